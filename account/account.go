@@ -1,16 +1,65 @@
 package account
 
 import (
+	"strings"
+	"time"
+
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	uuid "github.com/satori/go.uuid"
 )
 
 // Currency represents the key for global currency
-type Currency string
+type Currency = money.Currency
+
+// Status tells if the account can send and receive money
+type Status string
+
+const (
+	// StatusActive account sends and receives money
+	StatusActive Status = "active"
+
+	// StatusFrozen account is blocked until it is unfrozen
+	StatusFrozen Status = "frozen"
+
+	// StatusClosed account is blocked for good
+	StatusClosed Status = "closed"
+)
 
-// Account represents id holding multiple currencies
+// Account represents id holding multiple currencies.
+// Balances are posted by the ledger, Held is reserved by authorizations and not available for transfers.
+// CreditLimits allow the balance to go negative down to minus the limit.
 type Account struct {
-	ID       string               `json:"id"`
-	Balances map[Currency]float64 `json:"balances,omitempty"`
+	ID           string                   `json:"id"`
+	Status       Status                   `json:"status"`
+	Name         string                   `json:"name,omitempty"`
+	ExternalRef  string                   `json:"external_ref,omitempty"`
+	Metadata     map[string]string        `json:"metadata,omitempty"`
+	Balances     map[Currency]money.Money `json:"balances,omitempty"`
+	Held         map[Currency]money.Money `json:"held,omitempty"`
+	CreditLimits map[Currency]money.Money `json:"credit_limits,omitempty"`
+}
+
+// MaxMetadata is the number of metadata keys an account can have
+const MaxMetadata = 50
+
+// Profile changes descriptive fields of an account, nil fields are not changed.
+// Metadata keys are merged into the account metadata, empty value removes the key.
+type Profile struct {
+	Name        *string           `json:"name"`
+	ExternalRef *string           `json:"external_ref"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// Summary is the activity of an account recorded in the ledger
+type Summary struct {
+	Transactions int        `json:"transactions"`
+	Incoming     int        `json:"incoming"`
+	Outgoing     int        `json:"outgoing"`
+	Adjustments  int        `json:"adjustments"`
+	LastActivity *time.Time `json:"last_activity,omitempty"`
 }
 
 // Repository provides access a account store.
@@ -18,41 +67,252 @@ type Repository interface {
 	Store(*Account) error
 	Find(id string) (*Account, error)
 	FindAll() []*Account
+
+	// FindPage returns accounts after the page cursor and cursor of the next page
+	FindPage(page.Request) ([]*Account, string, error)
+
+	// Update loads the account, calls fn and stores the account atomically, nothing is stored if fn fails
+	Update(id string, fn func(*Account) error) error
+
+	// FindByExternalRef returns account with the external reference
+	FindByExternalRef(string) (*Account, error)
+
+	// Adjust loads the account, calls fn and posts the returned ledger entry atomically,
+	// nothing is posted if fn fails or returns no entry
+	Adjust(id string, fn func(*Account) (*ledger.Entry, error)) error
+
+	// Summary returns activity of the account kept up to date by ledger postings
+	Summary(id string) (*Summary, error)
 }
 
 // New creates account with id
 func New() *Account {
 	return &Account{
 		ID:       uuid.Must(uuid.NewV4()).String(),
-		Balances: make(map[Currency]float64),
+		Status:   StatusActive,
+		Balances: make(map[Currency]money.Money),
 	}
 }
 
+// Apply changes descriptive fields of the account
+func (a *Account) Apply(p Profile) error {
+	if p.Name != nil {
+		a.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.ExternalRef != nil {
+		a.ExternalRef = strings.TrimSpace(*p.ExternalRef)
+	}
+	for key, value := range p.Metadata {
+		if key == "" {
+			return problem.New(problem.Invalid, "metadata key can not be empty")
+		}
+		if value == "" {
+			delete(a.Metadata, key)
+			continue
+		}
+		if a.Metadata == nil {
+			a.Metadata = make(map[string]string)
+		}
+		a.Metadata[key] = value
+	}
+	if len(a.Metadata) > MaxMetadata {
+		return problem.New(problem.Invalid, "account can have at most %d metadata keys", MaxMetadata)
+	}
+	return nil
+}
+
+// IsActive checks if the account can send and receive money, accounts without status are active
+func (a *Account) IsActive() bool {
+	return a.Status == "" || a.Status == StatusActive
+}
+
+// CheckActive returns conflict error if the account can not send or receive money
+func (a *Account) CheckActive() error {
+	if a.IsActive() {
+		return nil
+	}
+	return problem.New(problem.Conflict, "%s account is %s", a.ID, a.Status)
+}
+
+// Freeze blocks active account
+func (a *Account) Freeze() error {
+	if !a.IsActive() {
+		return problem.New(problem.Conflict, "%s account is %s, only active can be frozen", a.ID, a.Status)
+	}
+	a.Status = StatusFrozen
+	return nil
+}
+
+// Unfreeze activates frozen account
+func (a *Account) Unfreeze() error {
+	if a.Status != StatusFrozen {
+		return problem.New(problem.Conflict, "%s account is %s, only frozen can be unfrozen", a.ID, a.Status)
+	}
+	a.Status = StatusActive
+	return nil
+}
+
+// Close blocks the account for good, all balances must be zero and nothing held
+func (a *Account) Close() error {
+	if a.Status == StatusClosed {
+		return problem.New(problem.Conflict, "%s account is already closed", a.ID)
+	}
+	for _, balance := range a.Balances {
+		if !balance.IsZero() {
+			return problem.New(problem.Conflict, "%s account has balance %s", a.ID, balance)
+		}
+	}
+	for _, held := range a.Held {
+		if !held.IsZero() {
+			return problem.New(problem.Conflict, "%s account has held %s", a.ID, held)
+		}
+	}
+	a.Status = StatusClosed
+	return nil
+}
+
 // BalanceFor returns amount for given currency
-func (a *Account) BalanceFor(currency Currency) float64 {
-	return a.Balances[currency]
+func (a *Account) BalanceFor(currency Currency) money.Money {
+	balance, ok := a.Balances[currency]
+	if !ok {
+		return money.New(0, currency)
+	}
+	return balance
 }
 
 // SetBalance hard reset balance for given currency
-func (a *Account) SetBalance(currency Currency, amount float64) {
+func (a *Account) SetBalance(amount money.Money) {
 	if a.Balances == nil {
-		a.Balances = make(map[Currency]float64)
+		a.Balances = make(map[Currency]money.Money)
 	}
-	a.Balances[currency] = amount
+	a.Balances[amount.Currency] = amount
 }
 
 // AppendBalance adds or removes from account balance for given currency
-func (a *Account) AppendBalance(currency Currency, amount float64) {
-	if a.Balances == nil {
-		a.Balances = make(map[Currency]float64)
+func (a *Account) AppendBalance(amount money.Money) {
+	balance := a.BalanceFor(amount.Currency)
+	a.SetBalance(money.New(balance.Units+amount.Units, amount.Currency))
+}
+
+// HeldFor returns amount reserved by authorizations for given currency
+func (a *Account) HeldFor(currency Currency) money.Money {
+	held, ok := a.Held[currency]
+	if !ok {
+		return money.New(0, currency)
 	}
-	a.Balances[currency] += amount
+	return held
 }
 
-// HasFunds checks if the account has enough amount for given currency
-func (a *Account) HasFunds(currency Currency, amount float64) bool {
-	if a.Balances == nil {
-		a.Balances = make(map[Currency]float64)
+// AvailableFor returns balance less held amount for given currency
+func (a *Account) AvailableFor(currency Currency) money.Money {
+	return money.New(a.BalanceFor(currency).Units-a.HeldFor(currency).Units, currency)
+}
+
+// Available returns available amount for every currency with balance or hold
+func (a *Account) Available() map[Currency]money.Money {
+	available := make(map[Currency]money.Money)
+	for currency := range a.Balances {
+		available[currency] = a.AvailableFor(currency)
+	}
+	for currency := range a.Held {
+		available[currency] = a.AvailableFor(currency)
+	}
+	return available
+}
+
+// Hold reserves amount, so it is not available until released
+func (a *Account) Hold(amount money.Money) {
+	if a.Held == nil {
+		a.Held = make(map[Currency]money.Money)
+	}
+	held := a.HeldFor(amount.Currency)
+	a.Held[amount.Currency] = money.New(held.Units+amount.Units, amount.Currency)
+}
+
+// Release makes held amount available again
+func (a *Account) Release(amount money.Money) {
+	held := a.HeldFor(amount.Currency)
+	if held.Units <= amount.Units {
+		delete(a.Held, amount.Currency)
+		return
+	}
+	a.Held[amount.Currency] = money.New(held.Units-amount.Units, amount.Currency)
+}
+
+// CreditLimitFor returns how far below zero the balance can go for given currency
+func (a *Account) CreditLimitFor(currency Currency) money.Money {
+	limit, ok := a.CreditLimits[currency]
+	if !ok {
+		return money.New(0, currency)
+	}
+	return limit
+}
+
+// SetCreditLimit sets credit limit for given currency, zero removes it
+func (a *Account) SetCreditLimit(limit money.Money) {
+	if limit.IsZero() {
+		delete(a.CreditLimits, limit.Currency)
+		return
+	}
+	if a.CreditLimits == nil {
+		a.CreditLimits = make(map[Currency]money.Money)
+	}
+	a.CreditLimits[limit.Currency] = limit
+}
+
+// HasFunds checks if the account has enough available amount and credit for given currency
+func (a *Account) HasFunds(amount money.Money) bool {
+	return a.AvailableFor(amount.Currency).Units+a.CreditLimitFor(amount.Currency).Units >= amount.Units
+}
+
+// Summarize counts entries posted to the account
+func Summarize(id string, entries []*ledger.Entry) *Summary {
+	summary := &Summary{}
+	for _, entry := range entries {
+		summary.Add(id, entry)
+	}
+	return summary
+}
+
+// Add counts the entry once if it is posted to the account. Transfer is incoming or outgoing by the net
+// of all account postings per currency, multi-leg transfer receiving one currency and sending another is both.
+func (s *Summary) Add(id string, entry *ledger.Entry) {
+	found := false
+	net := map[money.Currency]int64{}
+	for _, p := range entry.Postings {
+		if p.Account == id {
+			found = true
+			net[p.Amount.Currency] += p.Amount.Units
+		}
+	}
+	if !found {
+		return
+	}
+
+	switch entry.Type {
+	case ledger.EntryTransfer:
+		s.Transactions++
+		incoming, outgoing := false, false
+		for _, units := range net {
+			incoming = incoming || units > 0
+			outgoing = outgoing || units < 0
+		}
+		if incoming {
+			s.Incoming++
+		}
+		if outgoing {
+			s.Outgoing++
+		}
+	case ledger.EntryAdjustment:
+		s.Adjustments++
+	}
+
+	// entries posted before the timestamp was recorded have zero time
+	if entry.Posted.IsZero() {
+		return
+	}
+	if s.LastActivity == nil || entry.Posted.After(*s.LastActivity) {
+		posted := entry.Posted
+		s.LastActivity = &posted
 	}
-	return a.Balances[currency] >= amount
 }
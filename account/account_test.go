@@ -3,16 +3,28 @@ package account
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/go-kit/kit/log"
 )
 
 type FakeRepo struct {
 	makeError bool
+
+	// balance is the USD balance adjusted by entries posted to ledger
+	balance int64
+	ledger  *FakeRepoLedger
 }
 
 func (f *FakeRepo) Store(*Account) error {
@@ -31,6 +43,91 @@ func (f *FakeRepo) Find(id string) (*Account, error) {
 func (f *FakeRepo) FindAll() []*Account {
 	return []*Account{}
 }
+func (f *FakeRepo) FindPage(page.Request) ([]*Account, string, error) {
+	if f.makeError {
+		return nil, "", errors.New("test error")
+	}
+	return []*Account{}, "", nil
+}
+func (f *FakeRepo) Update(id string, fn func(*Account) error) error {
+	if f.makeError {
+		return errors.New("test error")
+	}
+	return fn(&Account{ID: id})
+}
+func (f *FakeRepo) Adjust(id string, fn func(*Account) (*ledger.Entry, error)) error {
+	if f.makeError {
+		return errors.New("test error")
+	}
+	acc := &Account{ID: id}
+	acc.SetBalance(money.New(f.balance, "USD"))
+	entry, err := fn(acc)
+	if err != nil || entry == nil {
+		return err
+	}
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	for _, p := range entry.Postings {
+		if p.Account == id {
+			f.balance += p.Amount.Units
+		}
+	}
+	return f.ledger.Post(entry)
+}
+func (f *FakeRepo) Summary(id string) (*Summary, error) {
+	if f.makeError {
+		return nil, errors.New("test error")
+	}
+	return Summarize(id, f.ledger.entries), nil
+}
+func (f *FakeRepo) FindByExternalRef(ref string) (*Account, error) {
+	if f.makeError {
+		return nil, errors.New("test error")
+	}
+	if ref != "customer-1" {
+		return nil, problem.New(problem.NotFound, "account with external reference %s not found", ref)
+	}
+	return &Account{ID: "123", ExternalRef: ref}, nil
+}
+
+type FakeRepoLedger struct {
+	entries []*ledger.Entry
+}
+
+func (f *FakeRepoLedger) Post(e *ledger.Entry) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	f.entries = append(f.entries, e)
+	return nil
+}
+func (f *FakeRepoLedger) Find(id string) (*ledger.Entry, error) {
+	return nil, errors.New("not found")
+}
+func (f *FakeRepoLedger) FindAll() []*ledger.Entry {
+	return f.entries
+}
+func (f *FakeRepoLedger) Snapshot() ([]*ledger.Entry, map[string][]money.Money) {
+	return f.entries, nil
+}
+
+type FakeRepoCurrency struct {
+	disabled bool
+}
+
+func (f *FakeRepoCurrency) Store(*currency.Currency) error {
+	return nil
+}
+func (f *FakeRepoCurrency) Find(code money.Currency) (*currency.Currency, error) {
+	info, _ := money.Lookup(code)
+	c := currency.New(info)
+	c.Enabled = !f.disabled
+	return c, nil
+}
+func (f *FakeRepoCurrency) FindAll() []*currency.Currency {
+	return currency.Defaults()
+}
 
 func TestAccountModel(t *testing.T) {
 
@@ -42,36 +139,177 @@ func TestAccountModel(t *testing.T) {
 	}
 
 	amount := acc.BalanceFor("USD")
-	if amount > 0 {
+	if !amount.IsZero() {
 		t.Errorf("Account balance map not initialized with zero values, got: %v", amount)
 		return
 	}
 
-	acc.SetBalance("USD", 10)
+	acc.SetBalance(money.New(10, "USD"))
 	amount = acc.BalanceFor("USD")
-	if amount != 10 {
-		t.Errorf("expected %v got %v", 10, amount)
+	if amount.Units != 10 {
+		t.Errorf("expected %v got %v", 10, amount.Units)
 		return
 	}
 
-	if !acc.HasFunds("USD", 10) {
+	if !acc.HasFunds(money.New(10, "USD")) {
 		t.Error("Account does not have required balance")
 		return
 	}
 
-	acc.AppendBalance("USD", 1)
+	if acc.HasFunds(money.New(11, "USD")) {
+		t.Error("Account should not have more than balance")
+		return
+	}
+
+	acc.AppendBalance(money.New(1, "USD"))
 	amount = acc.BalanceFor("USD")
-	if amount != 11 {
-		t.Errorf("expected %v got %v", 11, amount)
+	if amount.Units != 11 {
+		t.Errorf("expected %v got %v", 11, amount.Units)
+		return
+	}
+
+	// 0.1 + 0.2 must be exactly 0.3
+	acc.SetBalance(money.New(0, "EUR"))
+	for _, v := range []string{"0.1", "0.2"} {
+		m, err := money.Parse(v, "EUR")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		acc.AppendBalance(m)
+	}
+	if acc.BalanceFor("EUR").Decimal() != "0.30" {
+		t.Errorf("expected %v got %v", "0.30", acc.BalanceFor("EUR").Decimal())
+	}
+
+	// held amount stays in balance but is not available
+	acc.Hold(money.New(4, "USD"))
+	if acc.BalanceFor("USD").Units != 11 || acc.AvailableFor("USD").Units != 7 {
+		t.Errorf("expected balance %v available %v, got %v %v", 11, 7, acc.BalanceFor("USD").Units, acc.AvailableFor("USD").Units)
+		return
+	}
+	if acc.HasFunds(money.New(8, "USD")) {
+		t.Error("Account should not spend held amount")
+		return
+	}
+	buff, err := json.Marshal(acc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(buff), `"held":{"USD":{"value":"0.04","currency":"USD"}}`) || strings.Contains(string(buff), `"available"`) {
+		t.Errorf("expected held amount without derived available in %s", buff)
+		return
+	}
+	// available amounts are added to responses only
+	if buff, _ = json.Marshal(view(acc)); !strings.Contains(string(buff), `"available":{"EUR":{"value":"0.30","currency":"EUR"},"USD":{"value":"0.07","currency":"USD"}}`) || !strings.Contains(string(buff), `"id":"`+acc.ID+`"`) {
+		t.Errorf("expected account with available amounts in %s", buff)
+		return
+	}
+	acc.Release(money.New(4, "USD"))
+	if len(acc.Held) != 0 || !acc.HasFunds(money.New(11, "USD")) {
+		t.Errorf("expected released hold, got %v", acc.Held)
+		return
+	}
+
+	// credit limit lets the balance go negative
+	acc.SetCreditLimit(money.New(5, "USD"))
+	if !acc.HasFunds(money.New(16, "USD")) || acc.HasFunds(money.New(17, "USD")) {
+		t.Errorf("expected credit limit to extend funds, got %v", acc.CreditLimits)
+		return
+	}
+	acc.SetCreditLimit(money.New(0, "USD"))
+	if len(acc.CreditLimits) != 0 || acc.HasFunds(money.New(12, "USD")) {
+		t.Errorf("expected credit limit to be removed, got %v", acc.CreditLimits)
+	}
+}
+
+func TestAccountProfile(t *testing.T) {
+	acc := New()
+	name, ref := " Shop ", "customer-1"
+	err := acc.Apply(Profile{Name: &name, ExternalRef: &ref, Metadata: map[string]string{"tier": "gold", "region": "eu"}})
+	if err != nil {
+		t.Errorf("error applying profile %v", err)
+		return
+	}
+	if acc.Name != "Shop" || acc.ExternalRef != ref || len(acc.Metadata) != 2 {
+		t.Errorf("unexpected profile %+v", acc)
+		return
+	}
+
+	// missing fields are kept, empty metadata value removes the key
+	if err := acc.Apply(Profile{Metadata: map[string]string{"tier": "", "plan": "pro"}}); err != nil {
+		t.Errorf("error applying profile %v", err)
+		return
+	}
+	if acc.Name != "Shop" || acc.Metadata["tier"] != "" || acc.Metadata["plan"] != "pro" || len(acc.Metadata) != 2 {
+		t.Errorf("unexpected merged profile %+v", acc)
+		return
+	}
+
+	if err := acc.Apply(Profile{Metadata: map[string]string{"": "x"}}); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected empty metadata key to be invalid, got %v", err)
+	}
+	many := make(map[string]string)
+	for i := 0; i <= MaxMetadata; i++ {
+		many[strings.Repeat("k", i+1)] = "v"
 	}
+	if err := New().Apply(Profile{Metadata: many}); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected too many metadata keys to be invalid, got %v", err)
+	}
+}
 
+func TestAccountStatus(t *testing.T) {
+	acc := New()
+	if acc.Status != StatusActive || acc.CheckActive() != nil {
+		t.Errorf("expected new account to be active, got %v", acc.Status)
+		return
+	}
+	if err := acc.Unfreeze(); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict unfreezing active account, got %v", err)
+	}
+	if err := acc.Freeze(); err != nil || acc.Status != StatusFrozen {
+		t.Errorf("expected frozen account, got %v %v", acc.Status, err)
+		return
+	}
+	if err := acc.CheckActive(); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict for frozen account, got %v", err)
+	}
+	if err := acc.Unfreeze(); err != nil || !acc.IsActive() {
+		t.Errorf("expected active account, got %v %v", acc.Status, err)
+		return
+	}
+
+	acc.SetBalance(money.New(1, "USD"))
+	if err := acc.Close(); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict closing account with balance, got %v", err)
+	}
+	acc.SetBalance(money.New(0, "USD"))
+	acc.Hold(money.New(1, "EUR"))
+	if err := acc.Close(); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict closing account with hold, got %v", err)
+	}
+	acc.Release(money.New(1, "EUR"))
+	if err := acc.Close(); err != nil || acc.Status != StatusClosed {
+		t.Errorf("expected closed account, got %v %v", acc.Status, err)
+		return
+	}
+	if err := acc.Freeze(); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict freezing closed account, got %v", err)
+	}
+
+	// records stored before statuses are active
+	if legacy := (&Account{ID: "123"}); !legacy.IsActive() {
+		t.Error("expected account without status to be active")
+	}
 }
 
 func TestAccountService(t *testing.T) {
-	fr := &FakeRepo{}
+	lr := &FakeRepoLedger{}
+	fr := &FakeRepo{ledger: lr}
 	service := NewService(fr)
 
-	account, err := service.CreateAccount()
+	account, err := service.CreateAccount(Profile{})
 	if err != nil {
 		t.Error("Service cannot create account ", err)
 	}
@@ -87,18 +325,42 @@ func TestAccountService(t *testing.T) {
 		t.Error("Service did not get an account, got nil")
 	}
 
-	account, err = service.SetBalanceForAccount(&Account{ID: "123"}, Currency("USD"), 1)
+	account, err = service.SetBalanceForAccount("123", money.New(1, "USD"))
 	if err != nil {
 		t.Error("Service cannot set balance for account ", err)
 	}
 	if account == nil {
 		t.Error("Service did not set an balance, got nil")
 	}
+	if len(lr.entries) != 1 || lr.entries[0].Type != ledger.EntryAdjustment {
+		t.Errorf("expected balance change to be posted as adjustment, got %v entries", len(lr.entries))
+	}
+
+	// same balance does not need adjustment
+	if _, err := service.SetBalanceForAccount("123", money.New(1, "USD")); err != nil {
+		t.Error("Service cannot set balance for account ", err)
+	}
+	if len(lr.entries) != 1 {
+		t.Errorf("expected no adjustment for unchanged balance, got %v entries", len(lr.entries))
+	}
+
+	// a transfer settled after the client read the account does not shift the reset
+	if _, err := service.GetAccount("123"); err != nil {
+		t.Error(err)
+	}
+	fr.balance += 3
+	if _, err := service.SetBalanceForAccount("123", money.New(10, "USD")); err != nil || fr.balance != 10 {
+		t.Errorf("expected balance reset to 10, got %v %v", fr.balance, err)
+	}
+
+	if _, err := service.SetCreditLimit("123", money.New(-1, "USD")); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected negative credit limit to be invalid, got %v", err)
+	}
 
 	// lets handle errors
 	fr.makeError = true
 	err = nil
-	_, err = service.CreateAccount()
+	_, err = service.CreateAccount(Profile{})
 	if err == nil {
 		t.Error("Service should yield error for creation an account, got nil ")
 	}
@@ -110,21 +372,79 @@ func TestAccountService(t *testing.T) {
 	}
 
 	err = nil
-	_, err = service.SetBalanceForAccount(&Account{}, Currency("USD"), 1)
+	_, err = service.SetBalanceForAccount("123", money.New(1, "USD"))
 	if err == nil {
 		t.Error("Service should yield error for setting a balance, got nil")
 	}
 
+	if _, err := service.SetCreditLimit("123", money.New(1, "USD")); err == nil {
+		t.Error("Service should yield error for setting a credit limit, got nil")
+	}
+
+}
+
+func TestAccountSummary(t *testing.T) {
+	older := ledger.Transfer("tx1", "123", "222", money.New(10, "USD"))
+	older.Posted = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := ledger.Transfer("tx2", "222", "123", money.New(5, "USD"))
+	newer.Posted = time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+	adjustment := ledger.Adjustment("123", money.New(100, "USD"))
+	adjustment.Posted = time.Time{}
+	other := ledger.Transfer("tx3", "222", "333", money.New(1, "USD"))
+
+	summary := Summarize("123", []*ledger.Entry{newer, adjustment, older, other})
+	if summary.Transactions != 2 || summary.Incoming != 1 || summary.Outgoing != 1 || summary.Adjustments != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+		return
+	}
+	if summary.LastActivity == nil || !summary.LastActivity.Equal(newer.Posted) {
+		t.Errorf("expected last activity %v, got %v", newer.Posted, summary.LastActivity)
+	}
+
+	if summary := Summarize("444", []*ledger.Entry{older}); summary.Transactions != 0 || summary.LastActivity != nil {
+		t.Errorf("expected empty summary, got %+v", summary)
+		return
+	}
+
+	// account on both sides of multi-leg entry is counted once by its net movement, whatever the leg order
+	sends := ledger.New(ledger.EntryTransfer, "tx4",
+		ledger.Posting{Account: "123", Amount: money.New(3, "USD")},
+		ledger.Posting{Account: "222", Amount: money.New(7, "USD")},
+		ledger.Posting{Account: "123", Amount: money.New(-10, "USD")},
+	)
+	receives := ledger.New(ledger.EntryTransfer, "tx5",
+		ledger.Posting{Account: "123", Amount: money.New(-3, "USD")},
+		ledger.Posting{Account: "222", Amount: money.New(-7, "USD")},
+		ledger.Posting{Account: "123", Amount: money.New(10, "USD")},
+	)
+	if summary := Summarize("123", []*ledger.Entry{sends}); summary.Transactions != 1 || summary.Outgoing != 1 || summary.Incoming != 0 {
+		t.Errorf("expected one outgoing transfer, got %+v", summary)
+		return
+	}
+	if summary := Summarize("123", []*ledger.Entry{receives}); summary.Transactions != 1 || summary.Incoming != 1 || summary.Outgoing != 0 {
+		t.Errorf("expected one incoming transfer, got %+v", summary)
+	}
 }
 
 func TestAccountREST(t *testing.T) {
-	fr := &FakeRepo{}
+	lr := &FakeRepoLedger{}
+	fr := &FakeRepo{ledger: lr}
 	service := NewService(fr)
 
 	var logger = log.NewLogfmtLogger(os.Stderr)
-	handler := MakeHandler(service, logger)
+	cr := &FakeRepoCurrency{}
+	handler := MakeHandler(service, currency.NewService(cr), logger)
 
-	rr := makeRequest(t, "GET", "/accounts", handler)
+	rr := makeRequest(t, "GET", "/accounts?limit=10", handler)
+	listRes := listAccountsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(listRes.Accounts) > 0 || listRes.NextCursor != "" {
+		t.Errorf("expected list to be empty, got %+v", listRes)
+	}
+	makeStatusRequest(t, "GET", "/accounts?limit=x", nil, http.StatusBadRequest, handler)
 
 	rr = makeRequest(t, "POST", "/accounts", handler)
 	var res accountsResponse
@@ -132,40 +452,116 @@ func TestAccountREST(t *testing.T) {
 		t.Errorf("error decoding json %v", err)
 		return
 	}
-	if res.Error != "" {
-		t.Errorf("response with error %v", res.Error)
+	if res.Account == nil {
+		t.Error("expected created account, got nil")
 		return
 	}
 	t.Log(res)
 
-	// test with errors
-	fr.makeError = true
-
-	rr = makeRequest(t, "POST", "/accounts", handler)
+	rr = makeStatusRequest(t, "POST", "/accounts", strings.NewReader(`{"name":"Shop","external_ref":"customer-2","metadata":{"tier":"gold"}}`), http.StatusOK, handler)
 	res = accountsResponse{}
 	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
 		t.Error(err)
 		return
 	}
-	if res.Error == "" {
-		t.Error("expected error, but got nil")
+	if res.Account == nil || res.Account.Name != "Shop" || res.Account.ExternalRef != "customer-2" || res.Account.Metadata["tier"] != "gold" {
+		t.Errorf("expected account with profile, got %+v", res.Account)
 		return
 	}
+	makeStatusRequest(t, "POST", "/accounts", strings.NewReader(`{"name":`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "POST", "/accounts", strings.NewReader(`{"metadata":{"":"x"}}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "PATCH", "/accounts/123", strings.NewReader(`{"metadata":[]}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "PATCH", "/accounts/123", strings.NewReader(`{"name":"Renamed"}`), http.StatusOK, handler)
 
-	listRes := listAccountsResponse{}
-	rr = makeRequest(t, "GET", "/accounts", handler)
-	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+	for ref, want := range map[string]int{"customer-1": 1, "missing": 0} {
+		rr = makeRequest(t, "GET", "/accounts?external_ref="+ref, handler)
+		listRes = listAccountsResponse{}
+		if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+			t.Error(err)
+			return
+		}
+		if len(listRes.Accounts) != want {
+			t.Errorf("external reference %v, want %v accounts got %v", ref, want, len(listRes.Accounts))
+		}
+	}
+
+	balanceCases := map[string]int{
+		`{"currency":"usd","amount":10.50}`:    http.StatusOK,
+		`{"currency":"JPY","amount":"1000"}`:   http.StatusOK,
+		`{"currency":"US D","amount":10}`:      http.StatusBadRequest,
+		`{"currency":"FOO","amount":10}`:       http.StatusBadRequest,
+		`{"currency":"JPY","amount":10.5}`:     http.StatusBadRequest,
+		`{"currency":"USD","amount":"10.001"}`: http.StatusBadRequest,
+		`{"currency":"USD","amount":0}`:        http.StatusBadRequest,
+		`{"currency":"USD"`:                    http.StatusBadRequest,
+	}
+	for body, status := range balanceCases {
+		makeStatusRequest(t, "POST", "/accounts/123/balances", strings.NewReader(body), status, handler)
+	}
+
+	limitCases := map[string]int{
+		`{"currency":"usd","amount":"500"}`:   http.StatusOK,
+		`{"currency":"USD","amount":0}`:       http.StatusOK,
+		`{"currency":"USD","amount":"-1"}`:    http.StatusBadRequest,
+		`{"currency":"FOO","amount":10}`:      http.StatusBadRequest,
+		`{"currency":"","amount":10}`:         http.StatusBadRequest,
+		`{"currency":"USD","amount":"0.001"}`: http.StatusBadRequest,
+	}
+	for body, status := range limitCases {
+		makeStatusRequest(t, "PUT", "/accounts/123/limits", strings.NewReader(body), status, handler)
+	}
+
+	// fake repository does not keep the status, every account is active
+	makeRequest(t, "PUT", "/accounts/123/freeze", handler)
+	makeStatusRequest(t, "PUT", "/accounts/123/unfreeze", nil, http.StatusConflict, handler)
+	makeRequest(t, "PUT", "/accounts/123/close", handler)
+
+	rr = makeRequest(t, "GET", "/accounts/123", handler)
+	getRes := getAccountResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&getRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if getRes.Account == nil || getRes.Account.ID != "123" {
+		t.Errorf("expected account 123, got %+v", getRes.Account)
+		return
+	}
+	if getRes.Summary == nil || getRes.Summary.Adjustments != 2 || getRes.Summary.LastActivity == nil {
+		t.Errorf("expected summary with 2 adjustments, got %+v", getRes.Summary)
+		return
+	}
+
+	cr.disabled = true
+	rr = makeStatusRequest(t, "POST", "/accounts/123/balances", strings.NewReader(`{"currency":"USD","amount":1}`), http.StatusBadRequest, handler)
+	details := problem.Details{}
+	if err := json.NewDecoder(rr.Body).Decode(&details); err != nil {
 		t.Error(err)
 		return
 	}
-	if len(listRes.Accounts) > 0 {
-		t.Errorf("expected list to be empty, got %v", len(listRes.Accounts))
+	if details.Detail != currency.ErrCurrencyDisabled.Error() || details.Status != http.StatusBadRequest {
+		t.Errorf("expected disabled currency problem, got %+v", details)
 	}
 
+	// test with errors
+	fr.makeError = true
+
+	makeStatusRequest(t, "POST", "/accounts", nil, http.StatusInternalServerError, handler)
+	makeStatusRequest(t, "GET", "/accounts/123", nil, http.StatusInternalServerError, handler)
+	makeStatusRequest(t, "GET", "/accounts", nil, http.StatusInternalServerError, handler)
+	makeStatusRequest(t, "PUT", "/accounts/123/close", nil, http.StatusInternalServerError, handler)
+
 }
 
 func makeRequest(t *testing.T, method string, path string, handler http.Handler) *httptest.ResponseRecorder {
-	req, err := http.NewRequest(method, path, nil)
+	return makeBodyRequest(t, method, path, nil, handler)
+}
+
+func makeBodyRequest(t *testing.T, method string, path string, body io.Reader, handler http.Handler) *httptest.ResponseRecorder {
+	return makeStatusRequest(t, method, path, body, http.StatusOK, handler)
+}
+
+func makeStatusRequest(t *testing.T, method string, path string, body io.Reader, status int, handler http.Handler) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, body)
 	if err != nil {
 		t.Error(err)
 		t.Fail()
@@ -173,8 +569,8 @@ func makeRequest(t *testing.T, method string, path string, handler http.Handler)
 	}
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("error from http, expected 200 got %v", rr.Code)
+	if rr.Code != status {
+		t.Errorf("error from http %v %v, expected %v got %v", method, path, status, rr.Code)
 		t.Fail()
 		return nil
 	}
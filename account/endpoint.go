@@ -2,79 +2,207 @@ package account
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"strings"
 
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/go-kit/kit/endpoint"
 )
 
-type accountsRequest struct{}
+type accountsRequest struct {
+	Profile
+}
+
+// accountView is the account returned to clients with its available amounts
+type accountView struct {
+	*Account
+	Available map[Currency]money.Money `json:"available,omitempty"`
+}
+
+func view(a *Account) *accountView {
+	return &accountView{Account: a, Available: a.Available()}
+}
+
+func views(accounts []*Account) []*accountView {
+	res := make([]*accountView, len(accounts))
+	for i, a := range accounts {
+		res[i] = view(a)
+	}
+	return res
+}
 
 type accountsResponse struct {
-	Account *Account `json:"account"`
-	Error   string   `json:"error,omitempty"`
+	Account *accountView `json:"account"`
 }
 
 func makeAccountsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		res := accountsResponse{}
-		account, err := s.CreateAccount()
+		req := request.(accountsRequest)
+		account, err := s.CreateAccount(req.Profile)
+		if err != nil {
+			return nil, err
+		}
+		return accountsResponse{Account: view(account)}, nil
+	}
+}
+
+type updateAccountRequest struct {
+	Profile
+	ID string `json:"-"`
+}
+
+func makeUpdateAccountEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(updateAccountRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		account, err := s.UpdateAccount(req.ID, req.Profile)
 		if err != nil {
-			res.Error = err.Error()
+			return nil, err
 		}
-		res.Account = account
-		return res, nil
+		return accountsResponse{Account: view(account)}, nil
 	}
 }
 
-type listAccountsRequest struct{}
+type listAccountsRequest struct {
+	ExternalRef string
+	Page        page.Request
+}
 
 type listAccountsResponse struct {
-	Accounts []*Account `json:"accounts"`
+	Accounts   []*accountView `json:"accounts"`
+	NextCursor string         `json:"next_cursor,omitempty"`
 }
 
 func makeListAccountsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		return listAccountsResponse{Accounts: s.Accounts()}, nil
+		req := request.(listAccountsRequest)
+		if req.ExternalRef != "" {
+			account, err := s.AccountByExternalRef(req.ExternalRef)
+			if problem.Is(err, problem.NotFound) {
+				return listAccountsResponse{Accounts: []*accountView{}}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return listAccountsResponse{Accounts: []*accountView{view(account)}}, nil
+		}
+
+		accounts, next, err := s.Accounts(req.Page)
+		if err != nil {
+			return nil, err
+		}
+		return listAccountsResponse{Accounts: views(accounts), NextCursor: next}, nil
+	}
+}
+
+type getAccountRequest struct {
+	ID string
+}
+
+type getAccountResponse struct {
+	Account *accountView `json:"account"`
+	Summary *Summary     `json:"summary"`
+}
+
+func makeGetAccountEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getAccountRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		account, err := s.GetAccount(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		summary, err := s.GetSummary(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return getAccountResponse{Account: view(account), Summary: summary}, nil
+	}
+}
+
+type accountStatusRequest struct {
+	ID string
+}
+
+func makeAccountStatusEndpoint(change func(string) (*Account, error)) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(accountStatusRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		account, err := change(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return accountsResponse{Account: view(account)}, nil
+	}
+}
+
+type accountsLimitRequest struct {
+	Currency  string      `json:"currency"`
+	Amount    json.Number `json:"amount"`
+	AccountID string      `json:"-"`
+}
+
+func makeAccountsLimitEndpoint(s Service, cs currency.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(accountsLimitRequest)
+
+		if req.Currency == "" {
+			return nil, problem.New(problem.Invalid, "invalid currency set")
+		}
+		limit, err := cs.ParseAmount(req.Amount.String(), Currency(strings.ToUpper(req.Currency)))
+		if err != nil {
+			return nil, err
+		}
+
+		account, err := s.SetCreditLimit(req.AccountID, limit)
+		if err != nil {
+			return nil, err
+		}
+		return accountsResponse{Account: view(account)}, nil
 	}
 }
 
 type accountsBalanceRequest struct {
-	Currency  string  `json:"currency"`
-	Amount    float64 `json:"amount"`
-	AccountID string  `json:"-"`
+	Currency  string      `json:"currency"`
+	Amount    json.Number `json:"amount"`
+	AccountID string      `json:"-"`
 }
 
 type accountsBalanceResponse struct {
-	Account *Account `json:"account"`
-	Error   string   `json:"error,omitempty"`
+	Account *accountView `json:"account"`
 }
 
-func makeAccountsBalanceEndpoint(s Service) endpoint.Endpoint {
+func makeAccountsBalanceEndpoint(s Service, cs currency.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(accountsBalanceRequest)
-		res := accountsBalanceResponse{}
 
-		if req.Amount <= 0 {
-			res.Error = errors.New("invalid balance set").Error()
-			return res, nil
-		}
 		if req.Currency == "" {
-			res.Error = errors.New("invalid currency set").Error()
-			return res, nil
+			return nil, problem.New(problem.Invalid, "invalid currency set")
 		}
-
-		account, err := s.GetAccount(req.AccountID)
+		amount, err := cs.ParseAmount(req.Amount.String(), Currency(strings.ToUpper(req.Currency)))
 		if err != nil {
-			res.Error = err.Error()
-			return res, nil
+			return nil, err
+		}
+		if !amount.IsPositive() {
+			return nil, problem.New(problem.Invalid, "invalid balance set")
 		}
 
-		account, err = s.SetBalanceForAccount(account, Currency(strings.ToUpper(req.Currency)), req.Amount)
+		account, err := s.SetBalanceForAccount(req.AccountID, amount)
 		if err != nil {
-			res.Error = err.Error()
+			return nil, err
 		}
-		res.Account = account
-		return res, nil
+		return accountsBalanceResponse{Account: view(account)}, nil
 	}
 }
@@ -1,18 +1,46 @@
 package account
 
+import (
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
+)
+
 // Service is the interface that provides account methods.
 type Service interface {
-	// CreateAccount creates new account with generated ID
-	CreateAccount() (*Account, error)
+	// CreateAccount creates new account with generated ID and given profile
+	CreateAccount(Profile) (*Account, error)
+
+	// UpdateAccount changes profile of the account
+	UpdateAccount(string, Profile) (*Account, error)
+
+	// AccountByExternalRef returns account with the external reference
+	AccountByExternalRef(string) (*Account, error)
 
 	// GetAccount returns account by ID
 	GetAccount(string) (*Account, error)
 
-	// Accounts lists all accounts
-	Accounts() []*Account
+	// GetSummary returns activity of the account
+	GetSummary(string) (*Summary, error)
+
+	// Accounts lists page of accounts and returns cursor of the next page
+	Accounts(page.Request) ([]*Account, string, error)
 
 	// SetBalanceForAccount hard reset balance for account for given currency
-	SetBalanceForAccount(*Account, Currency, float64) (*Account, error)
+	SetBalanceForAccount(string, money.Money) (*Account, error)
+
+	// SetCreditLimit sets how far below zero the account balance can go in the currency of the limit
+	SetCreditLimit(string, money.Money) (*Account, error)
+
+	// FreezeAccount blocks the account from sending and receiving money
+	FreezeAccount(string) (*Account, error)
+
+	// UnfreezeAccount activates frozen account
+	UnfreezeAccount(string) (*Account, error)
+
+	// CloseAccount blocks the account for good, only accounts with zero balances can be closed
+	CloseAccount(string) (*Account, error)
 }
 
 type service struct {
@@ -26,22 +54,85 @@ func NewService(accounts Repository) Service {
 	}
 }
 
-func (s *service) CreateAccount() (*Account, error) {
+func (s *service) CreateAccount(p Profile) (*Account, error) {
 	acc := New()
+	if err := acc.Apply(p); err != nil {
+		return nil, err
+	}
 	err := s.accounts.Store(acc)
 	return acc, err
 }
 
-func (s *service) Accounts() []*Account {
-	return s.accounts.FindAll()
+func (s *service) UpdateAccount(id string, p Profile) (*Account, error) {
+	return s.update(id, func(acc *Account) error {
+		return acc.Apply(p)
+	})
+}
+
+func (s *service) AccountByExternalRef(ref string) (*Account, error) {
+	return s.accounts.FindByExternalRef(ref)
+}
+
+func (s *service) Accounts(p page.Request) ([]*Account, string, error) {
+	return s.accounts.FindPage(p)
 }
 
 func (s *service) GetAccount(id string) (*Account, error) {
 	return s.accounts.Find(id)
 }
 
-func (s *service) SetBalanceForAccount(account *Account, currency Currency, amount float64) (*Account, error) {
-	account.SetBalance(currency, amount)
-	err := s.accounts.Store(account)
-	return account, err
+func (s *service) GetSummary(id string) (*Summary, error) {
+	if _, err := s.accounts.Find(id); err != nil {
+		return nil, err
+	}
+	return s.accounts.Summary(id)
+}
+
+func (s *service) SetBalanceForAccount(id string, amount money.Money) (*Account, error) {
+	// balances are only changed by postings, so the reset is posted as an adjustment.
+	// The delta is computed in the same unit of work, a settlement can not change the balance meanwhile.
+	err := s.accounts.Adjust(id, func(acc *Account) (*ledger.Entry, error) {
+		if acc.Status == StatusClosed {
+			return nil, problem.New(problem.Conflict, "%s account is closed", acc.ID)
+		}
+		delta := amount.Units - acc.BalanceFor(amount.Currency).Units
+		if delta == 0 {
+			return nil, nil
+		}
+		return ledger.Adjustment(acc.ID, money.New(delta, amount.Currency)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.accounts.Find(id)
+}
+
+func (s *service) SetCreditLimit(id string, limit money.Money) (*Account, error) {
+	if limit.Units < 0 {
+		return nil, problem.New(problem.Invalid, "credit limit can not be negative")
+	}
+	return s.update(id, func(acc *Account) error {
+		acc.SetCreditLimit(limit)
+		return nil
+	})
+}
+
+func (s *service) FreezeAccount(id string) (*Account, error) {
+	return s.update(id, (*Account).Freeze)
+}
+
+func (s *service) UnfreezeAccount(id string) (*Account, error) {
+	return s.update(id, (*Account).Unfreeze)
+}
+
+func (s *service) CloseAccount(id string) (*Account, error) {
+	return s.update(id, (*Account).Close)
+}
+
+// update changes the account in one unit of work, settlement writes the same record
+func (s *service) update(id string, fn func(*Account) error) (*Account, error) {
+	if err := s.accounts.Update(id, fn); err != nil {
+		return nil, err
+	}
+	return s.accounts.Find(id)
 }
@@ -3,9 +3,12 @@ package account
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"io"
 	"net/http"
 
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/gorilla/mux"
 
 	kitlog "github.com/go-kit/kit/log"
@@ -13,11 +16,12 @@ import (
 )
 
 // MakeHandler returns a handler for the account service.
-func MakeHandler(as Service, logger kitlog.Logger) http.Handler {
+func MakeHandler(as Service, cs currency.Service, logger kitlog.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(problem.EncodeError),
 	}
 
 	accountsHandler := kithttp.NewServer(
@@ -27,6 +31,13 @@ func MakeHandler(as Service, logger kitlog.Logger) http.Handler {
 		opts...,
 	)
 
+	accountsUpdateHandler := kithttp.NewServer(
+		makeUpdateAccountEndpoint(as),
+		decodeUpdateAccountRequest,
+		encodeResponse,
+		opts...,
+	)
+
 	accountsListHandler := kithttp.NewServer(
 		makeListAccountsEndpoint(as),
 		decodeListAccountsRequest,
@@ -34,38 +45,145 @@ func MakeHandler(as Service, logger kitlog.Logger) http.Handler {
 		opts...,
 	)
 
+	accountsGetHandler := kithttp.NewServer(
+		makeGetAccountEndpoint(as),
+		decodeGetAccountRequest,
+		encodeResponse,
+		opts...,
+	)
+
 	accountsBalanceHandler := kithttp.NewServer(
-		makeAccountsBalanceEndpoint(as),
+		makeAccountsBalanceEndpoint(as, cs),
 		decodeAccountsBalanceRequest,
 		encodeResponse,
 		opts...,
 	)
 
+	accountsLimitHandler := kithttp.NewServer(
+		makeAccountsLimitEndpoint(as, cs),
+		decodeAccountsLimitRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	accountsFreezeHandler := kithttp.NewServer(
+		makeAccountStatusEndpoint(as.FreezeAccount),
+		decodeAccountStatusRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	accountsUnfreezeHandler := kithttp.NewServer(
+		makeAccountStatusEndpoint(as.UnfreezeAccount),
+		decodeAccountStatusRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	accountsCloseHandler := kithttp.NewServer(
+		makeAccountStatusEndpoint(as.CloseAccount),
+		decodeAccountStatusRequest,
+		encodeResponse,
+		opts...,
+	)
+
 	r.Handle("/accounts", accountsHandler).Methods("POST")
 	r.Handle("/accounts", accountsListHandler).Methods("GET")
+	r.Handle("/accounts/{id}", accountsGetHandler).Methods("GET")
+	r.Handle("/accounts/{id}", accountsUpdateHandler).Methods("PATCH")
 	r.Handle("/accounts/{id}/balances", accountsBalanceHandler).Methods("POST")
+	r.Handle("/accounts/{id}/limits", accountsLimitHandler).Methods("PUT")
+	r.Handle("/accounts/{id}/freeze", accountsFreezeHandler).Methods("PUT")
+	r.Handle("/accounts/{id}/unfreeze", accountsUnfreezeHandler).Methods("PUT")
+	r.Handle("/accounts/{id}/close", accountsCloseHandler).Methods("PUT")
 
 	return r
 }
 
+// decodeAccountsRequest accepts empty body for account without profile
 func decodeAccountsRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return accountsRequest{}, nil
+	var body accountsRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			return nil, problem.Wrap(problem.Invalid, err)
+		}
+	}
+	return body, nil
+}
+
+func decodeUpdateAccountRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+
+	var body updateAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, problem.Wrap(problem.Invalid, err)
+	}
+
+	body.ID = id
+	return body, nil
 }
 
 func decodeListAccountsRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return listAccountsRequest{}, nil
+	q := r.URL.Query()
+	p, err := page.FromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return listAccountsRequest{ExternalRef: q.Get("external_ref"), Page: p}, nil
+}
+
+func decodeGetAccountRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return getAccountRequest{
+		ID: id,
+	}, nil
 }
 
 func decodeAccountsBalanceRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
-		return nil, errors.New("bad request")
+		return nil, problem.New(problem.Invalid, "bad request")
 	}
 
 	var body accountsBalanceRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		return nil, err
+		return nil, problem.Wrap(problem.Invalid, err)
+	}
+
+	body.AccountID = id
+	return body, nil
+}
+
+func decodeAccountStatusRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return accountStatusRequest{
+		ID: id,
+	}, nil
+}
+
+func decodeAccountsLimitRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+
+	var body accountsLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, problem.Wrap(problem.Invalid, err)
 	}
 
 	body.AccountID = id
@@ -0,0 +1,37 @@
+package currency
+
+import "github.com/MarinX/kit-payment/money"
+
+// Currency represents ISO 4217 currency registered in the service
+type Currency struct {
+	Code     money.Currency `json:"code"`
+	Numeric  string         `json:"numeric"`
+	Exponent int            `json:"exponent"`
+	Enabled  bool           `json:"enabled"`
+}
+
+// Repository provides access a currency store.
+type Repository interface {
+	Store(*Currency) error
+	Find(code money.Currency) (*Currency, error)
+	FindAll() []*Currency
+}
+
+// New creates enabled currency from ISO 4217 info
+func New(info money.Info) *Currency {
+	return &Currency{
+		Code:     info.Code,
+		Numeric:  info.Numeric,
+		Exponent: info.Exponent,
+		Enabled:  true,
+	}
+}
+
+// Defaults returns all known ISO 4217 currencies, enabled
+func Defaults() []*Currency {
+	var currencies []*Currency
+	for _, info := range money.Currencies() {
+		currencies = append(currencies, New(info))
+	}
+	return currencies
+}
@@ -0,0 +1,161 @@
+package currency
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/go-kit/kit/log"
+)
+
+type FakeRepo struct {
+	currencies map[money.Currency]*Currency
+	makeError  bool
+}
+
+func newFakeRepo() *FakeRepo {
+	f := &FakeRepo{currencies: make(map[money.Currency]*Currency)}
+	for _, c := range Defaults() {
+		f.currencies[c.Code] = c
+	}
+	return f
+}
+
+func (f *FakeRepo) Store(c *Currency) error {
+	if f.makeError {
+		return errors.New("test error")
+	}
+	f.currencies[c.Code] = c
+	return nil
+}
+func (f *FakeRepo) Find(code money.Currency) (*Currency, error) {
+	if f.makeError {
+		return nil, errors.New("test error")
+	}
+	c, ok := f.currencies[code]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return c, nil
+}
+func (f *FakeRepo) FindAll() []*Currency {
+	return Defaults()
+}
+
+func TestCurrencyService(t *testing.T) {
+	fr := newFakeRepo()
+	service := NewService(fr)
+
+	c, err := service.GetCurrency("usd")
+	if err != nil {
+		t.Errorf("error getting currency %v", err)
+		return
+	}
+	if c.Numeric != "840" || c.Exponent != 2 || !c.Enabled {
+		t.Errorf("unexpected currency %+v", c)
+	}
+
+	if _, err := service.GetCurrency("FOO"); err != ErrUnknownCurrency {
+		t.Errorf("expected unknown currency, got %v", err)
+	}
+
+	m, err := service.ParseAmount("1000", "JPY")
+	if err != nil {
+		t.Errorf("error parsing amount %v", err)
+		return
+	}
+	if m.Units != 1000 {
+		t.Errorf("want %v got %v", 1000, m.Units)
+	}
+	if _, err := service.ParseAmount("10.5", "JPY"); err == nil {
+		t.Error("expected precision error, got nil")
+	}
+	if m, err := service.ParseAmount("1.005", "KWD"); err != nil || m.Units != 1005 {
+		t.Errorf("unexpected result %v %v", m, err)
+	}
+
+	if _, err := service.DisableCurrency("USD"); err != nil {
+		t.Errorf("error disabling currency %v", err)
+		return
+	}
+	if _, err := service.ParseAmount("1", "USD"); err != ErrCurrencyDisabled {
+		t.Errorf("expected disabled currency, got %v", err)
+	}
+	if _, err := service.EnableCurrency("USD"); err != nil {
+		t.Errorf("error enabling currency %v", err)
+		return
+	}
+	if _, err := service.ParseAmount("1", "USD"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	fr.makeError = true
+	if _, err := service.EnableCurrency("USD"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestCurrencyREST(t *testing.T) {
+	service := NewService(newFakeRepo())
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	handler := MakeHandler(service, logger)
+
+	rr := makeRequest(t, "GET", "/currencies", handler)
+	listRes := listCurrenciesResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(listRes.Currencies) == 0 {
+		t.Error("expected currencies, got none")
+		return
+	}
+
+	rr = makeRequest(t, "PUT", "/currencies/EUR/disable", handler)
+	res := currencyResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Currency == nil || res.Currency.Enabled {
+		t.Errorf("expected disabled currency, got %+v", res.Currency)
+		return
+	}
+
+	rr = makeRequest(t, "GET", "/currencies/EUR", handler)
+	res = currencyResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Currency == nil || res.Currency.Enabled {
+		t.Errorf("expected disabled currency, got %+v", res.Currency)
+		return
+	}
+
+	req, _ := http.NewRequest("PUT", "/currencies/FOO/enable", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown currency, got %v", rr.Code)
+	}
+}
+
+func makeRequest(t *testing.T, method string, path string, handler http.Handler) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("error from http, expected 200 got %v", rr.Code)
+		return nil
+	}
+	return rr
+}
@@ -0,0 +1,72 @@
+package currency
+
+import (
+	"context"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/go-kit/kit/endpoint"
+)
+
+type listCurrenciesRequest struct{}
+
+type listCurrenciesResponse struct {
+	Currencies []*Currency `json:"currencies"`
+}
+
+func makeListCurrenciesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return listCurrenciesResponse{Currencies: s.Currencies()}, nil
+	}
+}
+
+type getCurrencyRequest struct {
+	Code money.Currency
+}
+
+type currencyResponse struct {
+	Currency *Currency `json:"currency"`
+}
+
+func makeGetCurrencyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getCurrencyRequest)
+		if req.Code == "" {
+			return nil, problem.New(problem.Invalid, "missing required code")
+		}
+
+		c, err := s.GetCurrency(req.Code)
+		if err != nil {
+			return nil, err
+		}
+		return currencyResponse{Currency: c}, nil
+	}
+}
+
+type enableCurrencyRequest struct {
+	Code    money.Currency
+	Enabled bool
+}
+
+func makeEnableCurrencyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(enableCurrencyRequest)
+		if req.Code == "" {
+			return nil, problem.New(problem.Invalid, "missing required code")
+		}
+
+		var (
+			c   *Currency
+			err error
+		)
+		if req.Enabled {
+			c, err = s.EnableCurrency(req.Code)
+		} else {
+			c, err = s.DisableCurrency(req.Code)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return currencyResponse{Currency: c}, nil
+	}
+}
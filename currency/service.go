@@ -0,0 +1,91 @@
+package currency
+
+import (
+	"strings"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+)
+
+var (
+	// ErrUnknownCurrency is returned for codes which are not ISO 4217 currencies
+	ErrUnknownCurrency = problem.New(problem.NotFound, "unknown currency")
+
+	// ErrCurrencyDisabled is returned when the currency is not accepted by the service
+	ErrCurrencyDisabled = problem.New(problem.Invalid, "currency disabled")
+)
+
+// Service is the interface that provides currency methods.
+type Service interface {
+	// Currencies lists all registered currencies
+	Currencies() []*Currency
+
+	// GetCurrency returns currency by code
+	GetCurrency(money.Currency) (*Currency, error)
+
+	// EnableCurrency allows currency to be used in balances and transactions
+	EnableCurrency(money.Currency) (*Currency, error)
+
+	// DisableCurrency rejects currency in new balances and transactions
+	DisableCurrency(money.Currency) (*Currency, error)
+
+	// ParseAmount validates currency and converts decimal amount into money
+	ParseAmount(string, money.Currency) (money.Money, error)
+}
+
+type service struct {
+	currencies Repository
+}
+
+// NewService creates currency service
+func NewService(currencies Repository) Service {
+	return &service{
+		currencies: currencies,
+	}
+}
+
+func (s *service) Currencies() []*Currency {
+	return s.currencies.FindAll()
+}
+
+func (s *service) GetCurrency(code money.Currency) (*Currency, error) {
+	code = money.Currency(strings.ToUpper(string(code)))
+	if _, ok := money.Lookup(code); !ok {
+		return nil, ErrUnknownCurrency
+	}
+	return s.currencies.Find(code)
+}
+
+func (s *service) EnableCurrency(code money.Currency) (*Currency, error) {
+	return s.setEnabled(code, true)
+}
+
+func (s *service) DisableCurrency(code money.Currency) (*Currency, error) {
+	return s.setEnabled(code, false)
+}
+
+func (s *service) ParseAmount(amount string, code money.Currency) (money.Money, error) {
+	c, err := s.GetCurrency(code)
+	if problem.Is(err, problem.NotFound) {
+		// the currency is a field of the request, not the resource
+		return money.Money{}, problem.Wrap(problem.Invalid, err)
+	}
+	if err != nil {
+		return money.Money{}, err
+	}
+	if !c.Enabled {
+		return money.Money{}, ErrCurrencyDisabled
+	}
+	m, err := money.Parse(amount, c.Code)
+	return m, problem.Wrap(problem.Invalid, err)
+}
+
+func (s *service) setEnabled(code money.Currency, enabled bool) (*Currency, error) {
+	c, err := s.GetCurrency(code)
+	if err != nil {
+		return nil, err
+	}
+	c.Enabled = enabled
+	err = s.currencies.Store(c)
+	return c, err
+}
@@ -0,0 +1,93 @@
+package currency
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/gorilla/mux"
+
+	kitlog "github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// MakeHandler returns a handler for the currency service.
+func MakeHandler(cs Service, logger kitlog.Logger) http.Handler {
+	r := mux.NewRouter()
+
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(problem.EncodeError),
+	}
+
+	currenciesListHandler := kithttp.NewServer(
+		makeListCurrenciesEndpoint(cs),
+		decodeListCurrenciesRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	currenciesGetHandler := kithttp.NewServer(
+		makeGetCurrencyEndpoint(cs),
+		decodeGetCurrencyRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	currenciesEnableHandler := kithttp.NewServer(
+		makeEnableCurrencyEndpoint(cs),
+		decodeEnableCurrencyRequest(true),
+		encodeResponse,
+		opts...,
+	)
+
+	currenciesDisableHandler := kithttp.NewServer(
+		makeEnableCurrencyEndpoint(cs),
+		decodeEnableCurrencyRequest(false),
+		encodeResponse,
+		opts...,
+	)
+
+	r.Handle("/currencies", currenciesListHandler).Methods("GET")
+	r.Handle("/currencies/{code}", currenciesGetHandler).Methods("GET")
+	r.Handle("/currencies/{code}/enable", currenciesEnableHandler).Methods("PUT")
+	r.Handle("/currencies/{code}/disable", currenciesDisableHandler).Methods("PUT")
+
+	return r
+}
+
+func decodeListCurrenciesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return listCurrenciesRequest{}, nil
+}
+
+func decodeGetCurrencyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	code, ok := vars["code"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return getCurrencyRequest{
+		Code: money.Currency(code),
+	}, nil
+}
+
+func decodeEnableCurrencyRequest(enabled bool) kithttp.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		vars := mux.Vars(r)
+		code, ok := vars["code"]
+		if !ok {
+			return nil, problem.New(problem.Invalid, "bad request")
+		}
+		return enableCurrencyRequest{
+			Code:    money.Currency(code),
+			Enabled: enabled,
+		}, nil
+	}
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,259 @@
+// Package idempotency makes retried HTTP requests safe by replaying the first response.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/MarinX/kit-payment/uuid7"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// HeaderKey is the request header holding client generated idempotency key
+const HeaderKey = "Idempotency-Key"
+
+// HeaderReplayed is set on responses which are replayed from the store
+const HeaderReplayed = "Idempotent-Replayed"
+
+const (
+	// Lease is how long a request can stay in progress before a retry with the same key takes it over
+	Lease = time.Minute
+
+	// TTL is how long the stored response is replayed
+	TTL = 24 * time.Hour
+
+	// MaxBody is the largest request body buffered to compare retries
+	MaxBody = 1 << 20
+)
+
+// renewInterval is how often the lease of running request is extended
+var renewInterval = Lease / 3
+
+var (
+	// ErrExists is returned by Repository.Create when the key is already used
+	ErrExists = errors.New("idempotency key already exists")
+
+	// ErrMismatch is returned when the key is reused with a different request
+	ErrMismatch = errors.New("idempotency key reused with different request")
+
+	// ErrInProgress is returned when the first request with the key did not finish yet
+	ErrInProgress = errors.New("request with idempotency key in progress")
+
+	// ErrLeaseLost is returned by Repository.Store and Delete when the record was taken over by another request
+	ErrLeaseLost = errors.New("idempotency key taken over by another request")
+)
+
+// Record is the stored outcome of a request made with idempotency key
+type Record struct {
+	Key         string      `json:"key"`
+	RequestHash string      `json:"request_hash"`
+	StatusCode  int         `json:"status_code,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+
+	// ExpiresAt ends the lease of request in progress or the replay of completed one
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Token identifies the request holding the lease
+	Token string `json:"token,omitempty"`
+}
+
+// Repository provides access a idempotency record store.
+type Repository interface {
+	// Create stores the record only if the key does not exist yet or its record expired, otherwise returns ErrExists
+	Create(*Record) error
+	// Store replaces the record with the same token, otherwise returns ErrLeaseLost
+	Store(*Record) error
+	Find(key string) (*Record, error)
+	// Delete removes the record with the same token, otherwise returns ErrLeaseLost
+	Delete(*Record) error
+	// DeleteExpired removes records which expired before the time
+	DeleteExpired(before time.Time) error
+}
+
+// Completed checks if the response of the first request is stored
+func (r *Record) Completed() bool {
+	return r.StatusCode != 0
+}
+
+// Expired checks if the record can be replaced by a new request with the same key
+func (r *Record) Expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+// Middleware replays stored responses for requests carrying the Idempotency-Key header.
+// Keys are scoped by method and path, and a key reused with a different body is rejected.
+// The lease of running request is renewed, request which did not renew it in time, e.g. because the server crashed,
+// is run again on retry.
+func Middleware(records Repository, logger kitlog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HeaderKey)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			if body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBody)); err != nil {
+				problem.Write(w, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		record := &Record{
+			Key:         r.Method + " " + r.URL.Path + " " + key,
+			RequestHash: hash(body),
+			ExpiresAt:   time.Now().Add(Lease),
+			Token:       uuid7.New(),
+		}
+		err := records.Create(record)
+		if err == ErrExists {
+			replay(w, records, record)
+			return
+		}
+		if err != nil {
+			problem.Write(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		stopRenew := renew(records, record, logger)
+
+		// panic is not final either, release the key before it is propagated
+		defer func() {
+			if p := recover(); p != nil {
+				stopRenew()
+				release(records, record, logger)
+				panic(p)
+			}
+		}()
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		stopRenew()
+
+		// server errors are not final, the client is allowed to retry them
+		if rec.status >= http.StatusInternalServerError {
+			release(records, record, logger)
+			return
+		}
+		record.StatusCode = rec.status
+		record.Header = w.Header()
+		record.Body = rec.body.Bytes()
+		record.ExpiresAt = time.Now().Add(TTL)
+		if err := records.Store(record); err != nil {
+			// the response is already sent, the key stays in progress until the lease expires
+			// unless another request took it over
+			logger.Log("method", "store", "key", record.Key, "err", err)
+		}
+	})
+}
+
+// Sweep deletes expired records every interval until quit is closed
+func Sweep(records Repository, interval time.Duration, logger kitlog.Logger, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			if err := records.DeleteExpired(now); err != nil {
+				logger.Log("method", "sweep", "err", err)
+			}
+		}
+	}
+}
+
+// renew extends the lease of the record until the returned stop func is called and returns after the last renewal
+func renew(records Repository, record *Record, logger kitlog.Logger) func() {
+	lease := *record
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(renewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				lease.ExpiresAt = time.Now().Add(Lease)
+				err := records.Store(&lease)
+				if err == nil {
+					continue
+				}
+				logger.Log("method", "renew", "key", lease.Key, "err", err)
+				if err == ErrLeaseLost {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func release(records Repository, record *Record, logger kitlog.Logger) {
+	if err := records.Delete(record); err != nil {
+		// retry is rejected as in progress until the lease expires
+		logger.Log("method", "delete", "key", record.Key, "err", err)
+	}
+}
+
+func replay(w http.ResponseWriter, records Repository, record *Record) {
+	stored, err := records.Find(record.Key)
+	if err != nil {
+		problem.Write(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if stored.RequestHash != record.RequestHash {
+		problem.Write(w, http.StatusConflict, ErrMismatch.Error())
+		return
+	}
+	if !stored.Completed() {
+		problem.Write(w, http.StatusConflict, ErrInProgress.Error())
+		return
+	}
+
+	for k, v := range stored.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(HeaderReplayed, "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+func hash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// recorder passes the response to the client and keeps a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
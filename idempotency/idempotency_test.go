@@ -0,0 +1,268 @@
+package idempotency
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+type FakeRepo struct {
+	sync.Mutex
+	records  map[string]*Record
+	storeErr error
+}
+
+func (f *FakeRepo) Create(r *Record) error {
+	f.Lock()
+	defer f.Unlock()
+	if existing, ok := f.records[r.Key]; ok && !existing.Expired(time.Now()) {
+		return ErrExists
+	}
+	tmp := *r
+	f.records[r.Key] = &tmp
+	return nil
+}
+func (f *FakeRepo) Store(r *Record) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.storeErr != nil && r.Completed() {
+		return f.storeErr
+	}
+	if existing, ok := f.records[r.Key]; !ok || existing.Token != r.Token {
+		return ErrLeaseLost
+	}
+	tmp := *r
+	f.records[r.Key] = &tmp
+	return nil
+}
+func (f *FakeRepo) Find(key string) (*Record, error) {
+	f.Lock()
+	defer f.Unlock()
+	r, ok := f.records[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	tmp := *r
+	return &tmp, nil
+}
+func (f *FakeRepo) Delete(r *Record) error {
+	f.Lock()
+	defer f.Unlock()
+	if existing, ok := f.records[r.Key]; !ok || existing.Token != r.Token {
+		return ErrLeaseLost
+	}
+	delete(f.records, r.Key)
+	return nil
+}
+func (f *FakeRepo) DeleteExpired(before time.Time) error {
+	f.Lock()
+	defer f.Unlock()
+	for key, r := range f.records {
+		if r.Expired(before) {
+			delete(f.records, key)
+		}
+	}
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	fr := &FakeRepo{records: make(map[string]*Record)}
+	var logs bytes.Buffer
+	calls := 0
+	status := http.StatusOK
+	handler := Middleware(fr, kitlog.NewLogfmtLogger(&logs), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if status == 0 {
+			panic("handler failed")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"call":%d,"body":%q}`, calls, body)
+	}))
+
+	do := func(key string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/transactions", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(HeaderKey, key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := do("abc", `{"amount":1}`)
+	if first.Code != http.StatusOK || calls != 1 {
+		t.Errorf("expected first request to be handled, got %v after %v calls", first.Code, calls)
+		return
+	}
+
+	replayed := do("abc", `{"amount":1}`)
+	if calls != 1 {
+		t.Errorf("expected replay without calling handler, got %v calls", calls)
+		return
+	}
+	if replayed.Body.String() != first.Body.String() || replayed.Header().Get(HeaderReplayed) != "true" {
+		t.Errorf("expected stored response, got %v", replayed.Body.String())
+		return
+	}
+	if replayed.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected stored headers, got %v", replayed.Header())
+		return
+	}
+
+	conflict := do("abc", `{"amount":2}`)
+	if conflict.Code != http.StatusConflict || calls != 1 {
+		t.Errorf("expected conflict for different body, got %v", conflict.Code)
+		return
+	}
+
+	// requests without key are never deduplicated
+	do("", `{"amount":1}`)
+	do("", `{"amount":1}`)
+	if calls != 3 {
+		t.Errorf("expected requests without key to be handled, got %v calls", calls)
+		return
+	}
+
+	// server errors can be retried with the same key
+	status = http.StatusServiceUnavailable
+	do("retry", `{}`)
+	status = http.StatusOK
+	if rr := do("retry", `{}`); rr.Code != http.StatusOK || calls != 5 {
+		t.Errorf("expected retry after server error to be handled, got %v after %v calls", rr.Code, calls)
+		return
+	}
+
+	// in progress request is reported as conflict
+	fr.Create(&Record{Key: "POST /transactions pending", RequestHash: hash([]byte(`{}`)), ExpiresAt: time.Now().Add(Lease)})
+	if rr := do("pending", `{}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected conflict for request in progress, got %v", rr.Code)
+		return
+	}
+
+	// request which never finished is taken over once its lease expires
+	fr.records["POST /transactions pending"].ExpiresAt = time.Now().Add(-time.Second)
+	if rr := do("pending", `{}`); rr.Code != http.StatusOK || calls != 6 {
+		t.Errorf("expected expired lease to be taken over, got %v after %v calls", rr.Code, calls)
+		return
+	}
+	if r := fr.records["POST /transactions pending"]; !r.Completed() || r.Expired(time.Now().Add(TTL-time.Minute)) {
+		t.Errorf("expected completed record kept for TTL, got %+v", r)
+		return
+	}
+
+	// panic releases the key
+	status = 0
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic to be propagated")
+			}
+		}()
+		do("panic", `{}`)
+	}()
+	if _, ok := fr.records["POST /transactions panic"]; ok {
+		t.Error("expected key released after panic")
+		return
+	}
+
+	// failed store is logged, the key stays leased
+	status = http.StatusOK
+	fr.storeErr = errors.New("disk full")
+	do("store", `{}`)
+	fr.storeErr = nil
+	if !strings.Contains(logs.String(), "disk full") {
+		t.Errorf("expected store error logged, got %q", logs.String())
+		return
+	}
+	if r := fr.records["POST /transactions store"]; r == nil || r.Completed() {
+		t.Errorf("expected key in progress after failed store, got %+v", r)
+		return
+	}
+
+	// expired records are swept
+	fr.records["POST /transactions abc"].ExpiresAt = time.Now().Add(-time.Second)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Sweep(fr, time.Millisecond, kitlog.NewNopLogger(), quit)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(quit)
+	<-done
+	if _, ok := fr.records["POST /transactions abc"]; ok {
+		t.Error("expected expired record to be swept")
+	}
+	if _, ok := fr.records["POST /transactions pending"]; !ok {
+		t.Error("expected live record to be kept")
+	}
+}
+
+func TestMiddlewareLease(t *testing.T) {
+	renewInterval = time.Millisecond
+	defer func() { renewInterval = Lease / 3 }()
+
+	fr := &FakeRepo{records: make(map[string]*Record)}
+	var logs bytes.Buffer
+	var handle func(key string)
+	handler := Middleware(fr, kitlog.NewSyncLogger(kitlog.NewLogfmtLogger(&logs)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle("POST /transactions " + r.Header.Get(HeaderKey))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	do := func(key string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/transactions", strings.NewReader(body))
+		req.Header.Set(HeaderKey, key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// slow request keeps extending its lease
+	handle = func(key string) {
+		first, _ := fr.Find(key)
+		time.Sleep(20 * time.Millisecond)
+		if renewed, _ := fr.Find(key); !renewed.ExpiresAt.After(first.ExpiresAt) {
+			t.Errorf("expected renewed lease, got %v after %v", renewed.ExpiresAt, first.ExpiresAt)
+		}
+	}
+	if rr := do("slow", `{}`); rr.Code != http.StatusCreated {
+		t.Errorf("expected slow request to be handled, got %v", rr.Code)
+		return
+	}
+
+	// request which lost its lease leaves the record of the retry alone
+	handle = func(key string) {
+		fr.Lock()
+		fr.records[key] = &Record{Key: key, RequestHash: hash([]byte(`{}`)), ExpiresAt: time.Now().Add(Lease), Token: "retry"}
+		fr.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	do("taken", `{}`)
+	if r, _ := fr.Find("POST /transactions taken"); r == nil || r.Token != "retry" || r.Completed() {
+		t.Errorf("expected record of the retry kept, got %+v", r)
+		return
+	}
+	if !strings.Contains(logs.String(), ErrLeaseLost.Error()) {
+		t.Errorf("expected lost lease logged, got %q", logs.String())
+		return
+	}
+
+	// body is not buffered over the limit
+	handle = func(key string) {
+		t.Error("expected large body to be rejected before the handler")
+	}
+	if rr := do("large", strings.Repeat("x", MaxBody+1)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected too large body rejected, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package ledger
+
+import "github.com/MarinX/kit-payment/money"
+
+// Mismatch is an account whose cached balance differs from its postings
+type Mismatch struct {
+	Account string      `json:"account"`
+	Cached  money.Money `json:"cached"`
+	Posted  money.Money `json:"posted"`
+}
+
+// Report is the result of ledger invariant check
+type Report struct {
+	Balanced   bool                           `json:"balanced"`
+	Entries    int                            `json:"entries"`
+	Totals     map[money.Currency]money.Money `json:"totals"`
+	Mismatches []Mismatch                     `json:"mismatches,omitempty"`
+}
+
+// Check verifies that every currency nets to zero across the ledger
+// and cached account balances match the sum of their postings
+func Check(entries []*Entry, balances map[string][]money.Money) *Report {
+	report := &Report{
+		Entries: len(entries),
+		Totals:  Totals(entries...),
+	}
+
+	posted := make(map[string]map[money.Currency]int64)
+	for _, e := range entries {
+		for _, p := range e.Postings {
+			if p.Account == SystemAccount {
+				continue
+			}
+			if posted[p.Account] == nil {
+				posted[p.Account] = make(map[money.Currency]int64)
+			}
+			posted[p.Account][p.Amount.Currency] += p.Amount.Units
+		}
+	}
+
+	for account, cached := range balances {
+		for _, balance := range cached {
+			units := posted[account][balance.Currency]
+			if units != balance.Units {
+				report.Mismatches = append(report.Mismatches, Mismatch{
+					Account: account,
+					Cached:  balance,
+					Posted:  money.New(units, balance.Currency),
+				})
+			}
+			delete(posted[account], balance.Currency)
+		}
+	}
+	// postings for balances which are not cached at all
+	for account, currencies := range posted {
+		for currency, units := range currencies {
+			if units == 0 {
+				continue
+			}
+			report.Mismatches = append(report.Mismatches, Mismatch{
+				Account: account,
+				Cached:  money.New(0, currency),
+				Posted:  money.New(units, currency),
+			})
+		}
+	}
+
+	report.Balanced = len(report.Mismatches) == 0
+	for _, total := range report.Totals {
+		if !total.IsZero() {
+			report.Balanced = false
+		}
+	}
+	return report
+}
@@ -0,0 +1,55 @@
+package ledger
+
+import (
+	"context"
+
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/go-kit/kit/endpoint"
+)
+
+type listEntriesRequest struct{}
+
+type listEntriesResponse struct {
+	Entries []*Entry `json:"entries"`
+}
+
+func makeListEntriesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return listEntriesResponse{Entries: s.Entries()}, nil
+	}
+}
+
+type getEntryRequest struct {
+	ID string
+}
+
+type entryResponse struct {
+	Entry *Entry `json:"entry"`
+}
+
+func makeGetEntryEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getEntryRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		entry, err := s.GetEntry(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return entryResponse{Entry: entry}, nil
+	}
+}
+
+type checkRequest struct{}
+
+type checkResponse struct {
+	Report *Report `json:"report"`
+}
+
+func makeCheckEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return checkResponse{Report: s.Check()}, nil
+	}
+}
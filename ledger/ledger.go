@@ -0,0 +1,107 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+	uuid "github.com/satori/go.uuid"
+)
+
+// SystemAccount is the contra account for money entering or leaving the service
+const SystemAccount = "system"
+
+// ErrUnbalanced is returned when postings of an entry do not net to zero
+var ErrUnbalanced = problem.New(problem.Invalid, "unbalanced ledger entry")
+
+// EntryType describes why the entry was posted
+type EntryType string
+
+const (
+	// EntryTransfer moves money between two accounts
+	EntryTransfer EntryType = "transfer"
+
+	// EntryAdjustment is admin change of account balance
+	EntryAdjustment EntryType = "adjustment"
+
+	// EntryOpening carries balances which existed before the ledger
+	EntryOpening EntryType = "opening"
+)
+
+// Posting is a single credit (positive amount) or debit (negative amount) of an account
+type Posting struct {
+	Account string      `json:"account"`
+	Amount  money.Money `json:"amount"`
+}
+
+// Entry is a set of postings which net to zero in every currency
+type Entry struct {
+	ID        string    `json:"id"`
+	Type      EntryType `json:"type"`
+	Reference string    `json:"reference,omitempty"`
+	Postings  []Posting `json:"postings"`
+	Posted    time.Time `json:"posted"`
+}
+
+// Repository provides access a ledger store.
+type Repository interface {
+	// Post validates the entry, stores it and applies postings to cached account balances
+	Post(*Entry) error
+	Find(id string) (*Entry, error)
+	FindAll() []*Entry
+
+	// Snapshot returns all entries with cached balances of all accounts read at one point in time
+	Snapshot() ([]*Entry, map[string][]money.Money)
+}
+
+// New creates entry with generated ID
+func New(entryType EntryType, reference string, postings ...Posting) *Entry {
+	return &Entry{
+		ID:        uuid.Must(uuid.NewV4()).String(),
+		Type:      entryType,
+		Reference: reference,
+		Postings:  postings,
+		Posted:    time.Now().UTC(),
+	}
+}
+
+// Transfer creates entry debiting from and crediting to account
+func Transfer(reference string, from string, to string, amount money.Money) *Entry {
+	return New(EntryTransfer, reference,
+		Posting{Account: from, Amount: amount.Neg()},
+		Posting{Account: to, Amount: amount},
+	)
+}
+
+// Adjustment creates entry changing account balance against the system account
+func Adjustment(account string, amount money.Money) *Entry {
+	return New(EntryAdjustment, "",
+		Posting{Account: account, Amount: amount},
+		Posting{Account: SystemAccount, Amount: amount.Neg()},
+	)
+}
+
+// Validate checks if the postings net to zero per currency
+func (e *Entry) Validate() error {
+	if len(e.Postings) < 2 {
+		return ErrUnbalanced
+	}
+	for _, total := range Totals(e) {
+		if !total.IsZero() {
+			return ErrUnbalanced
+		}
+	}
+	return nil
+}
+
+// Totals sums postings of entries per currency
+func Totals(entries ...*Entry) map[money.Currency]money.Money {
+	totals := make(map[money.Currency]money.Money)
+	for _, e := range entries {
+		for _, p := range e.Postings {
+			total := totals[p.Amount.Currency]
+			totals[p.Amount.Currency] = money.New(total.Units+p.Amount.Units, p.Amount.Currency)
+		}
+	}
+	return totals
+}
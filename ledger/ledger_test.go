@@ -0,0 +1,159 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/go-kit/kit/log"
+)
+
+type FakeRepo struct {
+	entries  []*Entry
+	balances map[string][]money.Money
+}
+
+func (f *FakeRepo) Post(e *Entry) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	f.entries = append(f.entries, e)
+	return nil
+}
+func (f *FakeRepo) Find(id string) (*Entry, error) {
+	for _, e := range f.entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+func (f *FakeRepo) FindAll() []*Entry {
+	return f.entries
+}
+func (f *FakeRepo) Snapshot() ([]*Entry, map[string][]money.Money) {
+	return f.entries, f.balances
+}
+
+func TestLedgerModel(t *testing.T) {
+	entry := Transfer("tx", "123", "222", money.New(10, "USD"))
+	if entry.ID == "" {
+		t.Error("expected ID to be generated")
+		return
+	}
+	if err := entry.Validate(); err != nil {
+		t.Errorf("expected balanced transfer, got %v", err)
+		return
+	}
+
+	entry.Postings[1].Amount = money.New(9, "USD")
+	if err := entry.Validate(); err != ErrUnbalanced {
+		t.Errorf("expected unbalanced error, got %v", err)
+		return
+	}
+
+	// amounts in different currencies never balance each other
+	mixed := New(EntryTransfer, "",
+		Posting{Account: "123", Amount: money.New(-10, "USD")},
+		Posting{Account: "222", Amount: money.New(10, "EUR")},
+	)
+	if err := mixed.Validate(); err != ErrUnbalanced {
+		t.Errorf("expected unbalanced error, got %v", err)
+	}
+}
+
+func TestLedgerCheck(t *testing.T) {
+	entries := []*Entry{
+		Adjustment("123", money.New(100, "USD")),
+		Transfer("tx", "123", "222", money.New(30, "USD")),
+	}
+	balances := map[string][]money.Money{
+		"123": {money.New(70, "USD")},
+		"222": {money.New(30, "USD")},
+	}
+
+	report := Check(entries, balances)
+	if !report.Balanced {
+		t.Errorf("expected balanced ledger, got %+v", report)
+		return
+	}
+	if !report.Totals["USD"].IsZero() {
+		t.Errorf("expected USD to net to zero, got %v", report.Totals["USD"])
+		return
+	}
+
+	balances["222"] = []money.Money{money.New(31, "USD")}
+	report = Check(entries, balances)
+	if report.Balanced || len(report.Mismatches) != 1 {
+		t.Errorf("expected one mismatch, got %+v", report)
+		return
+	}
+
+	delete(balances, "222")
+	report = Check(entries, balances)
+	if report.Balanced || len(report.Mismatches) != 1 {
+		t.Errorf("expected mismatch for uncached balance, got %+v", report)
+	}
+}
+
+func TestLedgerREST(t *testing.T) {
+	fr := &FakeRepo{}
+	service := NewService(fr)
+	entry := Adjustment("123", money.New(100, "USD"))
+	fr.Post(entry)
+	fr.balances = map[string][]money.Money{"123": {money.New(100, "USD")}}
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	handler := MakeHandler(service, logger)
+
+	rr := makeRequest(t, "GET", "/ledger/entries", handler)
+	listRes := listEntriesResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(listRes.Entries) != 1 {
+		t.Errorf("expected 1 entry, got %v", len(listRes.Entries))
+		return
+	}
+
+	rr = makeRequest(t, "GET", "/ledger/entries/"+entry.ID, handler)
+	res := entryResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Entry == nil || res.Entry.ID != entry.ID {
+		t.Errorf("expected entry %v, got %+v", entry.ID, res.Entry)
+		return
+	}
+
+	rr = makeRequest(t, "GET", "/ledger/check", handler)
+	checkRes := checkResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&checkRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if !checkRes.Report.Balanced {
+		t.Errorf("expected balanced ledger, got %+v", checkRes.Report)
+	}
+}
+
+func makeRequest(t *testing.T, method string, path string, handler http.Handler) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("error from http, expected 200 got %v", rr.Code)
+		return nil
+	}
+	return rr
+}
@@ -0,0 +1,37 @@
+package ledger
+
+// Service is the interface that provides ledger methods.
+type Service interface {
+	// Entries lists all ledger entries
+	Entries() []*Entry
+
+	// GetEntry returns ledger entry by ID
+	GetEntry(string) (*Entry, error)
+
+	// Check verifies ledger invariants
+	Check() *Report
+}
+
+type service struct {
+	entries Repository
+}
+
+// NewService creates ledger service
+func NewService(entries Repository) Service {
+	return &service{
+		entries: entries,
+	}
+}
+
+func (s *service) Entries() []*Entry {
+	return s.entries.FindAll()
+}
+
+func (s *service) GetEntry(id string) (*Entry, error) {
+	return s.entries.Find(id)
+}
+
+func (s *service) Check() *Report {
+	// entries and balances must come from one read, a settlement in between would show as mismatch
+	return Check(s.entries.Snapshot())
+}
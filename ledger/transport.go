@@ -0,0 +1,74 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/gorilla/mux"
+
+	kitlog "github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// MakeHandler returns a handler for the ledger service.
+func MakeHandler(ls Service, logger kitlog.Logger) http.Handler {
+	r := mux.NewRouter()
+
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(problem.EncodeError),
+	}
+
+	entriesListHandler := kithttp.NewServer(
+		makeListEntriesEndpoint(ls),
+		decodeListEntriesRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	entriesGetHandler := kithttp.NewServer(
+		makeGetEntryEndpoint(ls),
+		decodeGetEntryRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	checkHandler := kithttp.NewServer(
+		makeCheckEndpoint(ls),
+		decodeCheckRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	r.Handle("/ledger/entries", entriesListHandler).Methods("GET")
+	r.Handle("/ledger/entries/{id}", entriesGetHandler).Methods("GET")
+	r.Handle("/ledger/check", checkHandler).Methods("GET")
+
+	return r
+}
+
+func decodeListEntriesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return listEntriesRequest{}, nil
+}
+
+func decodeGetEntryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return getEntryRequest{
+		ID: id,
+	}, nil
+}
+
+func decodeCheckRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return checkRequest{}, nil
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
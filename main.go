@@ -14,24 +14,37 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/MarinX/kit-payment/transaction"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/idempotency"
+	"github.com/MarinX/kit-payment/ledger"
 
 	"github.com/MarinX/kit-payment/repository"
 	"github.com/go-kit/kit/log"
+	router "github.com/gorilla/mux"
 )
 
 func main() {
 	var (
 		httpAddr = flag.String("http.addr", ":8080", "HTTP listen address")
+		workers  = flag.Int("settlement.workers", 4, "Number of transactions settled in parallel")
+		queue    = flag.Int("settlement.queue", 250, "Number of committed transactions waiting for settlement")
+		timeout  = flag.Duration("shutdown.timeout", 10*time.Second, "How long to wait for requests and settlements on shutdown")
+		ttl      = flag.Duration("transaction.ttl", 24*time.Hour, "How long created transaction waits for commit before it expires, 0 never expires")
+		sweep    = flag.Duration("transaction.sweep", time.Minute, "How often expired transactions, holds and idempotency keys are looked up")
+		holdTTL  = flag.Duration("authorization.ttl", 7*24*time.Hour, "How long authorized amount is held before it is released, 0 holds until captured or voided")
 	)
 	flag.Parse()
 
@@ -47,39 +60,89 @@ func main() {
 		logger.Log("exit", err)
 		return
 	}
-	defer repo.Close()
 
 	var (
 		accountRepo     = repo.Account()
 		transactionRepo = repo.Transaction()
+		currencyRepo    = repo.Currency()
+		ledgerRepo      = repo.Ledger()
+		idempotencyRepo = repo.Idempotency()
 	)
 
 	var (
+		cs = currency.NewService(currencyRepo)
 		as = account.NewService(accountRepo)
-		ts = transaction.NewService(transactionRepo, accountRepo, logger)
+		ts = transaction.NewService(transactionRepo, accountRepo, logger, transaction.Config{
+			Workers:        *workers,
+			QueueSize:      *queue,
+			EnqueueTimeout: 100 * time.Millisecond,
+			TTL:            *ttl,
+			HoldTTL:        *holdTTL,
+			SweepInterval:  *sweep,
+		})
+		ls = ledger.NewService(ledgerRepo)
 	)
 
 	httpLogger := log.With(logger, "component", "http")
+	accountHandler := account.MakeHandler(as, cs, httpLogger)
+	transactionHandler := transaction.MakeHandler(ts, cs, idempotencyRepo, httpLogger)
+
+	// transactions of an account are served by the transaction handler
+	accountRoutes := router.NewRouter()
+	accountRoutes.Handle("/accounts/{id}/transactions", transactionHandler)
+	accountRoutes.PathPrefix("/accounts/").Handler(accountHandler)
+
 	mux := http.NewServeMux()
-	mux.Handle("/accounts", account.MakeHandler(as, httpLogger))
-	mux.Handle("/accounts/", account.MakeHandler(as, httpLogger))
-	mux.Handle("/transactions", transaction.MakeHandler(ts, httpLogger))
-	mux.Handle("/transactions/", transaction.MakeHandler(ts, httpLogger))
+	mux.Handle("/accounts", accountHandler)
+	mux.Handle("/accounts/", accountRoutes)
+	mux.Handle("/transactions", transactionHandler)
+	mux.Handle("/transactions/", transactionHandler)
+	mux.Handle("/currencies", currency.MakeHandler(cs, httpLogger))
+	mux.Handle("/currencies/", currency.MakeHandler(cs, httpLogger))
+	mux.Handle("/ledger/", ledger.MakeHandler(ls, httpLogger))
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	expvar.Publish("settlement_queue_depth", expvar.Func(func() interface{} {
+		return ts.QueueDepth()
+	}))
 
 	go ts.Watch()
+	sweepQuit, sweepDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(sweepDone)
+		idempotency.Sweep(idempotencyRepo, *sweep, log.With(logger, "component", "idempotency"), sweepQuit)
+	}()
+	logger.Log("recovered", ts.Recover())
+
+	srv := &http.Server{Addr: *httpAddr, Handler: mux}
 
 	errs := make(chan error, 2)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	go func() {
 		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		errs <- http.ListenAndServe(*httpAddr, mux)
+		errs <- srv.ListenAndServe()
 	}()
 
 	logger.Log("exit", <-errs)
 
+	// stop accepting commits first, then let workers finish before storage is closed
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Log("shutdown", "http", "error", err)
+	}
+	if err := ts.Stop(ctx); err != nil {
+		logger.Log("shutdown", "settlement", "error", err)
+	}
+	// sweep can be in the middle of a delete, wait for it before storage is closed
+	close(sweepQuit)
+	<-sweepDone
+	if err := repo.Close(); err != nil {
+		logger.Log("shutdown", "repository", "error", err)
+	}
 }
@@ -0,0 +1,70 @@
+package money
+
+import "sort"
+
+// Info describes ISO 4217 currency
+type Info struct {
+	Code     Currency
+	Numeric  string
+	Exponent int
+}
+
+// iso4217 holds the currencies known to the service
+var iso4217 = map[Currency]Info{
+	"AUD": {"AUD", "036", 2},
+	"BAM": {"BAM", "977", 2},
+	"BHD": {"BHD", "048", 3},
+	"BRL": {"BRL", "986", 2},
+	"CAD": {"CAD", "124", 2},
+	"CHF": {"CHF", "756", 2},
+	"CLP": {"CLP", "152", 0},
+	"CNY": {"CNY", "156", 2},
+	"CZK": {"CZK", "203", 2},
+	"DKK": {"DKK", "208", 2},
+	"EUR": {"EUR", "978", 2},
+	"GBP": {"GBP", "826", 2},
+	"HKD": {"HKD", "344", 2},
+	"HUF": {"HUF", "348", 2},
+	"IDR": {"IDR", "360", 2},
+	"ILS": {"ILS", "376", 2},
+	"INR": {"INR", "356", 2},
+	"ISK": {"ISK", "352", 0},
+	"JOD": {"JOD", "400", 3},
+	"JPY": {"JPY", "392", 0},
+	"KRW": {"KRW", "410", 0},
+	"KWD": {"KWD", "414", 3},
+	"MXN": {"MXN", "484", 2},
+	"NOK": {"NOK", "578", 2},
+	"NZD": {"NZD", "554", 2},
+	"OMR": {"OMR", "512", 3},
+	"PLN": {"PLN", "985", 2},
+	"RON": {"RON", "946", 2},
+	"RSD": {"RSD", "941", 2},
+	"SEK": {"SEK", "752", 2},
+	"SGD": {"SGD", "702", 2},
+	"THB": {"THB", "764", 2},
+	"TND": {"TND", "788", 3},
+	"TRY": {"TRY", "949", 2},
+	"UAH": {"UAH", "980", 2},
+	"USD": {"USD", "840", 2},
+	"VND": {"VND", "704", 0},
+	"ZAR": {"ZAR", "710", 2},
+}
+
+// Lookup returns ISO 4217 info for given currency code
+func Lookup(currency Currency) (Info, bool) {
+	info, ok := iso4217[currency]
+	return info, ok
+}
+
+// Currencies lists all known currencies ordered by code
+func Currencies() []Info {
+	infos := make([]Info, 0, len(iso4217))
+	for _, info := range iso4217 {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Code < infos[j].Code
+	})
+	return infos
+}
@@ -0,0 +1,189 @@
+// Package money provides exact monetary amounts stored as integer minor units.
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultExponent is the number of minor unit digits used for currencies
+const defaultExponent = 2
+
+var (
+	// ErrInvalidAmount is returned when the amount cannot be parsed as a decimal
+	ErrInvalidAmount = errors.New("invalid amount")
+
+	// ErrCurrencyMismatch is returned when combining amounts of different currencies
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+)
+
+// Currency represents the key for global currency
+type Currency string
+
+// Money represents an exact amount of currency in minor units (e.g. cents)
+type Money struct {
+	Units    int64
+	Currency Currency
+}
+
+// New creates money from minor units
+func New(units int64, currency Currency) Money {
+	return Money{Units: units, Currency: currency}
+}
+
+// Parse converts decimal amount like "10.50" into money without going through float
+func Parse(amount string, currency Currency) (Money, error) {
+	exp := Exponent(currency)
+	s := strings.TrimSpace(amount)
+
+	negative := false
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return Money{}, ErrInvalidAmount
+	}
+	if !isDigits(whole) || !isDigits(frac) {
+		return Money{}, ErrInvalidAmount
+	}
+
+	// trailing zeros do not change the value
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		return Money{}, fmt.Errorf("%s allows at most %d decimal places", currency, exp)
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	if whole == "" {
+		whole = "0"
+	}
+	units, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, ErrInvalidAmount
+	}
+	if negative {
+		units = -units
+	}
+	return New(units, currency), nil
+}
+
+// FromFloat converts a float amount rounded to minor units.
+// It exists for reading legacy records and should not be used for new amounts.
+func FromFloat(amount float64, currency Currency) Money {
+	scale := math.Pow10(Exponent(currency))
+	return New(int64(math.Round(amount*scale)), currency)
+}
+
+// Exponent returns number of minor unit digits for given currency
+func Exponent(currency Currency) int {
+	if info, ok := Lookup(currency); ok {
+		return info.Exponent
+	}
+	return defaultExponent
+}
+
+// Add returns sum of two amounts of the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return New(m.Units+other.Units, m.Currency), nil
+}
+
+// Neg returns the negated amount
+func (m Money) Neg() Money {
+	return New(-m.Units, m.Currency)
+}
+
+// IsZero checks if the amount is zero
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+// IsPositive checks if the amount is greater than zero
+func (m Money) IsPositive() bool {
+	return m.Units > 0
+}
+
+// Decimal formats the amount as decimal string, e.g. "10.50"
+func (m Money) Decimal() string {
+	exp := Exponent(m.Currency)
+	units := m.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absUint(units), 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String returns human readable amount with currency
+func (m Money) String() string {
+	return m.Decimal() + " " + string(m.Currency)
+}
+
+type jsonMoney struct {
+	Value    json.RawMessage `json:"value"`
+	Currency Currency        `json:"currency"`
+}
+
+// MarshalJSON encodes the amount as exact decimal string
+func (m Money) MarshalJSON() ([]byte, error) {
+	value, err := json.Marshal(m.Decimal())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonMoney{Value: value, Currency: m.Currency})
+}
+
+// UnmarshalJSON decodes the amount from decimal string or number
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw jsonMoney
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	value := string(raw.Value)
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(raw.Value, &value); err != nil {
+			return err
+		}
+	}
+	parsed, err := Parse(value, raw.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func absUint(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1
+	}
+	return uint64(v)
+}
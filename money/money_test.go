@@ -0,0 +1,103 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	valid := map[string]int64{
+		"10":     1000,
+		"10.5":   1050,
+		"10.50":  1050,
+		"10.500": 1050,
+		"0.01":   1,
+		".3":     30,
+		"-1.25":  -125,
+	}
+	for input, want := range valid {
+		m, err := Parse(input, "USD")
+		if err != nil {
+			t.Errorf("unexpected error parsing %v: %v", input, err)
+			continue
+		}
+		if m.Units != want {
+			t.Errorf("parsing %v, want %v got %v", input, want, m.Units)
+		}
+	}
+
+	for _, input := range []string{"", ".", "abc", "1.2.3", "1e2", "10.001", "99999999999999999999"} {
+		if _, err := Parse(input, "USD"); err == nil {
+			t.Errorf("expected error parsing %q, got nil", input)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	cases := map[int64]string{
+		0:     "0.00",
+		5:     "0.05",
+		1050:  "10.50",
+		-1050: "-10.50",
+	}
+	for units, want := range cases {
+		if got := New(units, "USD").Decimal(); got != want {
+			t.Errorf("want %v got %v", want, got)
+		}
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	if m := FromFloat(0.1+0.2, "USD"); m.Units != 30 {
+		t.Errorf("want %v got %v", 30, m.Units)
+	}
+	if m := FromFloat(100.5, "USD"); m.Units != 10050 {
+		t.Errorf("want %v got %v", 10050, m.Units)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	sum, err := New(10, "USD").Add(New(20, "USD"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if sum.Units != 30 {
+		t.Errorf("want %v got %v", 30, sum.Units)
+	}
+	if _, err := New(10, "USD").Add(New(20, "EUR")); err != ErrCurrencyMismatch {
+		t.Errorf("expected currency mismatch, got %v", err)
+	}
+	if New(10, "USD").Neg().Units != -10 {
+		t.Error("negation failed")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buff, err := json.Marshal(New(1050, "USD"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(buff) != `{"value":"10.50","currency":"USD"}` {
+		t.Errorf("unexpected json %s", buff)
+		return
+	}
+
+	var m Money
+	if err := json.Unmarshal(buff, &m); err != nil {
+		t.Error(err)
+		return
+	}
+	if m != New(1050, "USD") {
+		t.Errorf("want %v got %v", New(1050, "USD"), m)
+	}
+
+	if err := json.Unmarshal([]byte(`{"value":10.5,"currency":"USD"}`), &m); err != nil {
+		t.Error(err)
+		return
+	}
+	if m.Units != 1050 {
+		t.Errorf("want %v got %v", 1050, m.Units)
+	}
+}
@@ -0,0 +1,47 @@
+// Package page provides cursor pagination of list endpoints.
+package page
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/MarinX/kit-payment/problem"
+)
+
+const (
+	// DefaultLimit is page size used when the request does not set one
+	DefaultLimit = 100
+
+	// MaxLimit is the largest page size a client can request
+	MaxLimit = 1000
+)
+
+// Request selects page of items following the cursor.
+// Cursor is opaque to clients, empty cursor starts from the first item.
+type Request struct {
+	Cursor string
+	Limit  int
+}
+
+// New creates request with limit bounded to MaxLimit, zero limit means DefaultLimit
+func New(cursor string, limit int) Request {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	return Request{Cursor: cursor, Limit: limit}
+}
+
+// FromQuery reads cursor and limit query parameters
+func FromQuery(q url.Values) (Request, error) {
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return Request{}, problem.New(problem.Invalid, "invalid limit %q", v)
+		}
+	}
+	return New(q.Get("cursor"), limit), nil
+}
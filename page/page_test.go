@@ -0,0 +1,35 @@
+package page
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/MarinX/kit-payment/problem"
+)
+
+func TestFromQuery(t *testing.T) {
+	cases := map[string]Request{
+		"":                   {Limit: DefaultLimit},
+		"limit=10":           {Limit: 10},
+		"limit=5000":         {Limit: MaxLimit},
+		"cursor=abc&limit=1": {Cursor: "abc", Limit: 1},
+	}
+	for query, want := range cases {
+		q, _ := url.ParseQuery(query)
+		got, err := FromQuery(q)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", query, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("query %q, want %+v got %+v", query, want, got)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", "limit=abc"} {
+		q, _ := url.ParseQuery(query)
+		if _, err := FromQuery(q); !problem.Is(err, problem.Invalid) {
+			t.Errorf("expected invalid error for %q, got %v", query, err)
+		}
+	}
+}
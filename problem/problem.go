@@ -0,0 +1,115 @@
+// Package problem provides typed domain errors and encodes them as RFC 7807 problem details.
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ContentType is the media type of problem details responses
+const ContentType = "application/problem+json"
+
+// Kind classifies an error, it decides the HTTP status code
+type Kind int
+
+// Kinds of domain errors
+const (
+	Internal Kind = iota
+	Invalid
+	NotFound
+	Conflict
+	InsufficientFunds
+	Unavailable
+)
+
+var statuses = map[Kind]int{
+	Internal:          http.StatusInternalServerError,
+	Invalid:           http.StatusBadRequest,
+	NotFound:          http.StatusNotFound,
+	Conflict:          http.StatusConflict,
+	InsufficientFunds: http.StatusUnprocessableEntity,
+	Unavailable:       http.StatusServiceUnavailable,
+}
+
+// Status returns HTTP status code for the kind
+func (k Kind) Status() int {
+	if status, ok := statuses[k]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is a domain error of given kind
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+// New creates error of given kind with formatted message
+func New(kind Kind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// Wrap classifies err as given kind, nil stays nil
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the wrapped error
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// KindOf returns kind of err, errors which are not classified are Internal
+func KindOf(err error) Kind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return Internal
+}
+
+// Is checks if err is of given kind
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
+
+// Details is the RFC 7807 problem details body
+type Details struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Write writes problem details with given status code
+func Write(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Details{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// EncodeError writes err as problem details, it is meant for kithttp.ServerErrorEncoder.
+// Internal errors can expose storage details, clients get generic detail and the raw error
+// is left to kithttp.ServerErrorLogger, which logs it before the encoder is called.
+func EncodeError(_ context.Context, err error, w http.ResponseWriter) {
+	status := KindOf(err).Status()
+	if status == http.StatusInternalServerError {
+		Write(w, status, "internal error")
+		return
+	}
+	Write(w, status, err.Error())
+}
@@ -0,0 +1,78 @@
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKind(t *testing.T) {
+	cases := map[Kind]int{
+		Internal:          http.StatusInternalServerError,
+		Invalid:           http.StatusBadRequest,
+		NotFound:          http.StatusNotFound,
+		Conflict:          http.StatusConflict,
+		InsufficientFunds: http.StatusUnprocessableEntity,
+		Unavailable:       http.StatusServiceUnavailable,
+	}
+	for kind, want := range cases {
+		if got := kind.Status(); got != want {
+			t.Errorf("invalid status for kind %v, want %v got %v", kind, want, got)
+		}
+	}
+
+	if kind := KindOf(errors.New("plain")); kind != Internal {
+		t.Errorf("plain errors must be internal, got %v", kind)
+	}
+	cause := errors.New("bad")
+	err := Wrap(Invalid, cause)
+	if !Is(err, Invalid) || err.Error() != "bad" || err.(*Error).Cause() != cause {
+		t.Errorf("unexpected wrapped error %#v", err)
+	}
+	if Wrap(Invalid, nil) != nil {
+		t.Error("wrapping nil must return nil")
+	}
+	if Is(nil, Internal) {
+		t.Error("nil must not be classified")
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	EncodeError(context.Background(), New(NotFound, "%s account not found", "123"), rr)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("want %v got %v", http.StatusNotFound, rr.Code)
+		return
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("want content type %v got %v", ContentType, ct)
+		return
+	}
+	d := Details{}
+	if err := json.NewDecoder(rr.Body).Decode(&d); err != nil {
+		t.Error(err)
+		return
+	}
+	want := Details{Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Detail: "123 account not found"}
+	if d != want {
+		t.Errorf("want %+v got %+v", want, d)
+	}
+}
+
+func TestEncodeInternalError(t *testing.T) {
+	for _, err := range []error{errors.New("bolt: database not open"), Wrap(Internal, errors.New("unexpected EOF"))} {
+		rr := httptest.NewRecorder()
+		EncodeError(context.Background(), err, rr)
+		d := Details{}
+		if err := json.NewDecoder(rr.Body).Decode(&d); err != nil {
+			t.Error(err)
+			return
+		}
+		if rr.Code != http.StatusInternalServerError || d.Detail != "internal error" {
+			t.Errorf("expected generic internal error, got %v %+v", rr.Code, d)
+		}
+	}
+}
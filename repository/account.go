@@ -2,14 +2,22 @@ package repository
 
 import (
 	"encoding/json"
-	"fmt"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/boltdb/bolt"
 )
 
 const (
 	accountBucket = "accounts"
+
+	// externalRefBucket maps external reference to account ID, so a reference is used once
+	externalRefBucket = "account_external_refs"
+
+	// summaryBucket keeps activity of every account, updated with each posted entry
+	summaryBucket = "account_summaries"
 )
 
 type accountRepository struct {
@@ -22,11 +30,16 @@ func (a *accountRepository) Store(acc *account.Account) error {
 		if err != nil {
 			return err
 		}
-		buff, err := json.Marshal(acc)
-		if err != nil {
+		old := new(account.Account)
+		if v := b.Get([]byte(acc.ID)); v != nil {
+			if err := json.Unmarshal(v, old); err != nil {
+				return err
+			}
+		}
+		if err := indexExternalRef(tx, old.ExternalRef, acc); err != nil {
 			return err
 		}
-		return b.Put([]byte(acc.ID), buff)
+		return putAccount(b, acc)
 	})
 }
 
@@ -37,11 +50,7 @@ func (a *accountRepository) Find(id string) (*account.Account, error) {
 		if b == nil {
 			return nil
 		}
-		v := b.Get([]byte(id))
-		if v == nil {
-			return fmt.Errorf("%s account not found", id)
-		}
-		return json.Unmarshal(v, acc)
+		return getAccount(b, id, acc)
 	})
 	return acc, err
 }
@@ -64,3 +73,137 @@ func (a *accountRepository) FindAll() []*account.Account {
 	})
 	return accs
 }
+
+func (a *accountRepository) FindPage(p page.Request) ([]*account.Account, string, error) {
+	var (
+		accs []*account.Account
+		next string
+	)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(accountBucket))
+		if b == nil {
+			return nil
+		}
+		var err error
+		next, err = scan(b, p, func(k, v []byte) (bool, error) {
+			tmp := &account.Account{}
+			if err := json.Unmarshal(v, tmp); err != nil {
+				return false, err
+			}
+			accs = append(accs, tmp)
+			return true, nil
+		})
+		return err
+	})
+	return accs, next, err
+}
+
+func (a *accountRepository) Update(id string, fn func(*account.Account) error) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(accountBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s account not found", id)
+		}
+		acc := new(account.Account)
+		if err := getAccount(b, id, acc); err != nil {
+			return err
+		}
+		old := acc.ExternalRef
+		if err := fn(acc); err != nil {
+			return err
+		}
+		if err := indexExternalRef(tx, old, acc); err != nil {
+			return err
+		}
+		return putAccount(b, acc)
+	})
+}
+
+func (a *accountRepository) Adjust(id string, fn func(*account.Account) (*ledger.Entry, error)) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(accountBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s account not found", id)
+		}
+		acc := new(account.Account)
+		if err := getAccount(b, id, acc); err != nil {
+			return err
+		}
+		entry, err := fn(acc)
+		if err != nil || entry == nil {
+			return err
+		}
+		return postEntry(tx, entry, nil)
+	})
+}
+
+func (a *accountRepository) Summary(id string) (*account.Summary, error) {
+	summary := new(account.Summary)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(summaryBucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, summary)
+	})
+	return summary, err
+}
+
+func (a *accountRepository) FindByExternalRef(ref string) (*account.Account, error) {
+	acc := new(account.Account)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(externalRefBucket))
+		var id []byte
+		if index != nil {
+			id = index.Get([]byte(ref))
+		}
+		if id == nil {
+			return problem.New(problem.NotFound, "account with external reference %s not found", ref)
+		}
+		return getAccount(tx.Bucket([]byte(accountBucket)), string(id), acc)
+	})
+	return acc, err
+}
+
+// indexExternalRef moves the account in the reference index from old reference to the current one
+func indexExternalRef(tx *bolt.Tx, old string, acc *account.Account) error {
+	if old == acc.ExternalRef {
+		return nil
+	}
+	index, err := tx.CreateBucketIfNotExists([]byte(externalRefBucket))
+	if err != nil {
+		return err
+	}
+	if acc.ExternalRef != "" {
+		if id := index.Get([]byte(acc.ExternalRef)); id != nil && string(id) != acc.ID {
+			return problem.New(problem.Conflict, "external reference %s is used by account %s", acc.ExternalRef, id)
+		}
+		if err := index.Put([]byte(acc.ExternalRef), []byte(acc.ID)); err != nil {
+			return err
+		}
+	}
+	if old != "" {
+		return index.Delete([]byte(old))
+	}
+	return nil
+}
+
+func getAccount(b *bolt.Bucket, id string, acc *account.Account) error {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return problem.New(problem.NotFound, "%s account not found", id)
+	}
+	return json.Unmarshal(v, acc)
+}
+
+func putAccount(b *bolt.Bucket, acc *account.Account) error {
+	buff, err := json.Marshal(acc)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(acc.ID), buff)
+}
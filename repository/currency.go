@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"encoding/json"
+
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	currencyBucket = "currencies"
+)
+
+type currencyRepository struct {
+	db *bolt.DB
+}
+
+func (a *currencyRepository) Store(c *currency.Currency) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(currencyBucket))
+		if err != nil {
+			return err
+		}
+		return putCurrency(b, c)
+	})
+}
+
+func (a *currencyRepository) Find(code money.Currency) (*currency.Currency, error) {
+	c := new(currency.Currency)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(currencyBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s currency not found", code)
+		}
+		v := b.Get([]byte(code))
+		if v == nil {
+			return problem.New(problem.NotFound, "%s currency not found", code)
+		}
+		return json.Unmarshal(v, c)
+	})
+	return c, err
+}
+
+func (a *currencyRepository) FindAll() []*currency.Currency {
+	var cs []*currency.Currency
+	a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(currencyBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			tmp := &currency.Currency{}
+			if err := json.Unmarshal(v, tmp); err != nil {
+				return err
+			}
+			cs = append(cs, tmp)
+		}
+		return nil
+	})
+	return cs
+}
+
+func putCurrency(b *bolt.Bucket, c *currency.Currency) error {
+	buff, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(c.Code), buff)
+}
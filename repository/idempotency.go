@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/MarinX/kit-payment/idempotency"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	idempotencyBucket = "idempotency"
+)
+
+type idempotencyRepository struct {
+	db *bolt.DB
+}
+
+func (a *idempotencyRepository) Create(record *idempotency.Record) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(idempotencyBucket))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(record.Key)); v != nil {
+			existing := new(idempotency.Record)
+			if err := json.Unmarshal(v, existing); err != nil {
+				return err
+			}
+			if !existing.Expired(time.Now()) {
+				return idempotency.ErrExists
+			}
+		}
+		return putRecord(b, record)
+	})
+}
+
+func (a *idempotencyRepository) Store(record *idempotency.Record) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(idempotencyBucket))
+		if err != nil {
+			return err
+		}
+		if err := checkLease(b, record); err != nil {
+			return err
+		}
+		return putRecord(b, record)
+	})
+}
+
+func (a *idempotencyRepository) Find(key string) (*idempotency.Record, error) {
+	record := new(idempotency.Record)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(idempotencyBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s idempotency key not found", key)
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return problem.New(problem.NotFound, "%s idempotency key not found", key)
+		}
+		return json.Unmarshal(v, record)
+	})
+	return record, err
+}
+
+func (a *idempotencyRepository) Delete(record *idempotency.Record) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(idempotencyBucket))
+		if b == nil {
+			return idempotency.ErrLeaseLost
+		}
+		if err := checkLease(b, record); err != nil {
+			return err
+		}
+		return b.Delete([]byte(record.Key))
+	})
+}
+
+func (a *idempotencyRepository) DeleteExpired(before time.Time) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(idempotencyBucket))
+		if b == nil {
+			return nil
+		}
+		// deleting with the cursor skips keys, they are collected first
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			record := new(idempotency.Record)
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			if record.Expired(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkLease makes sure the stored record still belongs to the request which created the record
+func checkLease(b *bolt.Bucket, record *idempotency.Record) error {
+	v := b.Get([]byte(record.Key))
+	if v == nil {
+		return idempotency.ErrLeaseLost
+	}
+	stored := new(idempotency.Record)
+	if err := json.Unmarshal(v, stored); err != nil {
+		return err
+	}
+	if stored.Token != record.Token {
+		return idempotency.ErrLeaseLost
+	}
+	return nil
+}
+
+func putRecord(b *bolt.Bucket, record *idempotency.Record) error {
+	buff, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(record.Key), buff)
+}
@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"encoding/json"
+
+	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	ledgerBucket = "ledger"
+)
+
+type ledgerRepository struct {
+	db *bolt.DB
+}
+
+func (a *ledgerRepository) Post(entry *ledger.Entry) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return postEntry(tx, entry, nil)
+	})
+}
+
+func (a *ledgerRepository) Find(id string) (*ledger.Entry, error) {
+	entry := new(ledger.Entry)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ledgerBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s entry not found", id)
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return problem.New(problem.NotFound, "%s entry not found", id)
+		}
+		return json.Unmarshal(v, entry)
+	})
+	return entry, err
+}
+
+func (a *ledgerRepository) FindAll() []*ledger.Entry {
+	var entries []*ledger.Entry
+	a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, err = allEntries(tx)
+		return err
+	})
+	return entries
+}
+
+func (a *ledgerRepository) Snapshot() ([]*ledger.Entry, map[string][]money.Money) {
+	var (
+		entries  []*ledger.Entry
+		balances map[string][]money.Money
+	)
+	a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if entries, err = allEntries(tx); err != nil {
+			return err
+		}
+		balances, err = allBalances(tx)
+		return err
+	})
+	return entries, balances
+}
+
+func allEntries(tx *bolt.Tx) ([]*ledger.Entry, error) {
+	var entries []*ledger.Entry
+	b := tx.Bucket([]byte(ledgerBucket))
+	if b == nil {
+		return nil, nil
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		tmp := &ledger.Entry{}
+		if err := json.Unmarshal(v, tmp); err != nil {
+			return entries, err
+		}
+		entries = append(entries, tmp)
+	}
+	return entries, nil
+}
+
+// allBalances returns cached balances of all accounts
+func allBalances(tx *bolt.Tx) (map[string][]money.Money, error) {
+	balances := make(map[string][]money.Money)
+	b := tx.Bucket([]byte(accountBucket))
+	if b == nil {
+		return balances, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		acc := &account.Account{}
+		if err := json.Unmarshal(v, acc); err != nil {
+			return err
+		}
+		for _, balance := range acc.Balances {
+			balances[acc.ID] = append(balances[acc.ID], balance)
+		}
+		return nil
+	})
+	return balances, err
+}
+
+// summarize adds the entry to summaries of its accounts, an account is counted once per entry
+func summarize(tx *bolt.Tx, entry *ledger.Entry) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(summaryBucket))
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, p := range entry.Postings {
+		if p.Account == ledger.SystemAccount || seen[p.Account] {
+			continue
+		}
+		seen[p.Account] = true
+		summary := new(account.Summary)
+		if v := b.Get([]byte(p.Account)); v != nil {
+			if err := json.Unmarshal(v, summary); err != nil {
+				return err
+			}
+		}
+		summary.Add(p.Account, entry)
+		buff, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(p.Account), buff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postEntry stores the entry and applies its postings to cached account balances and summaries
+func postEntry(tx *bolt.Tx, entry *ledger.Entry, fail failpoint) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	entries, err := tx.CreateBucketIfNotExists([]byte(ledgerBucket))
+	if err != nil {
+		return err
+	}
+	if entries.Get([]byte(entry.ID)) != nil {
+		return problem.New(problem.Conflict, "%s entry already posted", entry.ID)
+	}
+	accs, err := tx.CreateBucketIfNotExists([]byte(accountBucket))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range entry.Postings {
+		if p.Account == ledger.SystemAccount {
+			continue
+		}
+		acc := new(account.Account)
+		if err := getAccount(accs, p.Account, acc); err != nil {
+			return err
+		}
+		acc.AppendBalance(p.Amount)
+		if err := fail.check("account"); err != nil {
+			return err
+		}
+		if err := putAccount(accs, acc); err != nil {
+			return err
+		}
+	}
+
+	if err := summarize(tx, entry); err != nil {
+		return err
+	}
+
+	if err := fail.check("entry"); err != nil {
+		return err
+	}
+	buff, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return entries.Put([]byte(entry.ID), buff)
+}
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/transaction"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	metaBucket       = "meta"
+	schemaVersionKey = "schema_version"
+
+	// schemaVersion is the current layout of records in the buckets
+	schemaVersion = 7
+)
+
+// migrations upgrade the database from version i to i+1
+var migrations = []func(tx *bolt.Tx) error{
+	migrateFloatAmounts,
+	seedCurrencies,
+	openingBalances,
+	indexTransactions,
+	activateAccounts,
+	summarizeAccounts,
+	indexExpiries,
+}
+
+// migrate brings the database to the current schema version
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if v := meta.Get([]byte(schemaVersionKey)); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return err
+			}
+		}
+
+		for ; version < schemaVersion; version++ {
+			if err := migrations[version](tx); err != nil {
+				return err
+			}
+		}
+		return meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(version)))
+	})
+}
+
+type legacyAccount struct {
+	ID       string                       `json:"id"`
+	Balances map[account.Currency]float64 `json:"balances,omitempty"`
+}
+
+type legacyTransaction struct {
+	ID       string                        `json:"id"`
+	From     string                        `json:"from"`
+	To       string                        `json:"to"`
+	Status   transaction.TransactionStatus `json:"status"`
+	Amount   float64                       `json:"amount"`
+	Currency account.Currency              `json:"currency"`
+}
+
+// migrateFloatAmounts converts float balances and amounts into minor units
+func migrateFloatAmounts(tx *bolt.Tx) error {
+	if b := tx.Bucket([]byte(accountBucket)); b != nil {
+		err := rewrite(b, func(v []byte) (interface{}, error) {
+			old := legacyAccount{}
+			if err := json.Unmarshal(v, &old); err != nil {
+				return nil, err
+			}
+			acc := &account.Account{ID: old.ID}
+			for currency, amount := range old.Balances {
+				acc.SetBalance(money.FromFloat(amount, currency))
+			}
+			return acc, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if b := tx.Bucket([]byte(transactionBucket)); b != nil {
+		err := rewrite(b, func(v []byte) (interface{}, error) {
+			old := legacyTransaction{}
+			if err := json.Unmarshal(v, &old); err != nil {
+				return nil, err
+			}
+			return &transaction.Transaction{
+				ID:     old.ID,
+				From:   old.From,
+				To:     old.To,
+				Status: old.Status,
+				Amount: money.FromFloat(old.Amount, old.Currency),
+			}, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite replaces every value in bucket with converted one
+func rewrite(b *bolt.Bucket, convert func([]byte) (interface{}, error)) error {
+	updated := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		record, err := convert(v)
+		if err != nil {
+			return err
+		}
+		buff, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		updated[string(k)] = buff
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updated {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedCurrencies registers all known ISO 4217 currencies as enabled
+func seedCurrencies(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(currencyBucket))
+	if err != nil {
+		return err
+	}
+	for _, c := range currency.Defaults() {
+		if b.Get([]byte(c.Code)) != nil {
+			continue
+		}
+		if err := putCurrency(b, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openingBalances posts existing account balances to the ledger against the system account
+func openingBalances(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(accountBucket))
+	if b == nil {
+		return nil
+	}
+	entries, err := tx.CreateBucketIfNotExists([]byte(ledgerBucket))
+	if err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		acc := &account.Account{}
+		if err := json.Unmarshal(v, acc); err != nil {
+			return err
+		}
+		entry := ledger.New(ledger.EntryOpening, acc.ID)
+		for _, balance := range acc.Balances {
+			if balance.IsZero() {
+				continue
+			}
+			entry.Postings = append(entry.Postings,
+				ledger.Posting{Account: acc.ID, Amount: balance},
+				ledger.Posting{Account: ledger.SystemAccount, Amount: balance.Neg()},
+			)
+		}
+		if len(entry.Postings) == 0 {
+			return nil
+		}
+		buff, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return entries.Put([]byte(entry.ID), buff)
+	})
+}
+
+// indexTransactions adds existing transactions to the account index
+func indexTransactions(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(transactionBucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		trx := &transaction.Transaction{}
+		if err := json.Unmarshal(v, trx); err != nil {
+			return err
+		}
+		return indexTransaction(tx, trx)
+	})
+}
+
+// activateAccounts sets status of accounts created before account statuses
+func activateAccounts(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(accountBucket))
+	if b == nil {
+		return nil
+	}
+	return rewrite(b, func(v []byte) (interface{}, error) {
+		acc := &account.Account{}
+		if err := json.Unmarshal(v, acc); err != nil {
+			return nil, err
+		}
+		if acc.Status == "" {
+			acc.Status = account.StatusActive
+		}
+		return acc, nil
+	})
+}
+
+// summarizeAccounts builds activity summaries of accounts from the posted entries
+func summarizeAccounts(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(ledgerBucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		entry := &ledger.Entry{}
+		if err := json.Unmarshal(v, entry); err != nil {
+			return err
+		}
+		return summarize(tx, entry)
+	})
+}
+
+// indexExpiries adds created and authorized transactions to the expiry index
+func indexExpiries(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(transactionBucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		trx := &transaction.Transaction{}
+		if err := json.Unmarshal(v, trx); err != nil {
+			return err
+		}
+		return indexExpiry(tx, trx)
+	})
+}
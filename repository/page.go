@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/boltdb/bolt"
+)
+
+// encodeCursor hides the bolt key of the last returned record from clients
+func encodeCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func decodeCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(key) == 0 {
+		return nil, problem.New(problem.Invalid, "invalid cursor")
+	}
+	return key, nil
+}
+
+// errStopScan is returned by scan fn when no further key can be accepted, it ends the last page
+var errStopScan = errors.New("stop scan")
+
+// scan walks the bucket in key order starting after the cursor and passes records to fn
+// until it accepts p.Limit of them. It returns cursor of the next page, empty on the last page.
+// With filtering fn the next page can turn out empty.
+func scan(b *bolt.Bucket, p page.Request, fn func(k, v []byte) (bool, error)) (string, error) {
+	return scanFrom(b, nil, p, fn)
+}
+
+// scanFrom is scan which skips keys below from on the first page
+func scanFrom(b *bolt.Bucket, from []byte, p page.Request, fn func(k, v []byte) (bool, error)) (string, error) {
+	after, err := decodeCursor(p.Cursor)
+	if err != nil {
+		return "", err
+	}
+
+	c := b.Cursor()
+	k, v := c.First()
+	if after == nil && from != nil {
+		k, v = c.Seek(from)
+	}
+	if after != nil {
+		k, v = c.Seek(after)
+		if k != nil && bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+	}
+
+	accepted := 0
+	for ; k != nil; k, v = c.Next() {
+		ok, err := fn(k, v)
+		if err == errStopScan {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		accepted++
+		if accepted == p.Limit {
+			last := append([]byte(nil), k...)
+			if next, _ := c.Next(); next == nil {
+				return "", nil
+			}
+			return encodeCursor(last), nil
+		}
+	}
+	return "", nil
+}
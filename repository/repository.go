@@ -14,7 +14,24 @@ type Repository struct {
 // New creates new boltdb database
 func New() (*Repository, error) {
 	db, err := bolt.Open("data.db", 0600, &bolt.Options{Timeout: 5 * time.Second})
-	return &Repository{db: db}, err
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Repository{db: db}, nil
+}
+
+// failpoint is called before writes of a unit of work, tests use it to simulate crashes
+type failpoint func(step string) error
+
+func (f failpoint) check(step string) error {
+	if f == nil {
+		return nil
+	}
+	return f(step)
 }
 
 // Account returns account repository
@@ -27,6 +44,21 @@ func (r *Repository) Transaction() *transactionRepository {
 	return &transactionRepository{db: r.db}
 }
 
+// Currency returns currency repository
+func (r *Repository) Currency() *currencyRepository {
+	return &currencyRepository{db: r.db}
+}
+
+// Ledger returns ledger repository
+func (r *Repository) Ledger() *ledgerRepository {
+	return &ledgerRepository{db: r.db}
+}
+
+// Idempotency returns idempotency record repository
+func (r *Repository) Idempotency() *idempotencyRepository {
+	return &idempotencyRepository{db: r.db}
+}
+
 // Close the database
 func (r *Repository) Close() error {
 	return r.db.Close()
@@ -1,12 +1,24 @@
 package repository
 
 import (
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	uuid "github.com/satori/go.uuid"
 
 	"github.com/MarinX/kit-payment/transaction"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/idempotency"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/MarinX/kit-payment/uuid7"
 )
 
 func openRepo(t *testing.T) *Repository {
@@ -47,7 +59,7 @@ func TestAccountRepository(t *testing.T) {
 		t.Errorf("account ids does not match, want %v got %v", tmpAcc.ID, expected.ID)
 	}
 
-	tmpAcc.SetBalance(account.Currency("USD"), 1)
+	tmpAcc.SetBalance(money.New(1, "USD"))
 	if err := accRepo.Store(tmpAcc); err != nil {
 		t.Errorf("error updating account %v", err)
 		return
@@ -58,6 +70,162 @@ func TestAccountRepository(t *testing.T) {
 	if len(allAcc) != 1 {
 		t.Errorf("invalid number of accounts")
 	}
+
+	err = accRepo.Update(tmpAcc.ID, func(acc *account.Account) error {
+		acc.SetCreditLimit(money.New(5, "USD"))
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error updating account %v", err)
+		return
+	}
+	expected, _ = accRepo.Find(tmpAcc.ID)
+	if expected.CreditLimitFor("USD").Units != 5 || expected.BalanceFor("USD").Units != 1 {
+		t.Errorf("expected credit limit with unchanged balance, got %+v", expected)
+	}
+	if err := accRepo.Update("missing", func(*account.Account) error { return nil }); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected not found updating missing account, got %v", err)
+	}
+}
+
+func TestAccountAdjust(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	accounts := account.NewService(accRepo)
+
+	from, to := account.New(), account.New()
+	for _, acc := range []*account.Account{from, to} {
+		if err := accRepo.Store(acc); err != nil {
+			t.Errorf("error storing account %v", err)
+			return
+		}
+	}
+	if _, err := accounts.SetBalanceForAccount(from.ID, money.New(100, "USD")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the client reads the balance, then a transfer settles before the reset
+	if _, err := accRepo.Find(from.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	trx := transaction.New(from.ID, to.ID, money.New(30, "USD"))
+	trx.Create()
+	trx.Commit()
+	if err := txRepo.Store(trx); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := txRepo.Transfer(trx.ID, (*transaction.Transaction).Settle); err != nil {
+		t.Error(err)
+		return
+	}
+	acc, err := accounts.SetBalanceForAccount(from.ID, money.New(50, "USD"))
+	if err != nil || acc.BalanceFor("USD").Units != 50 {
+		t.Errorf("expected balance reset to 50, got %v %v", acc, err)
+		return
+	}
+	if report := ledger.Check(repo.Ledger().Snapshot()); !report.Balanced {
+		t.Errorf("expected balanced ledger after reset, got %+v", report)
+		return
+	}
+
+	// summaries are kept by postings and match the ledger
+	for _, id := range []string{from.ID, to.ID} {
+		summary, err := accounts.GetSummary(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		want := account.Summarize(id, repo.Ledger().FindAll())
+		if summary.Transactions != want.Transactions || summary.Incoming != want.Incoming ||
+			summary.Outgoing != want.Outgoing || summary.Adjustments != want.Adjustments ||
+			summary.LastActivity == nil || !summary.LastActivity.Equal(*want.LastActivity) {
+			t.Errorf("invalid summary of %v, want %+v got %+v", id, want, summary)
+			return
+		}
+	}
+	if summary, _ := accounts.GetSummary(from.ID); summary.Outgoing != 1 || summary.Adjustments != 2 {
+		t.Errorf("expected one outgoing transfer and two adjustments, got %+v", summary)
+		return
+	}
+
+	entries := len(repo.Ledger().FindAll())
+	if _, err := accounts.SetBalanceForAccount(from.ID, money.New(50, "USD")); err != nil || len(repo.Ledger().FindAll()) != entries {
+		t.Errorf("expected no entry for unchanged balance, got %v", err)
+		return
+	}
+	if _, err := accounts.SetBalanceForAccount(to.ID, money.New(0, "USD")); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := accounts.CloseAccount(to.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := accounts.SetBalanceForAccount(to.ID, money.New(1, "USD")); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict for closed account, got %v", err)
+		return
+	}
+	if _, err := accounts.SetBalanceForAccount("missing", money.New(1, "USD")); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected not found for missing account, got %v", err)
+	}
+}
+
+func TestAccountExternalRef(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	first := account.New()
+	first.ExternalRef = "customer-1"
+	if err := accRepo.Store(first); err != nil {
+		t.Errorf("error storing account %v", err)
+		return
+	}
+	found, err := accRepo.FindByExternalRef("customer-1")
+	if err != nil || found.ID != first.ID {
+		t.Errorf("expected account %v by reference, got %+v %v", first.ID, found, err)
+		return
+	}
+
+	second := account.New()
+	second.ExternalRef = "customer-1"
+	if err := accRepo.Store(second); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict for used reference, got %v", err)
+		return
+	}
+	if _, err := accRepo.Find(second.ID); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected account with used reference not to be stored, got %v", err)
+		return
+	}
+
+	// changing the reference frees the old one
+	err = accRepo.Update(first.ID, func(acc *account.Account) error {
+		acc.ExternalRef = "customer-2"
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error updating reference %v", err)
+		return
+	}
+	if _, err := accRepo.FindByExternalRef("customer-1"); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected old reference to be removed, got %v", err)
+	}
+	if err := accRepo.Store(second); err != nil {
+		t.Errorf("error storing account with freed reference %v", err)
+	}
+	err = accRepo.Update(first.ID, func(acc *account.Account) error {
+		acc.ExternalRef = "customer-1"
+		return nil
+	})
+	if !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict updating to used reference, got %v", err)
+	}
 }
 
 func TestTransactionRepository(t *testing.T) {
@@ -65,7 +233,7 @@ func TestTransactionRepository(t *testing.T) {
 	defer closeRepo(t, repo)
 
 	txRepo := repo.Transaction()
-	tmpTx := transaction.New("123", "222", account.Currency("USD"), 10)
+	tmpTx := transaction.New("123", "222", money.New(10, "USD"))
 
 	if err := txRepo.Store(tmpTx); err == nil {
 		t.Errorf("missing ID should yield error,got nil")
@@ -105,3 +273,965 @@ func TestTransactionRepository(t *testing.T) {
 		t.Errorf("invalid number of transactions")
 	}
 }
+
+func TestPagination(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	for i := 0; i < 5; i++ {
+		acc := account.New()
+		if err := accRepo.Store(acc); err != nil {
+			t.Error(err)
+			return
+		}
+		currency := money.Currency("USD")
+		if i%2 == 1 {
+			currency = "EUR"
+		}
+		tx := transaction.New(acc.ID, "222", money.New(int64(i), currency))
+		tx.Create()
+		if err := txRepo.Store(tx); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		accs, next, err := accRepo.FindPage(page.New(cursor, 2))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(accs) > 2 || pages > 3 {
+			t.Errorf("page too large or too many pages, got %v accounts on page %v", len(accs), pages)
+			return
+		}
+		for _, acc := range accs {
+			if seen[acc.ID] {
+				t.Errorf("account %v returned twice", acc.ID)
+			}
+			seen[acc.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 5 {
+		t.Errorf("expected 5 accounts, got %v", len(seen))
+	}
+
+	filter := transaction.Filter{Currency: "USD"}
+	txs, next, err := txRepo.FindPage(filter, page.New("", 2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(txs) != 2 || next == "" {
+		t.Errorf("expected full first page with cursor, got %v %q", len(txs), next)
+		return
+	}
+	rest, next, err := txRepo.FindPage(filter, page.New(next, 2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(rest) != 1 || next != "" {
+		t.Errorf("expected last page with 1 transaction, got %v %q", len(rest), next)
+		return
+	}
+	all := append(txs, rest...)
+	for i, tx := range all {
+		if tx.Amount.Currency != "USD" {
+			t.Errorf("transaction does not match filter %+v", tx)
+		}
+		// keys are time ordered, so pages follow creation order
+		if i > 0 && tx.CreatedAt.Before(all[i-1].CreatedAt) {
+			t.Errorf("transactions are not in creation order, %v before %v", all[i-1].CreatedAt, tx.CreatedAt)
+		}
+	}
+
+	if _, _, err := txRepo.FindPage(filter, page.New("!", 2)); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected invalid cursor error, got %v", err)
+	}
+}
+
+func TestTransactionIndex(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	txRepo := repo.Transaction()
+	store := func(from, to string) *transaction.Transaction {
+		tx := transaction.New(from, to, money.New(1, "USD"))
+		tx.Create()
+		if err := txRepo.Store(tx); err != nil {
+			t.Error(err)
+		}
+		return tx
+	}
+	store("a", "b")
+	store("b", "a")
+	third := store("a", "c")
+	store("a", "a")
+
+	counts := map[transaction.Direction]int{
+		transaction.DirectionAny:      4,
+		transaction.DirectionOutgoing: 3,
+		transaction.DirectionIncoming: 2,
+	}
+	for direction, want := range counts {
+		txs, _, err := txRepo.FindByAccount("a", direction, page.New("", 0))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(txs) != want {
+			t.Errorf("direction %q, want %v got %v", direction, want, len(txs))
+		}
+	}
+
+	// updates keep single index entry
+	third.Commit()
+	if err := txRepo.Store(third); err != nil {
+		t.Error(err)
+		return
+	}
+	txs, _, err := txRepo.FindByAccount("c", transaction.DirectionAny, page.New("", 0))
+	if err != nil || len(txs) != 1 || txs[0].Status != transaction.StatusPending {
+		t.Errorf("expected updated transaction for receiver, got %+v %v", txs, err)
+		return
+	}
+
+	if err := txRepo.Delete(third.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if txs, _, _ := txRepo.FindByAccount("c", transaction.DirectionAny, page.New("", 0)); len(txs) != 0 {
+		t.Errorf("expected deleted transaction to be removed from index, got %v", len(txs))
+	}
+	if txs, _, _ := txRepo.FindByAccount("unknown", transaction.DirectionAny, page.New("", 0)); len(txs) != 0 {
+		t.Errorf("expected no transactions for unknown account, got %v", len(txs))
+	}
+}
+
+func TestTransactionReference(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	txRepo := repo.Transaction()
+	store := func(reference string) *transaction.Transaction {
+		tx := transaction.New("a", "b", money.New(1, "USD"))
+		tx.Describe(transaction.Details{Reference: reference})
+		tx.Create()
+		if err := txRepo.Store(tx); err != nil {
+			t.Error(err)
+		}
+		return tx
+	}
+	first := store("order-1")
+	store("order-2")
+	second := store("order-1")
+	store("")
+
+	txs, next, err := txRepo.FindPage(transaction.Filter{Reference: "order-1"}, page.New("", 1))
+	if err != nil || len(txs) != 1 || txs[0].ID != first.ID || next == "" {
+		t.Errorf("expected first page with first transaction, got %+v %q %v", txs, next, err)
+		return
+	}
+	txs, next, err = txRepo.FindPage(transaction.Filter{Reference: "order-1"}, page.New(next, 1))
+	if err != nil || len(txs) != 1 || txs[0].ID != second.ID || next != "" {
+		t.Errorf("expected last page with second transaction, got %+v %q %v", txs, next, err)
+		return
+	}
+
+	if err := txRepo.Delete(first.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if txs, _, _ := txRepo.FindPage(transaction.Filter{Reference: "order-1"}, page.New("", 0)); len(txs) != 1 {
+		t.Errorf("expected deleted transaction to be removed from reference index, got %v", len(txs))
+	}
+	if txs, _, _ := txRepo.FindPage(transaction.Filter{Reference: "unknown"}, page.New("", 0)); len(txs) != 0 {
+		t.Errorf("expected no transactions for unknown reference, got %v", len(txs))
+	}
+}
+
+func TestTransactionCreatedRange(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	txRepo := repo.Transaction()
+	base := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	var ids []string
+	for i := 0; i < 4; i++ {
+		tx := transaction.New("a", "b", money.New(1, "USD"))
+		tx.Create()
+		tx.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		tx.ID = uuid7.Min(tx.CreatedAt)
+		if err := txRepo.Store(tx); err != nil {
+			t.Error(err)
+			return
+		}
+		ids = append(ids, tx.ID)
+	}
+	legacy := transaction.New("a", "b", money.New(1, "USD"))
+	legacy.ID = uuid.Must(uuid.NewV4()).String()
+	if err := txRepo.Store(legacy); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// legacy transaction without creation time is outside of any range
+	txs, _, err := txRepo.FindPage(transaction.Filter{CreatedTo: base.Add(2 * time.Hour)}, page.New("", 0))
+	if err != nil || len(txs) != 2 {
+		t.Errorf("expected 2 transactions created before the bound, got %v %v", len(txs), err)
+		return
+	}
+
+	// records outside of the range can not be decoded, so the scan must seek past and stop before them
+	repo.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(transactionBucket))
+		b.Put([]byte(uuid7.Min(base.Add(-time.Hour))), []byte("{"))
+		return b.Put([]byte(uuid7.Min(base.Add(10*time.Hour))), []byte("{"))
+	})
+
+	filter := transaction.Filter{CreatedFrom: base.Add(time.Hour), CreatedTo: base.Add(3 * time.Hour)}
+	txs, next, err := txRepo.FindPage(filter, page.New("", 1))
+	if err != nil || len(txs) != 1 || txs[0].ID != ids[1] || next == "" {
+		t.Errorf("expected first page with second transaction, got %+v %q %v", txs, next, err)
+		return
+	}
+	txs, next, err = txRepo.FindPage(filter, page.New(next, 1))
+	if err != nil || len(txs) != 1 || txs[0].ID != ids[2] {
+		t.Errorf("expected page with third transaction, got %+v %v", txs, err)
+		return
+	}
+	if next != "" {
+		if txs, next, err = txRepo.FindPage(filter, page.New(next, 1)); err != nil || len(txs) != 0 || next != "" {
+			t.Errorf("expected empty last page, got %+v %q %v", txs, next, err)
+			return
+		}
+	}
+}
+func TestMigrateFloatAmounts(t *testing.T) {
+	db, err := bolt.Open("data.db", 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		acc, err := tx.CreateBucketIfNotExists([]byte(accountBucket))
+		if err != nil {
+			return err
+		}
+		if err := acc.Put([]byte("123"), []byte(`{"id":"123","balances":{"USD":100.3}}`)); err != nil {
+			return err
+		}
+		trx, err := tx.CreateBucketIfNotExists([]byte(transactionBucket))
+		if err != nil {
+			return err
+		}
+		return trx.Put([]byte("abc"), []byte(`{"id":"abc","from":"123","to":"222","status":"ok","amount":0.30000000000000004,"currency":"USD"}`))
+	})
+	db.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	acc, err := repo.Account().Find("123")
+	if err != nil {
+		t.Errorf("error getting migrated account %v", err)
+		return
+	}
+	if balance := acc.BalanceFor("USD"); balance.Units != 10030 {
+		t.Errorf("invalid migrated balance, want %v got %v", 10030, balance.Units)
+	}
+	if acc.Status != account.StatusActive {
+		t.Errorf("invalid migrated status, want %v got %v", account.StatusActive, acc.Status)
+	}
+
+	trx, err := repo.Transaction().Find("abc")
+	if err != nil {
+		t.Errorf("error getting migrated transaction %v", err)
+		return
+	}
+	if trx.Amount != money.New(30, "USD") {
+		t.Errorf("invalid migrated amount, want %v got %v", money.New(30, "USD"), trx.Amount)
+	}
+
+	ledgerRepo := repo.Ledger()
+	if report := ledger.Check(ledgerRepo.Snapshot()); !report.Balanced || report.Entries != 1 {
+		t.Errorf("expected opening balance entry, got %+v", report)
+	}
+	if summary, err := repo.Account().Summary("123"); err != nil || summary.LastActivity == nil {
+		t.Errorf("expected summary built from opening entry, got %+v %v", summary, err)
+	}
+
+	if txs, _, err := repo.Transaction().FindByAccount("222", transaction.DirectionIncoming, page.New("", 0)); err != nil || len(txs) != 1 {
+		t.Errorf("expected migrated transaction in account index, got %v %v", len(txs), err)
+	}
+}
+
+func TestCurrencyRepository(t *testing.T) {
+	repo := openRepo(t)
+	defer func() { closeRepo(t, repo) }()
+
+	curRepo := repo.Currency()
+	if len(curRepo.FindAll()) != len(money.Currencies()) {
+		t.Errorf("currencies are not seeded, want %v got %v", len(money.Currencies()), len(curRepo.FindAll()))
+		return
+	}
+
+	c, err := curRepo.Find("USD")
+	if err != nil {
+		t.Errorf("error finding currency %v", err)
+		return
+	}
+	c.Enabled = false
+	if err := curRepo.Store(c); err != nil {
+		t.Errorf("error storing currency %v", err)
+		return
+	}
+
+	// reopening must not overwrite admin changes
+	repo.Close()
+	repo = openRepo(t)
+	curRepo = repo.Currency()
+	c, err = curRepo.Find("USD")
+	if err != nil {
+		t.Errorf("error finding currency %v", err)
+		return
+	}
+	if c.Enabled {
+		t.Error("expected currency to stay disabled after reopen")
+	}
+
+	if _, err := curRepo.Find("FOO"); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected not found error for unknown currency, got %v", err)
+	}
+}
+
+func TestTransactionTransfer(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	ledgerRepo := repo.Ledger()
+
+	from := account.New()
+	to := account.New()
+	for _, acc := range []*account.Account{from, to} {
+		if err := accRepo.Store(acc); err != nil {
+			t.Errorf("error storing account %v", err)
+			return
+		}
+	}
+	if err := ledgerRepo.Post(ledger.Adjustment(from.ID, money.New(100, "USD"))); err != nil {
+		t.Errorf("error funding account %v", err)
+		return
+	}
+
+	trx := transaction.New(from.ID, to.ID, money.New(30, "USD"))
+	trx.Create()
+	trx.Commit()
+	if err := txRepo.Store(trx); err != nil {
+		t.Errorf("error storing transaction %v", err)
+		return
+	}
+
+	total := func() int64 {
+		var sum int64
+		for _, acc := range accRepo.FindAll() {
+			sum += acc.BalanceFor("USD").Units
+		}
+		return sum
+	}
+
+	// crash before every write, nothing must be written
+	for failAt := 1; ; failAt++ {
+		calls := 0
+		txRepo.failpoint = func(step string) error {
+			calls++
+			if calls == failAt {
+				return errors.New("crash")
+			}
+			return nil
+		}
+		err := txRepo.Transfer(trx.ID, (*transaction.Transaction).Settle)
+		if calls < failAt {
+			if err != nil {
+				t.Errorf("error settling transaction %v", err)
+				return
+			}
+			txRepo.failpoint = nil
+			break
+		}
+		if err == nil {
+			t.Errorf("expected error when failing at write %v, got nil", failAt)
+			return
+		}
+		if sum := total(); sum != 100 {
+			t.Errorf("money created or destroyed when failing at write %v, total %v", failAt, sum)
+			return
+		}
+		stored, err := txRepo.Find(trx.ID)
+		if err != nil {
+			t.Errorf("error finding transaction %v", err)
+			return
+		}
+		if stored.Status != transaction.StatusPending {
+			t.Errorf("transaction status changed when failing at write %v, got %v", failAt, stored.Status)
+			return
+		}
+		if len(ledgerRepo.FindAll()) != 1 {
+			t.Errorf("ledger entry written when failing at write %v", failAt)
+			return
+		}
+	}
+
+	if sum := total(); sum != 100 {
+		t.Errorf("money created or destroyed after settlement, total %v", sum)
+	}
+	stored, _ := txRepo.Find(trx.ID)
+	if stored.Status != transaction.StatusOK {
+		t.Errorf("transaction status is wrong, want %v got %v", transaction.StatusOK, stored.Status)
+	}
+	sender, _ := accRepo.Find(from.ID)
+	if sender.BalanceFor("USD").Units != 70 {
+		t.Errorf("invalid sender balance, want %v got %v", 70, sender.BalanceFor("USD").Units)
+	}
+	if report := ledger.Check(ledgerRepo.Snapshot()); !report.Balanced {
+		t.Errorf("ledger is not balanced %+v", report)
+	}
+
+	// settling again after a restart must not move money twice
+	if err := txRepo.Transfer(trx.ID, (*transaction.Transaction).Settle); err != nil {
+		t.Errorf("error settling transaction again %v", err)
+	}
+	sender, _ = accRepo.Find(from.ID)
+	if sender.BalanceFor("USD").Units != 70 {
+		t.Errorf("transaction settled twice, want %v got %v", 70, sender.BalanceFor("USD").Units)
+	}
+
+	// failed attempts are rolled back with their history
+	history, err := txRepo.History(trx.ID)
+	if err != nil {
+		t.Errorf("error getting history %v", err)
+		return
+	}
+	want := []transaction.TransactionStatus{transaction.StatusCreated, transaction.StatusPending, transaction.StatusOK}
+	if len(history) != len(want) {
+		t.Errorf("expected %v changes, got %+v", len(want), history)
+		return
+	}
+	for i, change := range history {
+		if change.To != want[i] || (i > 0 && change.From != want[i-1]) {
+			t.Errorf("unexpected change %v %+v", i, change)
+		}
+	}
+	if history[2].Actor != transaction.ActorSettlement {
+		t.Errorf("expected settlement actor, got %v", history[2].Actor)
+	}
+
+	// missing account must fail without writing anything
+	orphan := transaction.New(from.ID, "missing", money.New(10, "USD"))
+	orphan.Create()
+	orphan.Commit()
+	txRepo.Store(orphan)
+	if err := txRepo.Transfer(orphan.ID, (*transaction.Transaction).Settle); err == nil {
+		t.Error("expected error for missing account, got nil")
+	}
+	if sum := total(); sum != 100 {
+		t.Errorf("money created or destroyed for missing account, total %v", sum)
+	}
+}
+
+func TestTransactionBatch(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	ledgerRepo := repo.Ledger()
+
+	from := account.New()
+	to := account.New()
+	for _, acc := range []*account.Account{from, to} {
+		if err := accRepo.Store(acc); err != nil {
+			t.Errorf("error storing account %v", err)
+			return
+		}
+	}
+	if err := ledgerRepo.Post(ledger.Adjustment(from.ID, money.New(100, "USD"))); err != nil {
+		t.Errorf("error funding account %v", err)
+		return
+	}
+
+	items := []transaction.BatchItem{
+		{From: from.ID, To: to.ID, Amount: money.New(60, "USD")},
+		{From: from.ID, To: to.ID, Amount: money.New(60, "USD")},
+	}
+	batch, txs, err := transaction.NewBatch(items)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the second transfer has no funds left, the first one is rolled back
+	err = txRepo.TransferBatch(batch, txs, func(trx *transaction.Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+		entry, err := trx.Settle(from, to)
+		if err == nil && trx.Status != transaction.StatusOK {
+			return nil, errors.New("not settled")
+		}
+		return entry, err
+	})
+	if err == nil {
+		t.Error("expected error for batch over the balance, got nil")
+		return
+	}
+	if acc, _ := accRepo.Find(from.ID); acc.BalanceFor("USD").Units != 100 {
+		t.Errorf("expected rolled back balance, got %v", acc.BalanceFor("USD"))
+		return
+	}
+	if stored := txRepo.FindAll(); len(stored) != 0 {
+		t.Errorf("expected rolled back transactions, got %v", len(stored))
+		return
+	}
+	if _, err := txRepo.FindBatch(batch.ID); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected rolled back batch, got %v", err)
+		return
+	}
+	if txs[0].Status != transaction.StatusPending || len(txs[0].Changes) != 2 {
+		t.Errorf("expected passed transaction unchanged, got %+v", txs[0])
+		return
+	}
+
+	items[1].Amount = money.New(40, "USD")
+	batch, txs, _ = transaction.NewBatch(items)
+	if err := txRepo.TransferBatch(batch, txs, (*transaction.Transaction).Settle); err != nil {
+		t.Error(err)
+		return
+	}
+	if acc, _ := accRepo.Find(to.ID); acc.BalanceFor("USD").Units != 100 {
+		t.Errorf("expected both transfers received, got %v", acc.BalanceFor("USD"))
+		return
+	}
+	for _, trx := range txs {
+		stored, err := txRepo.Find(trx.ID)
+		if err != nil || stored.Status != transaction.StatusOK || stored.Batch != batch.ID {
+			t.Errorf("expected settled transaction of the batch, got %+v %v", stored, err)
+			return
+		}
+	}
+	found, err := txRepo.FindBatch(batch.ID)
+	if err != nil || len(found.Transactions) != 2 || found.Transactions[0] != txs[0].ID {
+		t.Errorf("expected stored batch, got %+v %v", found, err)
+	}
+	if len(ledgerRepo.FindAll()) != 3 {
+		t.Errorf("expected ledger entry per transfer, got %v", len(ledgerRepo.FindAll()))
+	}
+}
+
+func TestTransactionLegs(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	ledgerRepo := repo.Ledger()
+
+	buyer, seller, fee := account.New(), account.New(), account.New()
+	for _, acc := range []*account.Account{buyer, seller, fee} {
+		if err := accRepo.Store(acc); err != nil {
+			t.Errorf("error storing account %v", err)
+			return
+		}
+	}
+	if err := ledgerRepo.Post(ledger.Adjustment(buyer.ID, money.New(100, "USD"))); err != nil {
+		t.Errorf("error funding account %v", err)
+		return
+	}
+
+	trx, err := transaction.NewMultiLeg(
+		[]transaction.Leg{{Account: buyer.ID, Amount: money.New(100, "USD")}},
+		[]transaction.Leg{{Account: seller.ID, Amount: money.New(90, "USD")}, {Account: fee.ID, Amount: money.New(10, "USD")}},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	trx.Create()
+	trx.Commit()
+	if err := txRepo.Store(trx); err != nil {
+		t.Errorf("error storing transaction %v", err)
+		return
+	}
+	if err := txRepo.TransferLegs(trx.ID, (*transaction.Transaction).SettleLegs); err != nil {
+		t.Errorf("error settling transaction %v", err)
+		return
+	}
+
+	want := map[string]int64{buyer.ID: 0, seller.ID: 90, fee.ID: 10}
+	for id, units := range want {
+		acc, _ := accRepo.Find(id)
+		if acc.BalanceFor("USD").Units != units {
+			t.Errorf("invalid balance, want %v got %v", units, acc.BalanceFor("USD"))
+		}
+	}
+	stored, err := txRepo.Find(trx.ID)
+	if err != nil || stored.Status != transaction.StatusOK || len(stored.Destinations) != 2 {
+		t.Errorf("expected settled transaction with legs, got %+v %v", stored, err)
+		return
+	}
+	// every leg account indexes the transaction
+	txs, _, err := txRepo.FindByAccount(fee.ID, transaction.DirectionIncoming, page.New("", 0))
+	if err != nil || len(txs) != 1 || txs[0].ID != trx.ID {
+		t.Errorf("expected transaction received by fee account, got %+v %v", txs, err)
+	}
+}
+
+func TestTransactionHold(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	ledgerRepo := repo.Ledger()
+
+	from := account.New()
+	to := account.New()
+	for _, acc := range []*account.Account{from, to} {
+		if err := accRepo.Store(acc); err != nil {
+			t.Errorf("error storing account %v", err)
+			return
+		}
+	}
+	if err := ledgerRepo.Post(ledger.Adjustment(from.ID, money.New(100, "USD"))); err != nil {
+		t.Errorf("error funding account %v", err)
+		return
+	}
+
+	trx := transaction.New(from.ID, to.ID, money.New(30, "USD"))
+	trx.Mode = transaction.ModeAuthorize
+	trx.Create()
+	trx.Commit()
+	txRepo.Store(trx)
+	if err := txRepo.Transfer(trx.ID, (*transaction.Transaction).Settle); err != nil {
+		t.Errorf("error authorizing transaction %v", err)
+		return
+	}
+	sender, _ := accRepo.Find(from.ID)
+	if sender.HeldFor("USD").Units != 30 || sender.BalanceFor("USD").Units != 100 {
+		t.Errorf("expected stored hold, got %+v", sender)
+		return
+	}
+	// derived available amounts are not stored
+	repo.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(accountBucket)).Get([]byte(from.ID)); strings.Contains(string(v), "available") {
+			t.Errorf("expected account stored without available amounts, got %s", v)
+		}
+		return nil
+	})
+
+	err := txRepo.Transfer(trx.ID, func(tx *transaction.Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+		return tx.Capture(money.New(10, "USD"), from, to)
+	})
+	if err != nil {
+		t.Errorf("error capturing transaction %v", err)
+		return
+	}
+	sender, _ = accRepo.Find(from.ID)
+	receiver, _ := accRepo.Find(to.ID)
+	if len(sender.Held) != 0 || sender.BalanceFor("USD").Units != 90 || receiver.BalanceFor("USD").Units != 10 {
+		t.Errorf("expected captured amount without hold, got %+v %+v", sender, receiver)
+	}
+	if report := ledger.Check(ledgerRepo.Snapshot()); !report.Balanced {
+		t.Errorf("ledger is not balanced %+v", report)
+	}
+}
+
+func TestTransactionStoreRefund(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	txRepo := repo.Transaction()
+	original := transaction.New("a", "b", money.New(10, "USD"))
+	original.Create()
+	original.Status = transaction.StatusOK
+	if err := txRepo.Store(original); err != nil {
+		t.Error(err)
+		return
+	}
+	refund, err := original.Refund(money.New(4, "USD"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// crash between the writes stores neither the reservation nor the refund
+	txRepo.failpoint = func(step string) error {
+		return errors.New("crash")
+	}
+	if err := txRepo.StoreRefund(original, refund); err == nil {
+		t.Error("expected error storing refund, got nil")
+		return
+	}
+	txRepo.failpoint = nil
+	if stored, _ := txRepo.Find(original.ID); stored.Refunded != nil {
+		t.Errorf("expected no reservation without refund, got %v", stored.Refunded)
+		return
+	}
+	if _, err := txRepo.Find(refund.ID); err == nil {
+		t.Error("expected refund not stored")
+		return
+	}
+
+	if err := txRepo.StoreRefund(original, refund); err != nil {
+		t.Error(err)
+		return
+	}
+	stored, _ := txRepo.Find(original.ID)
+	found, err := txRepo.Find(refund.ID)
+	if err != nil || stored.Refunded == nil || stored.Refunded.Units != 4 || found.RefundOf != original.ID {
+		t.Errorf("expected reservation with refund, got %+v %+v %v", stored, found, err)
+	}
+}
+
+func TestTransactionExpiry(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	txRepo := repo.Transaction()
+	from, to := account.New(), account.New()
+	for _, acc := range []*account.Account{from, to} {
+		if err := accRepo.Store(acc); err != nil {
+			t.Errorf("error storing account %v", err)
+			return
+		}
+	}
+	if err := repo.Ledger().Post(ledger.Adjustment(from.ID, money.New(100, "USD"))); err != nil {
+		t.Errorf("error funding account %v", err)
+		return
+	}
+
+	cutoff := time.Now()
+	var created []*transaction.Transaction
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour, -time.Hour} {
+		trx := transaction.New(from.ID, to.ID, money.New(1, "USD"))
+		trx.Create()
+		trx.CreatedAt = cutoff.Add(-age)
+		if err := txRepo.Store(trx); err != nil {
+			t.Error(err)
+			return
+		}
+		created = append(created, trx)
+	}
+	// committed transaction leaves the index
+	created[1].Commit()
+	if err := txRepo.Store(created[1]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	txs, next, err := txRepo.FindExpiring(transaction.StatusCreated, cutoff, page.New("", 1))
+	if err != nil || len(txs) != 1 || txs[0].ID != created[0].ID || next == "" {
+		t.Errorf("expected oldest created transaction first, got %+v %q %v", txs, next, err)
+		return
+	}
+	txs, next, err = txRepo.FindExpiring(transaction.StatusCreated, cutoff, page.New(next, 1))
+	if err != nil || len(txs) != 1 || txs[0].ID != created[2].ID {
+		t.Errorf("expected next created transaction, got %+v %v", txs, err)
+		return
+	}
+	// the fresh transaction stops the scan
+	if txs, next, err = txRepo.FindExpiring(transaction.StatusCreated, cutoff, page.New(next, 1)); err != nil || len(txs) != 0 || next != "" {
+		t.Errorf("expected end of expired transactions, got %+v %q %v", txs, next, err)
+		return
+	}
+
+	hold := transaction.New(from.ID, to.ID, money.New(30, "USD"))
+	hold.Mode = transaction.ModeAuthorize
+	hold.Create()
+	hold.Commit()
+	txRepo.Store(hold)
+	err = txRepo.Transfer(hold.ID, func(tx *transaction.Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+		entry, err := tx.Settle(from, to)
+		expires := cutoff.Add(-time.Minute)
+		tx.ExpiresAt = &expires
+		return entry, err
+	})
+	if err != nil {
+		t.Errorf("error authorizing transaction %v", err)
+		return
+	}
+	if txs, _, err := txRepo.FindExpiring(transaction.StatusAuthorized, cutoff, page.New("", 0)); err != nil || len(txs) != 1 || txs[0].ID != hold.ID {
+		t.Errorf("expected expired hold, got %+v %v", txs, err)
+		return
+	}
+	if txs, _, err := txRepo.FindExpiring(transaction.StatusAuthorized, cutoff.Add(-time.Hour), page.New("", 0)); err != nil || len(txs) != 0 {
+		t.Errorf("expected no hold expired an hour ago, got %+v %v", txs, err)
+		return
+	}
+
+	if err := txRepo.Delete(created[0].ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if txs, _, err := txRepo.FindExpiring(transaction.StatusCreated, cutoff, page.New("", 0)); err != nil || len(txs) != 1 || txs[0].ID != created[2].ID {
+		t.Errorf("expected deleted transaction removed from index, got %+v %v", txs, err)
+	}
+}
+
+func TestLedgerRepository(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	accRepo := repo.Account()
+	ledgerRepo := repo.Ledger()
+
+	acc := account.New()
+	if err := accRepo.Store(acc); err != nil {
+		t.Errorf("error storing account %v", err)
+		return
+	}
+
+	entry := ledger.Adjustment(acc.ID, money.New(500, "EUR"))
+	if err := ledgerRepo.Post(entry); err != nil {
+		t.Errorf("error posting entry %v", err)
+		return
+	}
+	if err := ledgerRepo.Post(entry); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict posting entry twice, got %v", err)
+		return
+	}
+
+	unbalanced := ledger.New(ledger.EntryAdjustment, "", ledger.Posting{Account: acc.ID, Amount: money.New(1, "EUR")})
+	if err := ledgerRepo.Post(unbalanced); err != ledger.ErrUnbalanced {
+		t.Errorf("expected unbalanced error, got %v", err)
+		return
+	}
+
+	stored, err := accRepo.Find(acc.ID)
+	if err != nil {
+		t.Errorf("error finding account %v", err)
+		return
+	}
+	if stored.BalanceFor("EUR").Units != 500 {
+		t.Errorf("balance not derived from postings, want %v got %v", 500, stored.BalanceFor("EUR").Units)
+		return
+	}
+
+	found, err := ledgerRepo.Find(entry.ID)
+	if err != nil {
+		t.Errorf("error finding entry %v", err)
+		return
+	}
+	if len(found.Postings) != 2 {
+		t.Errorf("invalid number of postings, want %v got %v", 2, len(found.Postings))
+	}
+
+	if report := ledger.Check(ledgerRepo.Snapshot()); !report.Balanced {
+		t.Errorf("ledger is not balanced %+v", report)
+	}
+
+	// balance changed outside of the ledger must be reported
+	stored.SetBalance(money.New(1, "EUR"))
+	accRepo.Store(stored)
+	if report := ledger.Check(ledgerRepo.Snapshot()); report.Balanced {
+		t.Error("expected mismatch for balance changed without postings")
+	}
+}
+
+func TestIdempotencyRepository(t *testing.T) {
+	repo := openRepo(t)
+	defer closeRepo(t, repo)
+
+	recRepo := repo.Idempotency()
+	record := &idempotency.Record{Key: "POST /transactions abc", RequestHash: "hash", ExpiresAt: time.Now().Add(time.Minute), Token: "first"}
+	if err := recRepo.Create(record); err != nil {
+		t.Errorf("error creating record %v", err)
+		return
+	}
+	if err := recRepo.Create(record); err != idempotency.ErrExists {
+		t.Errorf("expected existing key error, got %v", err)
+		return
+	}
+
+	record.StatusCode = 200
+	record.Body = []byte(`{"transaction":{}}`)
+	if err := recRepo.Store(record); err != nil {
+		t.Errorf("error storing record %v", err)
+		return
+	}
+	found, err := recRepo.Find(record.Key)
+	if err != nil {
+		t.Errorf("error finding record %v", err)
+		return
+	}
+	if !found.Completed() || string(found.Body) != string(record.Body) {
+		t.Errorf("invalid stored record %+v", found)
+		return
+	}
+
+	if err := recRepo.Delete(record); err != nil {
+		t.Errorf("error deleting record %v", err)
+		return
+	}
+	if _, err := recRepo.Find(record.Key); err == nil {
+		t.Error("expected error for deleted record, got nil")
+		return
+	}
+
+	// expired lease is taken over by the next request
+	stale := &idempotency.Record{Key: "POST /transactions stale", RequestHash: "hash", ExpiresAt: time.Now().Add(-time.Second), Token: "stale"}
+	if err := recRepo.Create(stale); err != nil {
+		t.Errorf("error creating record %v", err)
+		return
+	}
+	retry := &idempotency.Record{Key: stale.Key, RequestHash: "hash", ExpiresAt: time.Now().Add(time.Minute), Token: "retry"}
+	if err := recRepo.Create(retry); err != nil {
+		t.Errorf("expected expired record to be replaced, got %v", err)
+		return
+	}
+	// the request which lost the lease can not overwrite or delete the record of the retry
+	stale.StatusCode = 200
+	if err := recRepo.Store(stale); err != idempotency.ErrLeaseLost {
+		t.Errorf("expected lost lease storing record, got %v", err)
+		return
+	}
+	if err := recRepo.Delete(stale); err != idempotency.ErrLeaseLost {
+		t.Errorf("expected lost lease deleting record, got %v", err)
+		return
+	}
+	stale.StatusCode = 0
+
+	if err := recRepo.Create(stale); err != idempotency.ErrExists {
+		t.Errorf("expected existing key error, got %v", err)
+		return
+	}
+	expired := &idempotency.Record{Key: "POST /transactions expired", RequestHash: "hash", StatusCode: 200, ExpiresAt: time.Now().Add(-time.Second)}
+	if err := recRepo.Create(expired); err != nil {
+		t.Errorf("error storing record %v", err)
+		return
+	}
+	if err := recRepo.DeleteExpired(time.Now()); err != nil {
+		t.Errorf("error deleting expired records %v", err)
+		return
+	}
+	if _, err := recRepo.Find(expired.Key); err == nil {
+		t.Error("expected expired record to be deleted")
+		return
+	}
+	if _, err := recRepo.Find(retry.Key); err != nil {
+		t.Errorf("expected live record to be kept, got %v", err)
+	}
+}
@@ -1,19 +1,48 @@
 package repository
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
-	"fmt"
+	"time"
 
+	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/MarinX/kit-payment/transaction"
+	"github.com/MarinX/kit-payment/uuid7"
 	"github.com/boltdb/bolt"
 )
 
 const (
 	transactionBucket = "transactions"
+
+	// accountTransactionBucket holds bucket per account with IDs of its transactions
+	accountTransactionBucket = "account_transactions"
+
+	// transactionHistoryBucket holds bucket per transaction with its status changes in sequence
+	transactionHistoryBucket = "transaction_history"
+
+	// transactionReferenceBucket holds bucket per client reference with IDs of its transactions
+	transactionReferenceBucket = "transaction_references"
+
+	transactionBatchBucket = "transaction_batches"
+
+	// transactionExpiryBucket holds bucket per expiring status with IDs of its transactions
+	// keyed by expiry time first, so sweeps stop at the first one which did not expire yet
+	transactionExpiryBucket = "transaction_expiry"
+)
+
+// direction flags stored as index value, transfer to itself has both
+const (
+	indexOutgoing byte = 1 << iota
+	indexIncoming
 )
 
 type transactionRepository struct {
 	db *bolt.DB
+
+	failpoint failpoint
 }
 
 func (a *transactionRepository) Store(trx *transaction.Transaction) error {
@@ -22,11 +51,7 @@ func (a *transactionRepository) Store(trx *transaction.Transaction) error {
 		if err != nil {
 			return err
 		}
-		buff, err := json.Marshal(trx)
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(trx.ID), buff)
+		return putTransaction(b, trx)
 	})
 }
 
@@ -37,11 +62,7 @@ func (a *transactionRepository) Find(id string) (*transaction.Transaction, error
 		if b == nil {
 			return nil
 		}
-		v := b.Get([]byte(id))
-		if v == nil {
-			return fmt.Errorf("%s transaction not found", id)
-		}
-		return json.Unmarshal(v, trx)
+		return getTransaction(b, id, trx)
 	})
 	return trx, err
 }
@@ -65,9 +86,534 @@ func (a *transactionRepository) FindAll() []*transaction.Transaction {
 	return txs
 }
 
+func (a *transactionRepository) FindPage(filter transaction.Filter, p page.Request) ([]*transaction.Transaction, string, error) {
+	var (
+		txs  []*transaction.Transaction
+		next string
+	)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(transactionBucket))
+		if b == nil {
+			return nil
+		}
+		// a reference narrows the scan to its index, which is keyed by transaction ID as well
+		src := b
+		if filter.Reference != "" {
+			if src = referenceBucket(tx, filter.Reference); src == nil {
+				return nil
+			}
+		}
+		// keys are time ordered IDs, creation range bounds the scan, legacy IDs have no time and are filtered
+		var from []byte
+		if !filter.CreatedFrom.IsZero() {
+			from = []byte(uuid7.Min(filter.CreatedFrom))
+		}
+		var err error
+		next, err = scanFrom(src, from, p, func(k, v []byte) (bool, error) {
+			if created, ok := uuid7.Time(string(k)); ok && !filter.CreatedTo.IsZero() && !created.Before(filter.CreatedTo) {
+				return false, errStopScan
+			}
+			if src != b {
+				v = b.Get(k)
+			}
+			tmp := &transaction.Transaction{}
+			if err := json.Unmarshal(v, tmp); err != nil {
+				return false, err
+			}
+			if !filter.Match(tmp) {
+				return false, nil
+			}
+			txs = append(txs, tmp)
+			return true, nil
+		})
+		return err
+	})
+	return txs, next, err
+}
+
+func (a *transactionRepository) FindByAccount(id string, direction transaction.Direction, p page.Request) ([]*transaction.Transaction, string, error) {
+	mask := indexOutgoing | indexIncoming
+	switch direction {
+	case transaction.DirectionOutgoing:
+		mask = indexOutgoing
+	case transaction.DirectionIncoming:
+		mask = indexIncoming
+	}
+
+	var (
+		txs  []*transaction.Transaction
+		next string
+	)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(accountTransactionBucket))
+		if index == nil {
+			return nil
+		}
+		b := index.Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		trxs := tx.Bucket([]byte(transactionBucket))
+		var err error
+		next, err = scan(b, p, func(k, v []byte) (bool, error) {
+			if len(v) == 0 || v[0]&mask == 0 {
+				return false, nil
+			}
+			tmp := &transaction.Transaction{}
+			if err := getTransaction(trxs, string(k), tmp); err != nil {
+				return false, err
+			}
+			txs = append(txs, tmp)
+			return true, nil
+		})
+		return err
+	})
+	return txs, next, err
+}
+
+func (a *transactionRepository) FindExpiring(status transaction.TransactionStatus, before time.Time, p page.Request) ([]*transaction.Transaction, string, error) {
+	var (
+		txs  []*transaction.Transaction
+		next string
+	)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(transactionExpiryBucket))
+		if index == nil {
+			return nil
+		}
+		b := index.Bucket([]byte(status))
+		if b == nil {
+			return nil
+		}
+		trxs := tx.Bucket([]byte(transactionBucket))
+		bound := expiryKey(before, "")
+		var err error
+		next, err = scan(b, p, func(k, v []byte) (bool, error) {
+			if bytes.Compare(k, bound) >= 0 {
+				return false, errStopScan
+			}
+			tmp := &transaction.Transaction{}
+			if err := getTransaction(trxs, string(v), tmp); err != nil {
+				return false, err
+			}
+			txs = append(txs, tmp)
+			return true, nil
+		})
+		return err
+	})
+	return txs, next, err
+}
+
 func (a *transactionRepository) Delete(id string) error {
 	return a.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(transactionBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s transaction not found", id)
+		}
+		trx := new(transaction.Transaction)
+		if err := getTransaction(b, id, trx); err != nil {
+			return err
+		}
+		if index := tx.Bucket([]byte(accountTransactionBucket)); index != nil {
+			for _, account := range trx.Accounts() {
+				if ab := index.Bucket([]byte(account)); ab != nil {
+					if err := ab.Delete([]byte(id)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if rb := referenceBucket(tx, trx.Reference); rb != nil {
+			if err := rb.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		if err := unindexExpiry(tx, trx); err != nil {
+			return err
+		}
 		return b.Delete([]byte(id))
 	})
 }
+
+// Transfer calls fn with the transaction and both accounts, stores account holds, posts the returned
+// ledger entry and stores the transaction in a single bolt transaction, so either all changes are written or none.
+func (a *transactionRepository) Transfer(id string, fn transaction.TransferFunc) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		trxs, err := tx.CreateBucketIfNotExists([]byte(transactionBucket))
+		if err != nil {
+			return err
+		}
+		accs, err := tx.CreateBucketIfNotExists([]byte(accountBucket))
+		if err != nil {
+			return err
+		}
+
+		trx := new(transaction.Transaction)
+		if err := getTransaction(trxs, id, trx); err != nil {
+			return err
+		}
+		return a.transfer(trxs, accs, trx, fn)
+	})
+}
+
+// TransferLegs loads accounts of all legs for fn and stores the returned entry with the transaction like Transfer
+func (a *transactionRepository) TransferLegs(id string, fn transaction.LegsFunc) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		trxs, err := tx.CreateBucketIfNotExists([]byte(transactionBucket))
+		if err != nil {
+			return err
+		}
+		accs, err := tx.CreateBucketIfNotExists([]byte(accountBucket))
+		if err != nil {
+			return err
+		}
+
+		trx := new(transaction.Transaction)
+		if err := getTransaction(trxs, id, trx); err != nil {
+			return err
+		}
+		accounts := map[string]*account.Account{}
+		for _, id := range trx.Accounts() {
+			if accounts[id] != nil {
+				continue
+			}
+			acc := new(account.Account)
+			if err := getAccount(accs, id, acc); err != nil {
+				return err
+			}
+			accounts[id] = acc
+		}
+
+		entry, err := fn(trx, accounts)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			if err := postEntry(tx, entry, a.failpoint); err != nil {
+				return err
+			}
+		}
+
+		if err := a.failpoint.check("transaction"); err != nil {
+			return err
+		}
+		return putTransaction(trxs, trx)
+	})
+}
+
+// TransferBatch stores the batch and transfers its transactions one by one in a single bolt transaction,
+// each transfer sees account balances changed by the previous ones
+func (a *transactionRepository) TransferBatch(batch *transaction.Batch, txs []*transaction.Transaction, fn transaction.TransferFunc) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		trxs, err := tx.CreateBucketIfNotExists([]byte(transactionBucket))
+		if err != nil {
+			return err
+		}
+		accs, err := tx.CreateBucketIfNotExists([]byte(accountBucket))
+		if err != nil {
+			return err
+		}
+		if err := putBatch(tx, batch); err != nil {
+			return err
+		}
+		for _, trx := range txs {
+			// the caller keeps its transactions unchanged if the batch is rolled back
+			copied := *trx
+			copied.Changes = append([]transaction.Change(nil), trx.Changes...)
+			if err := a.transfer(trxs, accs, &copied, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// transfer loads accounts of the transaction, calls fn, and stores the accounts, the entry and the transaction
+func (a *transactionRepository) transfer(trxs *bolt.Bucket, accs *bolt.Bucket, trx *transaction.Transaction, fn transaction.TransferFunc) error {
+	from := new(account.Account)
+	if err := getAccount(accs, trx.From, from); err != nil {
+		return err
+	}
+	// transfer to itself changes one account
+	to := from
+	if trx.To != trx.From {
+		to = new(account.Account)
+		if err := getAccount(accs, trx.To, to); err != nil {
+			return err
+		}
+	}
+
+	entry, err := fn(trx, from, to)
+	if err != nil {
+		return err
+	}
+	// holds are written before postings, which are applied to the stored accounts
+	accounts := []*account.Account{from}
+	if to != from {
+		accounts = append(accounts, to)
+	}
+	for _, acc := range accounts {
+		if err := putAccount(accs, acc); err != nil {
+			return err
+		}
+	}
+	if entry != nil {
+		if err := postEntry(trxs.Tx(), entry, a.failpoint); err != nil {
+			return err
+		}
+	}
+
+	if err := a.failpoint.check("transaction"); err != nil {
+		return err
+	}
+	return putTransaction(trxs, trx)
+}
+
+func (a *transactionRepository) StoreBatch(batch *transaction.Batch, txs []*transaction.Transaction) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(transactionBucket))
+		if err != nil {
+			return err
+		}
+		if err := putBatch(tx, batch); err != nil {
+			return err
+		}
+		for _, trx := range txs {
+			if err := putTransaction(b, trx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *transactionRepository) StoreRefund(original *transaction.Transaction, refund *transaction.Transaction) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(transactionBucket))
+		if err != nil {
+			return err
+		}
+		if err := putTransaction(b, original); err != nil {
+			return err
+		}
+		if err := a.failpoint.check("refund"); err != nil {
+			return err
+		}
+		return putTransaction(b, refund)
+	})
+}
+
+func (a *transactionRepository) FindBatch(id string) (*transaction.Batch, error) {
+	batch := new(transaction.Batch)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(transactionBatchBucket))
+		if b == nil {
+			return problem.New(problem.NotFound, "%s batch not found", id)
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return problem.New(problem.NotFound, "%s batch not found", id)
+		}
+		return json.Unmarshal(v, batch)
+	})
+	return batch, err
+}
+
+func putBatch(tx *bolt.Tx, batch *transaction.Batch) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(transactionBatchBucket))
+	if err != nil {
+		return err
+	}
+	buff, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(batch.ID), buff)
+}
+
+func (a *transactionRepository) History(id string) ([]*transaction.Change, error) {
+	var changes []*transaction.Change
+	err := a.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket([]byte(transactionHistoryBucket))
+		if history == nil {
+			return nil
+		}
+		b := history.Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			change := new(transaction.Change)
+			if err := json.Unmarshal(v, change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+			return nil
+		})
+	})
+	return changes, err
+}
+
+func getTransaction(b *bolt.Bucket, id string, trx *transaction.Transaction) error {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return problem.New(problem.NotFound, "%s transaction not found", id)
+	}
+	return json.Unmarshal(v, trx)
+}
+
+// putTransaction stores the transaction together with its account index entries
+// and appends its unsaved status changes to history
+func putTransaction(b *bolt.Bucket, trx *transaction.Transaction) error {
+	buff, err := json.Marshal(trx)
+	if err != nil {
+		return err
+	}
+	if err := indexTransaction(b.Tx(), trx); err != nil {
+		return err
+	}
+	if err := appendHistory(b.Tx(), trx); err != nil {
+		return err
+	}
+	return b.Put([]byte(trx.ID), buff)
+}
+
+// appendHistory stores changes keyed by big endian sequence, so they iterate in order
+func appendHistory(tx *bolt.Tx, trx *transaction.Transaction) error {
+	if len(trx.Changes) == 0 {
+		return nil
+	}
+	history, err := tx.CreateBucketIfNotExists([]byte(transactionHistoryBucket))
+	if err != nil {
+		return err
+	}
+	b, err := history.CreateBucketIfNotExists([]byte(trx.ID))
+	if err != nil {
+		return err
+	}
+	for _, change := range trx.Changes {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		buff, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, buff); err != nil {
+			return err
+		}
+	}
+	trx.Changes = nil
+	return nil
+}
+
+func indexTransaction(tx *bolt.Tx, trx *transaction.Transaction) error {
+	index, err := tx.CreateBucketIfNotExists([]byte(accountTransactionBucket))
+	if err != nil {
+		return err
+	}
+	flags := map[string]byte{}
+	for _, account := range trx.Senders() {
+		flags[account] |= indexOutgoing
+	}
+	for _, account := range trx.Receivers() {
+		flags[account] |= indexIncoming
+	}
+	for account, flag := range flags {
+		b, err := index.CreateBucketIfNotExists([]byte(account))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(trx.ID), []byte{flag}); err != nil {
+			return err
+		}
+	}
+	if err := indexExpiry(tx, trx); err != nil {
+		return err
+	}
+	if trx.Reference == "" {
+		return nil
+	}
+	refs, err := tx.CreateBucketIfNotExists([]byte(transactionReferenceBucket))
+	if err != nil {
+		return err
+	}
+	b, err := refs.CreateBucketIfNotExists([]byte(trx.Reference))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(trx.ID), []byte{})
+}
+
+// expiringStatuses are statuses the sweeps expire transactions from
+var expiringStatuses = []transaction.TransactionStatus{transaction.StatusCreated, transaction.StatusAuthorized}
+
+// indexExpiry keeps the transaction in the expiry index of its status only,
+// it leaves the index once it moves on. Expiry times do not change within a status.
+func indexExpiry(tx *bolt.Tx, trx *transaction.Transaction) error {
+	if err := unindexExpiry(tx, trx); err != nil {
+		return err
+	}
+	at, ok := trx.ExpiryTime()
+	if !ok {
+		return nil
+	}
+	index, err := tx.CreateBucketIfNotExists([]byte(transactionExpiryBucket))
+	if err != nil {
+		return err
+	}
+	b, err := index.CreateBucketIfNotExists([]byte(trx.Status))
+	if err != nil {
+		return err
+	}
+	return b.Put(expiryKey(at, trx.ID), []byte(trx.ID))
+}
+
+// unindexExpiry removes the transaction from expiry indexes of all statuses
+func unindexExpiry(tx *bolt.Tx, trx *transaction.Transaction) error {
+	index := tx.Bucket([]byte(transactionExpiryBucket))
+	if index == nil {
+		return nil
+	}
+	for _, status := range expiringStatuses {
+		b := index.Bucket([]byte(status))
+		if b == nil {
+			continue
+		}
+		copied := *trx
+		copied.Status = status
+		at, ok := copied.ExpiryTime()
+		if !ok {
+			continue
+		}
+		if err := b.Delete(expiryKey(at, trx.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiryKey orders by big endian unix nanoseconds, transactions without time come first
+func expiryKey(at time.Time, id string) []byte {
+	var nanos uint64
+	if !at.IsZero() && at.Unix() > 0 {
+		nanos = uint64(at.UnixNano())
+	}
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, nanos)
+	return append(key, id...)
+}
+
+func referenceBucket(tx *bolt.Tx, reference string) *bolt.Bucket {
+	if reference == "" {
+		return nil
+	}
+	refs := tx.Bucket([]byte(transactionReferenceBucket))
+	if refs == nil {
+		return nil
+	}
+	return refs.Bucket([]byte(reference))
+}
@@ -0,0 +1,101 @@
+package transaction
+
+import (
+	"time"
+
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/MarinX/kit-payment/uuid7"
+)
+
+// MaxBatch is the number of transfers a batch can have
+const MaxBatch = 1000
+
+// BatchStatus is the outcome of the whole batch
+type BatchStatus string
+
+const (
+	// BatchOK if all transfers of the batch were settled
+	BatchOK BatchStatus = "ok"
+
+	// BatchFailed if one of the transfers could not be settled and none was
+	BatchFailed BatchStatus = "failed"
+)
+
+// Batch is a set of transfers settled all or nothing
+type Batch struct {
+	ID     string      `json:"id"`
+	Status BatchStatus `json:"status"`
+
+	// Transactions are IDs of the batch transactions in the order of transfers
+	Transactions []string `json:"transactions"`
+
+	// Failed is index of the transfer which failed the batch
+	Failed        *int          `json:"failed,omitempty"`
+	FailureReason FailureReason `json:"failure_reason,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BatchItem is a single transfer of a batch
+type BatchItem struct {
+	From    string
+	To      string
+	Amount  money.Money
+	Details Details
+}
+
+// NewBatch creates batch with committed transactions of the items, they are stored only when the batch settles
+func NewBatch(items []BatchItem) (*Batch, []*Transaction, error) {
+	if len(items) == 0 {
+		return nil, nil, problem.New(problem.Invalid, "batch has no transfers")
+	}
+	if len(items) > MaxBatch {
+		return nil, nil, problem.New(problem.Invalid, "batch can have at most %d transfers", MaxBatch)
+	}
+
+	batch := &Batch{ID: uuid7.New()}
+	txs := make([]*Transaction, len(items))
+	for i, item := range items {
+		if err := item.Details.Validate(); err != nil {
+			return nil, nil, itemError(i, err)
+		}
+		if !item.Amount.IsPositive() {
+			return nil, nil, itemError(i, problem.New(problem.Invalid, "invalid amount"))
+		}
+		tx := New(item.From, item.To, item.Amount)
+		tx.Mode = ModeTransfer
+		tx.Batch = batch.ID
+		tx.Describe(item.Details)
+		tx.Create()
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		txs[i] = tx
+		batch.Transactions = append(batch.Transactions, tx.ID)
+	}
+	batch.CreatedAt = txs[0].CreatedAt
+	return batch, txs, nil
+}
+
+// Abort marks the batch failed because of the transfer at index, txs are the batch transactions
+// where the failed one is already settled, the others fail as well
+func (b *Batch) Abort(index int, txs []*Transaction) error {
+	b.Status = BatchFailed
+	b.Failed = &index
+	b.FailureReason = txs[index].FailureReason
+	for i, tx := range txs {
+		if i == index {
+			continue
+		}
+		if err := tx.Fail(ReasonBatchFailed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemError keeps the kind of err and adds index of the transfer to the message
+func itemError(index int, err error) error {
+	return problem.New(problem.KindOf(err), "transfer %d: %v", index, err)
+}
@@ -2,9 +2,15 @@ package transaction
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 
 	"github.com/go-kit/kit/endpoint"
 )
@@ -12,53 +18,229 @@ import (
 type transactionsRequest struct {
 	From     string           `json:"from"`
 	To       string           `json:"to"`
-	Amount   float64          `json:"amount"`
+	Amount   json.Number      `json:"amount"`
 	Currency account.Currency `json:"currency"`
+	Mode     Mode             `json:"mode"`
+
+	// Sources and Destinations replace From and To for multi-leg transaction
+	Sources      []legRequest `json:"sources"`
+	Destinations []legRequest `json:"destinations"`
+
+	Description string            `json:"description"`
+	Reference   string            `json:"reference"`
+	Metadata    map[string]string `json:"metadata"`
 }
 
 type transactionsResponse struct {
 	Transaction *Transaction `json:"transaction"`
-	Error       string       `json:"error,omitempty"`
 }
 
-func makeTransactionsEndpoint(s Service) endpoint.Endpoint {
+type legRequest struct {
+	Account  string           `json:"account"`
+	Amount   json.Number      `json:"amount"`
+	Currency account.Currency `json:"currency"`
+}
+
+func parseLegs(cs currency.Service, legs []legRequest) ([]Leg, error) {
+	parsed := make([]Leg, len(legs))
+	for i, leg := range legs {
+		if len(leg.Currency) == 0 {
+			return nil, problem.New(problem.Invalid, "missing currency")
+		}
+		amount, err := cs.ParseAmount(leg.Amount.String(), account.Currency(strings.ToUpper(string(leg.Currency))))
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = Leg{Account: leg.Account, Amount: amount}
+	}
+	return parsed, nil
+}
+
+func (req transactionsRequest) details() Details {
+	return Details{
+		Description: strings.TrimSpace(req.Description),
+		Reference:   strings.TrimSpace(req.Reference),
+		Metadata:    req.Metadata,
+	}
+}
+
+// parse validates addresses and returns the amount and details of the request
+func (req transactionsRequest) parse(cs currency.Service) (money.Money, Details, error) {
+	if len(req.From) == 0 || len(req.To) == 0 {
+		return money.Money{}, Details{}, problem.New(problem.Invalid, "missing address")
+	}
+
+	if len(req.Currency) == 0 {
+		return money.Money{}, Details{}, problem.New(problem.Invalid, "missing currency")
+	}
+
+	amount, err := cs.ParseAmount(req.Amount.String(), account.Currency(strings.ToUpper(string(req.Currency))))
+	if err != nil {
+		return money.Money{}, Details{}, err
+	}
+	if !amount.IsPositive() {
+		return money.Money{}, Details{}, problem.New(problem.Invalid, "invalid amount")
+	}
+
+	return amount, req.details(), nil
+}
+
+func makeTransactionsEndpoint(s Service, cs currency.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(transactionsRequest)
-		res := transactionsResponse{}
-		if len(req.From) == 0 || len(req.To) == 0 {
-			res.Error = errors.New("missing address").Error()
-			return res, nil
+		if len(req.Sources) > 0 || len(req.Destinations) > 0 {
+			return createMultiLeg(ctx, s, cs, req)
 		}
 
-		if len(req.Currency) == 0 {
-			res.Error = errors.New("missing currency").Error()
-			return res, nil
+		amount, details, err := req.parse(cs)
+		if err != nil {
+			return nil, err
 		}
 
-		if req.Amount <= 0 {
-			res.Error = errors.New("invalid amount").Error()
-			return res, nil
+		var tx *Transaction
+		switch req.Mode {
+		case "", ModeTransfer:
+			tx, err = s.CreateTransaction(ctx, req.From, req.To, amount, details)
+		case ModeAuthorize:
+			tx, err = s.AuthorizeTransaction(ctx, req.From, req.To, amount, details)
+		default:
+			return nil, problem.New(problem.Invalid, "unknown mode %s", req.Mode)
 		}
-
-		tx, err := s.CreateTransaction(req.From, req.To, req.Currency, req.Amount)
 		if err != nil {
-			res.Error = err.Error()
+			return nil, err
 		}
-		res.Transaction = tx
-		return res, nil
+		return transactionsResponse{Transaction: tx}, nil
 	}
 }
 
-type listTransactionsRequest struct{}
+func createMultiLeg(ctx context.Context, s Service, cs currency.Service, req transactionsRequest) (interface{}, error) {
+	if req.From != "" || req.To != "" || req.Amount != "" {
+		return nil, problem.New(problem.Invalid, "multi-leg transaction has sources and destinations instead of from, to and amount")
+	}
+	if req.Mode != "" && req.Mode != ModeTransfer {
+		return nil, problem.New(problem.Invalid, "multi-leg transaction supports only transfer mode")
+	}
+	sources, err := parseLegs(cs, req.Sources)
+	if err != nil {
+		return nil, err
+	}
+	destinations, err := parseLegs(cs, req.Destinations)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.CreateMultiLegTransaction(ctx, sources, destinations, req.details())
+	if err != nil {
+		return nil, err
+	}
+	return transactionsResponse{Transaction: tx}, nil
+}
+
+type listTransactionsRequest struct {
+	Status      TransactionStatus
+	Currency    money.Currency
+	From        string
+	To          string
+	MinAmount   string
+	MaxAmount   string
+	CreatedFrom string
+	CreatedTo   string
+	Reference   string
+	Page        page.Request
+}
 
 type listTransactionsResponse struct {
 	Transactions []*Transaction `json:"transactions"`
+	NextCursor   string         `json:"next_cursor,omitempty"`
 }
 
 func makeListTransactionsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listTransactionsRequest)
+		filter := Filter{
+			Status:   req.Status,
+			Currency: money.Currency(strings.ToUpper(string(req.Currency))),
+			From:     req.From,
+			To:       req.To,
+
+			Reference: req.Reference,
+		}
+
+		// amounts are only comparable within one currency
+		if (req.MinAmount != "" || req.MaxAmount != "") && filter.Currency == "" {
+			return nil, problem.New(problem.Invalid, "amount range requires currency")
+		}
+		var err error
+		if filter.MinAmount, err = parseBound(req.MinAmount, filter.Currency); err != nil {
+			return nil, err
+		}
+		if filter.MaxAmount, err = parseBound(req.MaxAmount, filter.Currency); err != nil {
+			return nil, err
+		}
+		if filter.CreatedFrom, err = parseTime(req.CreatedFrom); err != nil {
+			return nil, err
+		}
+		if filter.CreatedTo, err = parseTime(req.CreatedTo); err != nil {
+			return nil, err
+		}
+
+		txs, next, err := s.Transactions(filter, req.Page)
+		if err != nil {
+			return nil, err
+		}
+		return listTransactionsResponse{
+			Transactions: txs,
+			NextCursor:   next,
+		}, nil
+	}
+}
+
+// parseBound parses optional amount filter
+func parseBound(amount string, currency money.Currency) (*money.Money, error) {
+	if amount == "" {
+		return nil, nil
+	}
+	m, err := money.Parse(amount, currency)
+	if err != nil {
+		return nil, problem.Wrap(problem.Invalid, err)
+	}
+	return &m, nil
+}
+
+// parseTime parses optional RFC 3339 time filter
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, problem.New(problem.Invalid, "invalid time %q, expected RFC 3339", value)
+	}
+	return t, nil
+}
+
+type accountTransactionsRequest struct {
+	AccountID string
+	Direction Direction
+	Page      page.Request
+}
+
+func makeAccountTransactionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(accountTransactionsRequest)
+		switch req.Direction {
+		case DirectionAny, DirectionIncoming, DirectionOutgoing:
+		default:
+			return nil, problem.New(problem.Invalid, "invalid direction %q", req.Direction)
+		}
+
+		txs, next, err := s.AccountTransactions(req.AccountID, req.Direction, req.Page)
+		if err != nil {
+			return nil, err
+		}
 		return listTransactionsResponse{
-			Transactions: s.Transactions(),
+			Transactions: txs,
+			NextCursor:   next,
 		}, nil
 	}
 }
@@ -70,19 +252,15 @@ type getTransactionsRequest struct {
 func makeGetTransactionsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(getTransactionsRequest)
-		res := transactionsResponse{}
 
 		if req.ID == "" {
-			res.Error = errors.New("missing required ID").Error()
-			return res, nil
+			return nil, problem.New(problem.Invalid, "missing required ID")
 		}
 		trx, err := s.GetTransaction(req.ID)
 		if err != nil {
-			res.Error = err.Error()
+			return nil, err
 		}
-		res.Transaction = trx
-
-		return res, nil
+		return transactionsResponse{Transaction: trx}, nil
 	}
 }
 
@@ -93,19 +271,121 @@ type commitTransactionsRequest struct {
 func makeCommitTransactionsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(commitTransactionsRequest)
-		res := transactionsResponse{}
 		if req.ID == "" {
-			res.Error = errors.New("missing required ID").Error()
-			return res, nil
+			return nil, problem.New(problem.Invalid, "missing required ID")
 		}
 
-		trx, err := s.CommitTransaction(req.ID)
+		trx, err := s.CommitTransaction(ctx, req.ID)
 		if err != nil {
-			res.Error = err.Error()
-			return res, nil
+			return nil, err
 		}
-		res.Transaction = trx
-		return res, nil
+		return transactionsResponse{Transaction: trx}, nil
+	}
+}
+
+type refundTransactionsRequest struct {
+	ID     string      `json:"-"`
+	Amount json.Number `json:"amount"`
+}
+
+func makeRefundTransactionsEndpoint(s Service, cs currency.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(refundTransactionsRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		// partial refund is in the currency of the original transaction
+		var amount *money.Money
+		if req.Amount != "" {
+			original, err := s.GetTransaction(req.ID)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := cs.ParseAmount(req.Amount.String(), original.Amount.Currency)
+			if err != nil {
+				return nil, err
+			}
+			amount = &parsed
+		}
+
+		refund, err := s.RefundTransaction(ctx, req.ID, amount)
+		if err != nil {
+			return nil, err
+		}
+		return transactionsResponse{Transaction: refund}, nil
+	}
+}
+
+type captureTransactionsRequest struct {
+	ID     string      `json:"-"`
+	Amount json.Number `json:"amount"`
+}
+
+func makeCaptureTransactionsEndpoint(s Service, cs currency.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(captureTransactionsRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		// partial capture is in the currency of the authorization
+		var amount *money.Money
+		if req.Amount != "" {
+			authorized, err := s.GetTransaction(req.ID)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := cs.ParseAmount(req.Amount.String(), authorized.Amount.Currency)
+			if err != nil {
+				return nil, err
+			}
+			amount = &parsed
+		}
+
+		trx, err := s.CaptureTransaction(ctx, req.ID, amount)
+		if err != nil {
+			return nil, err
+		}
+		return transactionsResponse{Transaction: trx}, nil
+	}
+}
+
+type voidTransactionsRequest struct {
+	ID string
+}
+
+func makeVoidTransactionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(voidTransactionsRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		trx, err := s.VoidTransaction(ctx, req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return transactionsResponse{Transaction: trx}, nil
+	}
+}
+
+type cancelTransactionsRequest struct {
+	ID string
+}
+
+func makeCancelTransactionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(cancelTransactionsRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		trx, err := s.CancelTransaction(ctx, req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return transactionsResponse{Transaction: trx}, nil
 	}
 }
 
@@ -113,31 +393,102 @@ type hashTransactionsRequest struct {
 	ID string
 }
 type hashTransactionsResponse struct {
-	Hash  string `json:"hash"`
-	Error string `json:"error,omitempty"`
+	Hash string `json:"hash"`
 }
 
 func makeHashTransactionsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(hashTransactionsRequest)
-		res := hashTransactionsResponse{}
 
 		if req.ID == "" {
-			res.Error = errors.New("missing required ID").Error()
-			return res, nil
+			return nil, problem.New(problem.Invalid, "missing required ID")
 		}
 
 		trx, err := s.GetTransaction(req.ID)
 		if err != nil {
-			res.Error = err.Error()
-			return res, nil
+			return nil, err
 		}
 
 		hash, err := trx.Hash()
 		if err != nil {
-			res.Error = err.Error()
+			return nil, err
+		}
+		return hashTransactionsResponse{Hash: hash}, nil
+	}
+}
+
+type historyTransactionsRequest struct {
+	ID string
+}
+type historyTransactionsResponse struct {
+	History []*Change `json:"history"`
+}
+
+func makeHistoryTransactionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(historyTransactionsRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		history, err := s.History(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		if history == nil {
+			history = []*Change{}
+		}
+		return historyTransactionsResponse{History: history}, nil
+	}
+}
+
+type batchTransactionsRequest struct {
+	Transfers []transactionsRequest `json:"transfers"`
+}
+
+type batchTransactionsResponse struct {
+	Batch        *Batch         `json:"batch"`
+	Transactions []*Transaction `json:"transactions"`
+}
+
+func makeBatchTransactionsEndpoint(s Service, cs currency.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(batchTransactionsRequest)
+		items := make([]BatchItem, len(req.Transfers))
+		for i, transfer := range req.Transfers {
+			if transfer.Mode != "" && transfer.Mode != ModeTransfer {
+				return nil, itemError(i, problem.New(problem.Invalid, "batch supports only transfers"))
+			}
+			amount, details, err := transfer.parse(cs)
+			if err != nil {
+				return nil, itemError(i, err)
+			}
+			items[i] = BatchItem{From: transfer.From, To: transfer.To, Amount: amount, Details: details}
+		}
+
+		batch, txs, err := s.CreateBatch(ctx, items)
+		if err != nil {
+			return nil, err
+		}
+		return batchTransactionsResponse{Batch: batch, Transactions: txs}, nil
+	}
+}
+
+type getBatchTransactionsRequest struct {
+	ID string
+}
+
+func makeGetBatchTransactionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getBatchTransactionsRequest)
+		if req.ID == "" {
+			return nil, problem.New(problem.Invalid, "missing required ID")
+		}
+
+		batch, txs, err := s.GetBatch(req.ID)
+		if err != nil {
+			return nil, err
 		}
-		res.Hash = hash
-		return res, nil
+		return batchTransactionsResponse{Batch: batch, Transactions: txs}, nil
 	}
 }
@@ -0,0 +1,63 @@
+package transaction
+
+import (
+	"time"
+
+	"github.com/MarinX/kit-payment/problem"
+)
+
+// Actors changing transaction status
+const (
+	// ActorAPI is a client request
+	ActorAPI = "api"
+
+	// ActorSettlement is the settlement worker
+	ActorSettlement = "settlement"
+
+	// ActorSweeper expires transactions which were not committed in time
+	ActorSweeper = "sweeper"
+)
+
+// Change is a single status transition of a transaction
+type Change struct {
+	From   TransactionStatus `json:"from"`
+	To     TransactionStatus `json:"to"`
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor"`
+	Reason string            `json:"reason,omitempty"`
+}
+
+// transitions lists statuses reachable from each status, final statuses have none
+var transitions = map[TransactionStatus][]TransactionStatus{
+	"":            {StatusCreated},
+	StatusCreated: {StatusPending, StatusCancelled, StatusExpired},
+	// a commit which could not be queued goes back to created
+	StatusPending:    {StatusOK, StatusInsufficientFunds, StatusFailed, StatusCreated, StatusAuthorized},
+	StatusAuthorized: {StatusOK, StatusVoided, StatusExpired},
+}
+
+// CanTransition checks if the status can change from one to another
+func CanTransition(from TransactionStatus, to TransactionStatus) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition changes the status and records the change for the repository to append to history
+func (t *Transaction) transition(to TransactionStatus, actor string, reason string) error {
+	if !CanTransition(t.Status, to) {
+		return problem.New(problem.Conflict, "%s transaction cannot change from %s to %s", t.ID, t.Status, to)
+	}
+	t.Changes = append(t.Changes, Change{
+		From:   t.Status,
+		To:     to,
+		Time:   now(),
+		Actor:  actor,
+		Reason: reason,
+	})
+	t.Status = to
+	return nil
+}
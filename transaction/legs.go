@@ -0,0 +1,160 @@
+package transaction
+
+import (
+	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/problem"
+)
+
+// MaxLegs is the number of sources and destinations a multi-leg transaction can have
+const MaxLegs = 100
+
+// Leg is an amount debited from a source or credited to a destination account
+type Leg struct {
+	Account string      `json:"account"`
+	Amount  money.Money `json:"amount"`
+}
+
+// LegsFunc updates multi-leg transaction and returns ledger entry to post, accounts of all legs are keyed by ID
+type LegsFunc func(tx *Transaction, accounts map[string]*account.Account) (*ledger.Entry, error)
+
+// NewMultiLeg creates transaction moving money from sources to destinations, amounts must balance per currency.
+// From and To are the first source and destination, Amount is the total of sources in the currency of the first one,
+// Totals has the totals of all currencies.
+func NewMultiLeg(sources []Leg, destinations []Leg) (*Transaction, error) {
+	if len(sources) == 0 || len(destinations) == 0 {
+		return nil, problem.New(problem.Invalid, "multi-leg transaction needs sources and destinations")
+	}
+	if len(sources)+len(destinations) > MaxLegs {
+		return nil, problem.New(problem.Invalid, "multi-leg transaction can have at most %d legs", MaxLegs)
+	}
+
+	totals := map[money.Currency]int64{}
+	for _, legs := range [][]Leg{sources, destinations} {
+		for _, leg := range legs {
+			if leg.Account == "" {
+				return nil, problem.New(problem.Invalid, "missing address")
+			}
+			if !leg.Amount.IsPositive() {
+				return nil, problem.New(problem.Invalid, "invalid amount")
+			}
+		}
+	}
+	for _, leg := range sources {
+		totals[leg.Amount.Currency] += leg.Amount.Units
+	}
+	for _, leg := range destinations {
+		totals[leg.Amount.Currency] -= leg.Amount.Units
+	}
+	for currency, total := range totals {
+		if total != 0 {
+			return nil, problem.New(problem.Invalid, "legs do not balance in %s", currency)
+		}
+	}
+
+	amount := money.New(0, sources[0].Amount.Currency)
+	for _, leg := range sources {
+		if leg.Amount.Currency == amount.Currency {
+			amount.Units += leg.Amount.Units
+		}
+	}
+	tx := New(sources[0].Account, destinations[0].Account, amount)
+	tx.Mode = ModeTransfer
+	tx.Sources = sources
+	tx.Destinations = destinations
+	return tx, nil
+}
+
+// IsMultiLeg checks if the transaction has legs instead of single sender and receiver
+func (t *Transaction) IsMultiLeg() bool {
+	return len(t.Sources) > 0
+}
+
+// Senders returns accounts debited by the transaction
+func (t *Transaction) Senders() []string {
+	if !t.IsMultiLeg() {
+		return []string{t.From}
+	}
+	return legAccounts(t.Sources)
+}
+
+// Receivers returns accounts credited by the transaction
+func (t *Transaction) Receivers() []string {
+	if !t.IsMultiLeg() {
+		return []string{t.To}
+	}
+	return legAccounts(t.Destinations)
+}
+
+// Accounts returns all accounts of the transaction
+func (t *Transaction) Accounts() []string {
+	return append(t.Senders(), t.Receivers()...)
+}
+
+func legAccounts(legs []Leg) []string {
+	ids := make([]string, len(legs))
+	for i, leg := range legs {
+		ids[i] = leg.Account
+	}
+	return ids
+}
+
+// Totals returns amount moved by the transaction per currency, for multi-leg transaction the sum of its sources
+func (t *Transaction) Totals() map[money.Currency]money.Money {
+	if !t.IsMultiLeg() {
+		return map[money.Currency]money.Money{t.Amount.Currency: t.Amount}
+	}
+	totals := map[money.Currency]money.Money{}
+	for _, leg := range t.Sources {
+		total := totals[leg.Amount.Currency]
+		totals[leg.Amount.Currency] = money.New(total.Units+leg.Amount.Units, leg.Amount.Currency)
+	}
+	return totals
+}
+
+// SettleLegs returns ledger entry with posting per leg if every source has enough funds for all its legs
+func (t *Transaction) SettleLegs(accounts map[string]*account.Account) (*ledger.Entry, error) {
+	if t.Status != StatusPending {
+		return nil, nil
+	}
+	for _, id := range t.Accounts() {
+		if !accounts[id].IsActive() {
+			return nil, t.Fail(ReasonAccountInactive)
+		}
+	}
+
+	// one account can be source of several legs
+	debits := map[string]map[money.Currency]int64{}
+	for _, leg := range t.Sources {
+		if debits[leg.Account] == nil {
+			debits[leg.Account] = map[money.Currency]int64{}
+		}
+		debits[leg.Account][leg.Amount.Currency] += leg.Amount.Units
+	}
+	for id, totals := range debits {
+		for currency, units := range totals {
+			if !accounts[id].HasFunds(money.New(units, currency)) {
+				if err := t.transition(StatusInsufficientFunds, ActorSettlement, string(ReasonInsufficientFunds)); err != nil {
+					return nil, err
+				}
+				t.FailureReason = ReasonInsufficientFunds
+				t.settled()
+				return nil, nil
+			}
+		}
+	}
+
+	if err := t.transition(StatusOK, ActorSettlement, ""); err != nil {
+		return nil, err
+	}
+	t.settled()
+	postings := make([]ledger.Posting, 0, len(t.Sources)+len(t.Destinations))
+	for _, leg := range t.Sources {
+		postings = append(postings, ledger.Posting{Account: leg.Account, Amount: leg.Amount.Neg()})
+	}
+	for _, leg := range t.Destinations {
+		postings = append(postings, ledger.Posting{Account: leg.Account, Amount: leg.Amount})
+	}
+	return ledger.New(ledger.EntryTransfer, t.ID, postings...), nil
+}
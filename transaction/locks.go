@@ -0,0 +1,78 @@
+package transaction
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// accountLocks serializes settlements touching the same account
+type accountLocks struct {
+	mu    sync.Mutex
+	locks map[string]*accountLock
+}
+
+type accountLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newAccountLocks() *accountLocks {
+	return &accountLocks{
+		locks: make(map[string]*accountLock),
+	}
+}
+
+// lock acquires locks of all accounts in sorted order, so two settlements
+// can never wait on each other, and returns function releasing them
+func (l *accountLocks) lock(ids ...string) func() {
+	ids = unique(ids)
+
+	held := make([]*accountLock, 0, len(ids))
+	for _, id := range ids {
+		l.mu.Lock()
+		al, ok := l.locks[id]
+		if !ok {
+			al = &accountLock{}
+			l.locks[id] = al
+		}
+		al.refs++
+		l.mu.Unlock()
+
+		al.Lock()
+		held = append(held, al)
+	}
+
+	return func() {
+		for i, al := range held {
+			al.Unlock()
+
+			l.mu.Lock()
+			al.refs--
+			if al.refs == 0 {
+				delete(l.locks, ids[i])
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func unique(ids []string) []string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	out := sorted[:0]
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+// partition maps account to one of n workers
+func partition(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
@@ -1,28 +1,112 @@
 package transaction
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/go-kit/kit/log"
 )
 
 // Service is the interface that provides transaction methods.
 type Service interface {
 	// CreateTransaction creates a raw transaction
-	CreateTransaction(string, string, account.Currency, float64) (*Transaction, error)
+	CreateTransaction(context.Context, string, string, money.Money, Details) (*Transaction, error)
 
-	// CommitTransaction commits the transaction by ID
-	CommitTransaction(string) (*Transaction, error)
+	// CreateMultiLegTransaction creates a transaction moving money from sources to destinations,
+	// it is committed and settled like a raw transaction
+	CreateMultiLegTransaction(context.Context, []Leg, []Leg, Details) (*Transaction, error)
 
-	// Transactions lists all transactions
-	Transactions() []*Transaction
+	// AuthorizeTransaction creates a transaction which holds the amount on sender account once committed
+	AuthorizeTransaction(context.Context, string, string, money.Money, Details) (*Transaction, error)
+
+	// CaptureTransaction transfers the amount of authorized transaction and releases the rest of the hold.
+	// Nil amount captures the whole authorized amount.
+	CaptureTransaction(context.Context, string, *money.Money) (*Transaction, error)
+
+	// VoidTransaction releases the hold of authorized transaction
+	VoidTransaction(context.Context, string) (*Transaction, error)
+
+	// CommitTransaction commits the transaction by ID and queues it for settlement.
+	// It returns ErrQueueFull if the settlement queue is saturated.
+	CommitTransaction(context.Context, string) (*Transaction, error)
+
+	// RefundTransaction refunds the settled transaction by ID with reverse transaction queued for settlement.
+	// Nil amount refunds everything not refunded yet.
+	RefundTransaction(context.Context, string, *money.Money) (*Transaction, error)
+
+	// CancelTransaction cancels the transaction by ID, only created transactions can be cancelled
+	CancelTransaction(context.Context, string) (*Transaction, error)
+
+	// CreateBatch validates all transfers up front and settles them in one unit of work, either all or none.
+	// It returns the batch with its transactions in the order of transfers, batch which could not be settled
+	// is stored as failed.
+	CreateBatch(context.Context, []BatchItem) (*Batch, []*Transaction, error)
+
+	// GetBatch returns the batch by ID with its transactions
+	GetBatch(string) (*Batch, []*Transaction, error)
+
+	// Transactions lists page of transactions matching the filter and returns cursor of the next page
+	Transactions(Filter, page.Request) ([]*Transaction, string, error)
+
+	// AccountTransactions lists page of transactions of the account in given direction
+	AccountTransactions(string, Direction, page.Request) ([]*Transaction, string, error)
+
+	// History returns status changes of the transaction
+	History(string) ([]*Change, error)
 
 	// GetTransaction returns transaction by IDD
 	GetTransaction(string) (*Transaction, error)
 
-	// Watch is a event for transaction update
+	// Watch is a event for transaction update, it also expires uncommitted transactions
+	// after TTL and releases holds after HoldTTL
 	Watch()
+
+	// Recover enqueues transactions left pending by previous run for settlement
+	// and returns how many were found. Watch must be running to drain them.
+	Recover() int
+
+	// QueueDepth returns number of transactions waiting for settlement
+	QueueDepth() int
+
+	// Stop stops Watch after the transfers in progress are finished. Queued transactions
+	// stay pending in storage and are settled by Recover on next start.
+	// It returns context error if the workers did not finish before ctx is done.
+	Stop(context.Context) error
+}
+
+// ErrQueueFull is returned when the settlement queue is saturated, the request can be retried later
+var ErrQueueFull = problem.New(problem.Unavailable, "settlement queue is full")
+
+// RetryAfter is the suggested delay before retrying request rejected with ErrQueueFull
+const RetryAfter = time.Second
+
+// Config holds settlement options
+type Config struct {
+	// Workers is number of transactions settled in parallel.
+	// Transactions of the same account are always settled one by one.
+	Workers int
+
+	// QueueSize is number of committed transactions waiting for settlement
+	QueueSize int
+
+	// EnqueueTimeout is how long commit waits for space in a full queue
+	EnqueueTimeout time.Duration
+
+	// TTL is how long created transaction waits for commit before it expires, zero never expires
+	TTL time.Duration
+
+	// HoldTTL is how long authorized amount is held before it is released, zero holds until captured or voided
+	HoldTTL time.Duration
+
+	// SweepInterval is how often expired transactions and holds are looked up
+	SweepInterval time.Duration
 }
 
 type service struct {
@@ -30,56 +114,367 @@ type service struct {
 	accounts     account.Repository
 	onCreate     chan *Transaction
 	onPending    chan *Transaction
+	workers      []chan *Transaction
 	log          log.Logger
+	config       Config
+	locks        *accountLocks
+
+	// updates serializes status changes of one transaction made outside of settlement
+	updates *accountLocks
+
+	// state guards stopped, so Watch registers its goroutines before Stop waits for them or not at all
+	state   sync.Mutex
+	stopped bool
+	quit    chan struct{}
+	running sync.WaitGroup
 }
 
 // NewService creates transaction service
-func NewService(transactions Repository, accounts account.Repository, log log.Logger) Service {
+func NewService(transactions Repository, accounts account.Repository, log log.Logger, config Config) Service {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = 250
+	}
+	if config.SweepInterval <= 0 {
+		config.SweepInterval = time.Minute
+	}
+
+	// transactions of the same sender go to the same worker so debits keep commit order
+	workers := make([]chan *Transaction, config.Workers)
+	for i := range workers {
+		workers[i] = make(chan *Transaction, config.QueueSize)
+	}
+
 	return &service{
 		transactions: transactions,
 		accounts:     accounts,
 		log:          log,
-		onCreate:     make(chan *Transaction, 250),
-		onPending:    make(chan *Transaction, 250),
+		config:       config,
+		locks:        newAccountLocks(),
+		updates:      newAccountLocks(),
+		onCreate:     make(chan *Transaction, config.QueueSize),
+		onPending:    make(chan *Transaction, config.QueueSize),
+		workers:      workers,
+		quit:         make(chan struct{}),
 	}
 }
 
-func (s *service) CreateTransaction(from string, to string, currency account.Currency, amount float64) (*Transaction, error) {
+func (s *service) CreateTransaction(ctx context.Context, from string, to string, amount money.Money, details Details) (*Transaction, error) {
+	tx := New(from, to, amount)
+	tx.Mode = ModeTransfer
+	return s.create(ctx, tx, details)
+}
 
-	if _, err := s.accounts.Find(from); err != nil {
+func (s *service) CreateMultiLegTransaction(ctx context.Context, sources []Leg, destinations []Leg, details Details) (*Transaction, error) {
+	tx, err := NewMultiLeg(sources, destinations)
+	if err != nil {
 		return nil, err
 	}
+	return s.create(ctx, tx, details)
+}
+
+func (s *service) AuthorizeTransaction(ctx context.Context, from string, to string, amount money.Money, details Details) (*Transaction, error) {
+	tx := New(from, to, amount)
+	tx.Mode = ModeAuthorize
+	return s.create(ctx, tx, details)
+}
 
-	if _, err := s.accounts.Find(to); err != nil {
+func (s *service) create(ctx context.Context, tx *Transaction, details Details) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := details.Validate(); err != nil {
 		return nil, err
 	}
 
-	tx := New(from, to, currency, amount)
+	for _, id := range tx.Accounts() {
+		acc, err := s.accounts.Find(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := acc.CheckActive(); err != nil {
+			return nil, err
+		}
+	}
+
+	tx.Describe(details)
 	tx.Create()
 	err := s.transactions.Store(tx)
-	s.onCreate <- tx
-	return tx, err
+	if err != nil {
+		return tx, err
+	}
+
+	// creation events are only notifications, they are dropped instead of blocking the client
+	select {
+	case s.onCreate <- tx:
+	default:
+		s.log.Log("payment", "create event dropped", "transaction", tx.ID)
+	}
+	return tx, nil
 }
 
-func (s *service) CommitTransaction(id string) (*Transaction, error) {
+func (s *service) CommitTransaction(ctx context.Context, id string) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := s.updates.lock(id)
+	defer unlock()
+
 	tx, err := s.transactions.Find(id)
 	if err != nil {
 		return nil, err
 	}
-	if tx.Status != StatusCreated {
-		return nil, errors.New("unknown transaction")
+	return s.commit(ctx, tx)
+}
+
+// commit stores committed transaction and queues it, the caller holds the update lock
+func (s *service) commit(ctx context.Context, tx *Transaction) (*Transaction, error) {
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if err := s.transactions.Store(tx); err != nil {
+		return nil, err
+	}
+
+	if err := s.enqueue(ctx, tx); err != nil {
+		// not queued, so the client can commit again later
+		if rerr := tx.Rollback(err.Error()); rerr != nil {
+			return nil, rerr
+		}
+		if serr := s.transactions.Store(tx); serr != nil {
+			return nil, serr
+		}
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *service) RefundTransaction(ctx context.Context, id string, amount *money.Money) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	err = tx.Commit()
+
+	unlock := s.updates.lock(id)
+	defer unlock()
+
+	original, err := s.transactions.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if amount == nil {
+		refundable := original.Refundable()
+		amount = &refundable
+	}
+	refund, err := original.Refund(*amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// the amount is reserved together with the refund, a refund which does not settle gives it back
+	if err := s.transactions.StoreRefund(original, refund); err != nil {
+		return nil, err
+	}
+
+	committed, err := s.commit(ctx, refund)
 	if err != nil {
+		// refund was not queued, cancel it and give the amount back
+		if refund.Status == StatusCreated && refund.Cancel() == nil {
+			original.ReleaseRefund(refund.Amount)
+			s.checkError(s.transactions.StoreRefund(original, refund))
+		}
 		return nil, err
 	}
-	err = s.transactions.Store(tx)
-	s.onPending <- tx
-	return tx, err
+	return committed, nil
+}
+
+func (s *service) CaptureTransaction(ctx context.Context, id string, amount *money.Money) (*Transaction, error) {
+	return s.update(ctx, id, func(tx *Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+		if amount == nil {
+			return tx.Capture(tx.Amount, from, to)
+		}
+		return tx.Capture(*amount, from, to)
+	})
 }
 
-func (s *service) Transactions() []*Transaction {
-	return s.transactions.FindAll()
+func (s *service) VoidTransaction(ctx context.Context, id string) (*Transaction, error) {
+	return s.update(ctx, id, func(tx *Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+		return nil, tx.Void(from)
+	})
+}
+
+// update changes the transaction and its accounts in one unit of work,
+// holding account locks so it is ordered with settlements
+func (s *service) update(ctx context.Context, id string, fn TransferFunc) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.transactions.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.locks.lock(tx.From, tx.To)
+	defer unlock()
+
+	if err := s.transactions.Transfer(id, fn); err != nil {
+		return nil, err
+	}
+	return s.transactions.Find(id)
+}
+
+func (s *service) CancelTransaction(ctx context.Context, id string) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := s.updates.lock(id)
+	defer unlock()
+
+	tx, err := s.transactions.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Cancel(); err != nil {
+		return nil, err
+	}
+	if err := s.storeUnsettled(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// errBatchAborted stops the batch unit of work when one of its transfers is not settled
+var errBatchAborted = errors.New("batch aborted")
+
+func (s *service) CreateBatch(ctx context.Context, items []BatchItem) (*Batch, []*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	batch, txs, err := NewBatch(items)
+	if err != nil {
+		return nil, nil, err
+	}
+	checked := map[string]bool{}
+	ids := make([]string, 0, 2*len(txs))
+	for i, tx := range txs {
+		for _, id := range []string{tx.From, tx.To} {
+			if checked[id] {
+				continue
+			}
+			acc, err := s.accounts.Find(id)
+			if err != nil {
+				return nil, nil, itemError(i, err)
+			}
+			if err := acc.CheckActive(); err != nil {
+				return nil, nil, itemError(i, err)
+			}
+			checked[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	// the batch is ordered with settlements of all its accounts
+	unlock := s.locks.lock(ids...)
+	defer unlock()
+
+	batch.Status = BatchOK
+	settled := make([]*Transaction, 0, len(txs))
+	err = s.transactions.TransferBatch(batch, txs, func(trx *Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+		entry, err := trx.Settle(from, to)
+		if err != nil {
+			return nil, err
+		}
+		settled = append(settled, trx)
+		if trx.Status != StatusOK {
+			return nil, errBatchAborted
+		}
+		return entry, nil
+	})
+	if err == errBatchAborted {
+		// nothing was transferred, the batch is kept as failed with the reason of the failed transfer
+		failed := len(settled) - 1
+		txs[failed] = settled[failed]
+		if err := batch.Abort(failed, txs); err != nil {
+			return nil, nil, err
+		}
+		if err := s.transactions.StoreBatch(batch, txs); err != nil {
+			return nil, nil, err
+		}
+		return batch, txs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return batch, settled, nil
+}
+
+func (s *service) GetBatch(id string) (*Batch, []*Transaction, error) {
+	batch, err := s.transactions.FindBatch(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	txs := make([]*Transaction, 0, len(batch.Transactions))
+	for _, txID := range batch.Transactions {
+		tx, err := s.transactions.Find(txID)
+		if err != nil {
+			return nil, nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return batch, txs, nil
+}
+
+// enqueue waits up to EnqueueTimeout for space in the settlement queue
+func (s *service) enqueue(ctx context.Context, tx *Transaction) error {
+	select {
+	case s.onPending <- tx:
+		return nil
+	default:
+	}
+	if s.config.EnqueueTimeout <= 0 {
+		return ErrQueueFull
+	}
+
+	timer := time.NewTimer(s.config.EnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.onPending <- tx:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrQueueFull
+	}
+}
+
+func (s *service) QueueDepth() int {
+	depth := len(s.onPending)
+	for _, w := range s.workers {
+		depth += len(w)
+	}
+	return depth
+}
+
+func (s *service) Transactions(filter Filter, p page.Request) ([]*Transaction, string, error) {
+	return s.transactions.FindPage(filter, p)
+}
+
+func (s *service) AccountTransactions(id string, direction Direction, p page.Request) ([]*Transaction, string, error) {
+	if _, err := s.accounts.Find(id); err != nil {
+		return nil, "", err
+	}
+	return s.transactions.FindByAccount(id, direction, p)
+}
+
+func (s *service) History(id string) ([]*Change, error) {
+	if _, err := s.transactions.Find(id); err != nil {
+		return nil, err
+	}
+	return s.transactions.History(id)
 }
 
 func (s *service) GetTransaction(id string) (*Transaction, error) {
@@ -87,44 +482,320 @@ func (s *service) GetTransaction(id string) (*Transaction, error) {
 }
 
 func (s *service) Watch() {
+	sweep := s.config.TTL > 0 || s.config.HoldTTL > 0
+	s.state.Lock()
+	if s.stopped {
+		s.state.Unlock()
+		return
+	}
+	s.running.Add(len(s.workers) + 1)
+	if sweep {
+		s.running.Add(1)
+	}
+	s.state.Unlock()
+
+	defer s.running.Done()
+	for _, w := range s.workers {
+		go s.work(w)
+	}
+	if sweep {
+		go s.sweep()
+	}
+
 	for {
 		select {
+		case <-s.quit:
+			return
 		case <-s.onCreate:
 			// we can notify 3rd party systems here for new created transaction
 			break
 		case tx := <-s.onPending:
-			from, err := s.accounts.Find(tx.From)
-			if err != nil {
-				s.log.Log("cannot find account", "from", tx.From)
+			select {
+			case s.workers[partition(tx.From, len(s.workers))] <- tx:
+			case <-s.quit:
+				s.flush(tx)
 				return
 			}
-			to, err := s.accounts.Find(tx.To)
-			if err != nil {
-				s.log.Log("cannot find account", "to", tx.To)
+			break
+		}
+	}
+}
+
+// work settles transactions holding locks of both accounts,
+// so the receiver is not changed by another worker at the same time
+func (s *service) work(queue <-chan *Transaction) {
+	defer s.running.Done()
+	for {
+		// never start a new transfer once stopping
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+
+		select {
+		case <-s.quit:
+			return
+		case tx := <-queue:
+			unlock := s.locks.lock(tx.Accounts()...)
+			s.settle(tx)
+			unlock()
+		}
+	}
+}
+
+// sweep expires transactions not committed within TTL and holds not captured within HoldTTL until stopped
+func (s *service) sweep() {
+	defer s.running.Done()
+	ticker := time.NewTicker(s.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			if s.config.TTL > 0 {
+				if expired := s.expire(now().Add(-s.config.TTL)); expired > 0 {
+					s.log.Log("payment", "expired", "count", expired)
+				}
 			}
-			if !from.HasFunds(tx.Currency, tx.Amount) {
-				tx.Status = StatusInsufficientFunds
-				err := s.transactions.Store(tx)
-				s.checkError(err)
-				return
+			if released := s.expireHolds(now()); released > 0 {
+				s.log.Log("payment", "holds released", "count", released)
 			}
+		}
+	}
+}
 
-			// everything is fine, transfer the money
-			from.AppendBalance(tx.Currency, -tx.Amount)
-			err = s.accounts.Store(from)
+// expire marks transactions created before the time and still not committed as expired
+// and returns how many were expired
+func (s *service) expire(before time.Time) int {
+	count := 0
+	cursor := ""
+	for {
+		txs, next, err := s.transactions.FindExpiring(StatusCreated, before, page.New(cursor, page.MaxLimit))
+		if err != nil {
 			s.checkError(err)
+			return count
+		}
+		for _, tx := range txs {
+			if s.expireOne(tx.ID, before) {
+				count++
+			}
+		}
+		if next == "" {
+			return count
+		}
+		cursor = next
+	}
+}
 
-			to.AppendBalance(tx.Currency, tx.Amount)
-			err = s.accounts.Store(to)
+// expireHolds releases holds of authorized transactions which expired before the time
+// and returns how many were released
+func (s *service) expireHolds(before time.Time) int {
+	count := 0
+	cursor := ""
+	for {
+		txs, next, err := s.transactions.FindExpiring(StatusAuthorized, before, page.New(cursor, page.MaxLimit))
+		if err != nil {
 			s.checkError(err)
+			return count
+		}
+		for _, tx := range txs {
+			_, err := s.update(context.Background(), tx.ID, func(trx *Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+				return nil, trx.ExpireHold(from)
+			})
+			if err != nil {
+				// captured or voided meanwhile
+				s.checkError(err)
+				continue
+			}
+			count++
+		}
+		if next == "" {
+			return count
+		}
+		cursor = next
+	}
+}
 
-			tx.Status = StatusOK
-			err = s.transactions.Store(tx)
-			s.checkError(err)
+// expireOne expires the transaction unless it was committed or cancelled meanwhile
+func (s *service) expireOne(id string, before time.Time) bool {
+	unlock := s.updates.lock(id)
+	defer unlock()
 
-			break
+	tx, err := s.transactions.Find(id)
+	if err != nil {
+		s.checkError(err)
+		return false
+	}
+	if tx.Status != StatusCreated || !tx.CreatedAt.Before(before) {
+		return false
+	}
+	if err := tx.Expire(); err != nil {
+		s.checkError(err)
+		return false
+	}
+	if err := s.storeUnsettled(tx); err != nil {
+		s.checkError(err)
+		return false
+	}
+	return true
+}
+
+func (s *service) Stop(ctx context.Context) error {
+	s.state.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.quit)
+	}
+	s.state.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// whatever is left in the queues was not settled
+	flushed := 0
+	for _, queue := range append([]chan *Transaction{s.onPending}, s.workers...) {
+		for len(queue) > 0 {
+			s.flush(<-queue)
+			flushed++
+		}
+	}
+	s.log.Log("payment", "stopped", "pending", flushed)
+	return nil
+}
+
+// flush makes sure queued transaction is in storage, so Recover finds it on next start.
+// Commit stores the transaction before it is queued, so normally there is nothing to write.
+func (s *service) flush(tx *Transaction) {
+	if _, err := s.transactions.Find(tx.ID); err == nil {
+		return
+	}
+	s.checkError(s.transactions.Store(tx))
+}
+
+// settle handles single transaction, a failure is recorded on the transaction
+// and never stops the worker from processing the next one
+func (s *service) settle(tx *Transaction) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Log("payment", "panic", "transaction", tx.ID, "error", r)
+			s.fail(tx.ID, ReasonInternal)
+		}
+	}()
+
+	for _, id := range tx.Accounts() {
+		if _, err := s.accounts.Find(id); err != nil {
+			s.log.Log("payment", "cannot find account", "transaction", tx.ID, "account", id)
+			s.fail(tx.ID, ReasonAccountNotFound)
+			return
+		}
+	}
+
+	// debit, credit and status change are stored in one unit of work
+	var result TransactionStatus
+	var err error
+	if tx.IsMultiLeg() {
+		err = s.transactions.TransferLegs(tx.ID, (*Transaction).SettleLegs)
+	} else {
+		err = s.transactions.Transfer(tx.ID, func(trx *Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+			pending := trx.Status == StatusPending
+			entry, err := trx.Settle(from, to)
+			if pending {
+				result = trx.Status
+			}
+			if pending && trx.Status == StatusAuthorized && s.config.HoldTTL > 0 {
+				expires := now().Add(s.config.HoldTTL)
+				trx.ExpiresAt = &expires
+			}
+			return entry, err
+		})
+	}
+	if err != nil {
+		s.log.Log("payment", "error", "transaction", tx.ID, "error", err)
+		s.fail(tx.ID, ReasonInternal)
+		return
+	}
+	if result == StatusInsufficientFunds || result == StatusFailed {
+		s.releaseRefund(tx)
+	}
+}
+
+// fail marks transaction as failed if it is still pending
+func (s *service) fail(id string, reason FailureReason) {
+	tx, err := s.transactions.Find(id)
+	if err != nil {
+		s.checkError(err)
+		return
+	}
+	if tx.Status != StatusPending {
+		return
+	}
+	if err := tx.Fail(reason); err != nil {
+		s.checkError(err)
+		return
+	}
+	s.checkError(s.storeUnsettled(tx))
+}
+
+// storeUnsettled stores transaction which ended without settlement,
+// a refund gives its amount back to the original in the same unit of work
+func (s *service) storeUnsettled(tx *Transaction) error {
+	if tx.RefundOf == "" {
+		return s.transactions.Store(tx)
+	}
+	unlock := s.updates.lock(tx.RefundOf)
+	defer unlock()
+
+	original, err := s.transactions.Find(tx.RefundOf)
+	if err != nil {
+		return err
+	}
+	original.ReleaseRefund(tx.Amount)
+	return s.transactions.StoreRefund(original, tx)
+}
+
+// releaseRefund gives amount of unsuccessful refund back to the original transaction.
+// It is called once when the refund reaches final status, a crash before it only keeps the amount reserved.
+func (s *service) releaseRefund(refund *Transaction) {
+	if refund.RefundOf == "" {
+		return
+	}
+	unlock := s.updates.lock(refund.RefundOf)
+	defer unlock()
+
+	original, err := s.transactions.Find(refund.RefundOf)
+	if err != nil {
+		s.checkError(err)
+		return
+	}
+	original.ReleaseRefund(refund.Amount)
+	s.checkError(s.transactions.Store(original))
+}
+
+func (s *service) Recover() int {
+	count := 0
+	for _, tx := range s.transactions.FindAll() {
+		if tx.Status != StatusPending {
+			continue
+		}
+		// settlement skips transactions which are no longer pending, so enqueuing twice is safe
+		select {
+		case s.onPending <- tx:
+		case <-s.quit:
+			return count
 		}
+		count++
 	}
+	return count
 }
 
 func (s *service) checkError(err error) {
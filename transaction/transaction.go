@@ -2,11 +2,18 @@ package transaction
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"sort"
+	"time"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
+	"github.com/MarinX/kit-payment/uuid7"
 	"github.com/cbergoon/merkletree"
-	uuid "github.com/satori/go.uuid"
 )
 
 // TransactionStatus is our status handler
@@ -27,58 +34,541 @@ const (
 
 	// StatusCreated is when transaction is created and ready for commit
 	StatusCreated TransactionStatus = "created"
+
+	// StatusFailed if the transaction could not be settled, see FailureReason
+	StatusFailed TransactionStatus = "failed"
+
+	// StatusCancelled if the client cancelled the transaction before commit
+	StatusCancelled TransactionStatus = "cancelled"
+
+	// StatusExpired if the transaction was not committed in time or its hold was not captured in time
+	StatusExpired TransactionStatus = "expired"
+
+	// StatusAuthorized if the amount is held on sender account and waits for capture
+	StatusAuthorized TransactionStatus = "authorized"
+
+	// StatusVoided if the hold was released without capture
+	StatusVoided TransactionStatus = "voided"
+)
+
+// Mode decides what settlement does with the amount
+type Mode string
+
+const (
+	// ModeTransfer moves the amount, records without mode are transfers
+	ModeTransfer Mode = "transfer"
+
+	// ModeAuthorize holds the amount on sender account until it is captured or voided
+	ModeAuthorize Mode = "authorize"
+)
+
+// FailureReason is machine-readable cause of unsuccessful settlement
+type FailureReason string
+
+const (
+	// ReasonInsufficientFunds if the sender does not have enough balance
+	ReasonInsufficientFunds FailureReason = "insufficient_funds"
+
+	// ReasonAccountNotFound if the sender or receiver account does not exist
+	ReasonAccountNotFound FailureReason = "account_not_found"
+
+	// ReasonInternal for storage errors or crashes during settlement
+	ReasonInternal FailureReason = "internal_error"
+
+	// ReasonAccountInactive if the sender or receiver account is frozen or closed
+	ReasonAccountInactive FailureReason = "account_inactive"
+
+	// ReasonBatchFailed if another transfer of the same batch could not be settled
+	ReasonBatchFailed FailureReason = "batch_failed"
 )
 
 // Transaction represents transaction between 2 accounts
 type Transaction struct {
-	ID       string            `json:"id"`
-	From     string            `json:"from"`
-	To       string            `json:"to"`
-	Status   TransactionStatus `json:"status"`
-	Amount   float64           `json:"amount"`
-	Currency account.Currency  `json:"currency"`
+	ID     string            `json:"id"`
+	From   string            `json:"from"`
+	To     string            `json:"to"`
+	Status TransactionStatus `json:"status"`
+	Amount money.Money       `json:"amount"`
+	Mode   Mode              `json:"mode,omitempty"`
+
+	// Sources and Destinations are legs of multi-leg transaction
+	Sources      []Leg `json:"sources,omitempty"`
+	Destinations []Leg `json:"destinations,omitempty"`
+
+	Description string            `json:"description,omitempty"`
+	Reference   string            `json:"reference,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	FailureReason FailureReason `json:"failure_reason,omitempty"`
+
+	// RefundOf is ID of the original transaction if this is a refund
+	RefundOf string `json:"refund_of,omitempty"`
+	// Refunded is amount of refunds settled or in progress, it never exceeds transferred amount
+	Refunded *money.Money `json:"refunded,omitempty"`
+
+	// Batch is ID of the batch the transaction was settled with
+	Batch string `json:"batch,omitempty"`
+
+	// Captured is transferred part of authorized Amount
+	Captured *money.Money `json:"captured,omitempty"`
+	// ExpiresAt is when the hold of authorized transaction is released if not captured
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	CommittedAt *time.Time `json:"committed_at,omitempty"`
+	SettledAt   *time.Time `json:"settled_at,omitempty"`
+
+	// Changes are status transitions not stored yet, the repository appends them to history
+	Changes []Change `json:"-"`
+}
+
+// MaxMetadata is the number of metadata keys a transaction can have
+const MaxMetadata = 50
+
+// Details describe the transaction for the client, they are set once at creation
+type Details struct {
+	Description string            `json:"description"`
+	Reference   string            `json:"reference"`
+	Metadata    map[string]string `json:"metadata"`
 }
 
+// Validate checks the metadata keys
+func (d Details) Validate() error {
+	if len(d.Metadata) > MaxMetadata {
+		return problem.New(problem.Invalid, "transaction can have at most %d metadata keys", MaxMetadata)
+	}
+	for key := range d.Metadata {
+		if key == "" {
+			return problem.New(problem.Invalid, "metadata key can not be empty")
+		}
+	}
+	return nil
+}
+
+// now is the clock of transaction lifecycle
+var now = func() time.Time {
+	return time.Now().UTC()
+}
+
+// TransferFunc updates the transaction and returns ledger entry to post, if any
+type TransferFunc func(tx *Transaction, from *account.Account, to *account.Account) (*ledger.Entry, error)
+
 // Repository provides access a transaction store.
 type Repository interface {
 	Store(*Transaction) error
 	Find(id string) (*Transaction, error)
 	FindAll() []*Transaction
 	Delete(string) error
+
+	// FindPage returns transactions matching the filter after the page cursor and cursor of the next page
+	FindPage(Filter, page.Request) ([]*Transaction, string, error)
+
+	// FindByAccount returns page of transactions sent or received by the account
+	FindByAccount(string, Direction, page.Request) ([]*Transaction, string, error)
+
+	// FindExpiring returns page of transactions in the status with ExpiryTime before the time, earliest first
+	FindExpiring(TransactionStatus, time.Time, page.Request) ([]*Transaction, string, error)
+
+	// Transfer loads the transaction with its accounts, calls TransferFunc and stores
+	// the transaction with the returned entry atomically. Nothing is stored if TransferFunc fails.
+	Transfer(id string, fn TransferFunc) error
+
+	// TransferLegs is Transfer for multi-leg transaction, LegsFunc gets accounts of all legs
+	TransferLegs(id string, fn LegsFunc) error
+
+	// History returns status changes of the transaction in the order they happened
+	History(id string) ([]*Change, error)
+
+	// TransferBatch stores the batch with its transactions, calling TransferFunc for each of them in order
+	// with copies of the transaction and its accounts, and posts the returned entries atomically.
+	// Nothing is stored if TransferFunc fails for any transaction, the passed transactions are not changed.
+	TransferBatch(*Batch, []*Transaction, TransferFunc) error
+
+	// StoreBatch stores the batch with its transactions
+	StoreBatch(*Batch, []*Transaction) error
+
+	// StoreRefund stores the original transaction with its refunded amount and the refund atomically
+	StoreRefund(original *Transaction, refund *Transaction) error
+
+	// FindBatch returns batch by ID
+	FindBatch(id string) (*Batch, error)
+}
+
+// Direction of transaction from the point of view of an account
+type Direction string
+
+const (
+	// DirectionAny matches both sent and received transactions
+	DirectionAny Direction = ""
+
+	// DirectionIncoming matches transactions received by the account
+	DirectionIncoming Direction = "incoming"
+
+	// DirectionOutgoing matches transactions sent by the account
+	DirectionOutgoing Direction = "outgoing"
+)
+
+// Filter selects transactions, empty fields match all transactions.
+// Amount range is inclusive and matches only transactions in the currency of the bound.
+type Filter struct {
+	Status    TransactionStatus
+	Currency  money.Currency
+	From      string
+	To        string
+	MinAmount *money.Money
+	MaxAmount *money.Money
+
+	// CreatedFrom is inclusive and CreatedTo exclusive bound of creation time,
+	// transactions created before timestamps have none and never match the range
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+
+	Reference string
+}
+
+// Match checks if the transaction passes the filter, currency and amounts are matched against
+// the totals per currency, so multi-leg transaction matches any currency of its legs
+func (f Filter) Match(t *Transaction) bool {
+	totals := t.Totals()
+	_, inCurrency := totals[f.Currency]
+	switch {
+	case f.Status != "" && t.Status != f.Status:
+		return false
+	case f.Currency != "" && !inCurrency:
+		return false
+	case f.From != "" && !contains(t.Senders(), f.From):
+		return false
+	case f.To != "" && !contains(t.Receivers(), f.To):
+		return false
+	case f.MinAmount != nil && !inRange(totals, *f.MinAmount, func(total, bound int64) bool { return total >= bound }):
+		return false
+	case f.MaxAmount != nil && !inRange(totals, *f.MaxAmount, func(total, bound int64) bool { return total <= bound }):
+		return false
+	case (!f.CreatedFrom.IsZero() || !f.CreatedTo.IsZero()) && t.CreatedAt.IsZero():
+		return false
+	case !f.CreatedFrom.IsZero() && t.CreatedAt.Before(f.CreatedFrom):
+		return false
+	case !f.CreatedTo.IsZero() && !t.CreatedAt.Before(f.CreatedTo):
+		return false
+	case f.Reference != "" && t.Reference != f.Reference:
+		return false
+	}
+	return true
+}
+
+// inRange checks if there is total in the currency of the bound and it compares with the bound
+func inRange(totals map[money.Currency]money.Money, bound money.Money, cmp func(total, bound int64) bool) bool {
+	total, ok := totals[bound.Currency]
+	return ok && cmp(total.Units, bound.Units)
+}
+
+func contains(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
 }
 
 // New creates transaction between 2 accounts
-func New(from string, to string, currency account.Currency, amount float64) *Transaction {
+func New(from string, to string, amount money.Money) *Transaction {
 	return &Transaction{
-		From:     from,
-		To:       to,
-		Currency: currency,
-		Amount:   amount,
+		From:   from,
+		To:     to,
+		Amount: amount,
 	}
 }
 
-// Create creates new transaction with generated ID
+// Describe sets details of the transaction
+func (t *Transaction) Describe(d Details) {
+	t.Description = d.Description
+	t.Reference = d.Reference
+	t.Metadata = d.Metadata
+}
+
+// Create creates new transaction with ID generated from the creation time, IDs sort in creation order
 func (t *Transaction) Create() {
-	t.ID = uuid.Must(uuid.NewV4()).String()
-	t.Status = StatusCreated
+	t.Status = ""
+	t.Changes = nil
+	t.transition(StatusCreated, ActorAPI, "")
+	t.CreatedAt = t.changed()
+	t.ID = uuid7.At(t.CreatedAt)
 }
 
 // Commit commits the transaction, ready to be processed
 func (t *Transaction) Commit() error {
-	t.Status = StatusPending
+	if err := t.transition(StatusPending, ActorAPI, ""); err != nil {
+		return err
+	}
+	committed := t.changed()
+	t.CommittedAt = &committed
+	return nil
+}
+
+// Rollback returns committed transaction which was not queued for settlement to created
+func (t *Transaction) Rollback(reason string) error {
+	if err := t.transition(StatusCreated, ActorAPI, reason); err != nil {
+		return err
+	}
+	t.CommittedAt = nil
+	return nil
+}
+
+// Cancel cancels created transaction, it can not be committed anymore
+func (t *Transaction) Cancel() error {
+	return t.transition(StatusCancelled, ActorAPI, "")
+}
+
+// Expire marks created transaction which was not committed in time as expired
+func (t *Transaction) Expire() error {
+	return t.transition(StatusExpired, ActorSweeper, "")
+}
+
+// ExpiryTime returns the time expiry of the transaction is counted from, creation of created transaction
+// and hold expiry of authorized one. Transactions in other statuses do not expire.
+func (t *Transaction) ExpiryTime() (time.Time, bool) {
+	switch {
+	case t.Status == StatusCreated:
+		return t.CreatedAt, true
+	case t.Status == StatusAuthorized && t.ExpiresAt != nil:
+		return *t.ExpiresAt, true
+	}
+	return time.Time{}, false
+}
+
+// Transferred returns amount moved by the settled transaction, captured part for authorizations
+func (t *Transaction) Transferred() money.Money {
+	if t.Captured != nil {
+		return *t.Captured
+	}
+	return t.Amount
+}
+
+// Refundable returns amount which can still be refunded
+func (t *Transaction) Refundable() money.Money {
+	transferred := t.Transferred()
+	if t.Refunded == nil {
+		return transferred
+	}
+	return money.New(transferred.Units-t.Refunded.Units, transferred.Currency)
+}
+
+// Refund reserves the amount on settled transaction and returns created reverse transaction
+func (t *Transaction) Refund(amount money.Money) (*Transaction, error) {
+	if t.Status != StatusOK {
+		return nil, problem.New(problem.Conflict, "%s transaction is %s, only ok can be refunded", t.ID, t.Status)
+	}
+	if t.RefundOf != "" {
+		return nil, problem.New(problem.Invalid, "%s transaction is a refund and cannot be refunded", t.ID)
+	}
+	if t.IsMultiLeg() {
+		return nil, problem.New(problem.Invalid, "%s multi-leg transaction cannot be refunded", t.ID)
+	}
+	if amount.Currency != t.Amount.Currency {
+		return nil, problem.New(problem.Invalid, "refund currency %s does not match %s", amount.Currency, t.Amount.Currency)
+	}
+	refundable := t.Refundable()
+	if refundable.IsZero() {
+		return nil, problem.New(problem.Conflict, "%s transaction is fully refunded", t.ID)
+	}
+	if !amount.IsPositive() {
+		return nil, problem.New(problem.Invalid, "invalid amount")
+	}
+	if amount.Units > refundable.Units {
+		return nil, problem.New(problem.Conflict, "refund %s exceeds refundable %s", amount, refundable)
+	}
+
+	refunded := money.New(t.Transferred().Units-refundable.Units+amount.Units, t.Amount.Currency)
+	t.Refunded = &refunded
+
+	refund := New(t.To, t.From, amount)
+	refund.RefundOf = t.ID
+	refund.Reference = t.Reference
+	refund.Create()
+	return refund, nil
+}
+
+// ReleaseRefund returns amount of unsuccessful refund to the refundable amount
+func (t *Transaction) ReleaseRefund(amount money.Money) {
+	if t.Refunded == nil {
+		return
+	}
+	refunded := money.New(t.Refunded.Units-amount.Units, t.Refunded.Currency)
+	if refunded.Units < 0 {
+		refunded.Units = 0
+	}
+	t.Refunded = &refunded
+}
+
+// Fail marks the transaction as failed with given reason
+func (t *Transaction) Fail(reason FailureReason) error {
+	if err := t.transition(StatusFailed, ActorSettlement, string(reason)); err != nil {
+		return err
+	}
+	t.FailureReason = reason
+	t.settled()
+	return nil
+}
+
+// changed returns time of the last status change
+func (t *Transaction) changed() time.Time {
+	if len(t.Changes) == 0 {
+		return now()
+	}
+	return t.Changes[len(t.Changes)-1].Time
+}
+
+// settled records when the transaction reached final status
+func (t *Transaction) settled() {
+	settled := t.changed()
+	t.SettledAt = &settled
+}
+
+// Settle returns ledger entry moving the amount between accounts if the sender has enough funds.
+// Authorization holds the amount on sender account instead.
+func (t *Transaction) Settle(from *account.Account, to *account.Account) (*ledger.Entry, error) {
+	if t.Status != StatusPending {
+		return nil, nil
+	}
+	if !from.IsActive() || !to.IsActive() {
+		return nil, t.Fail(ReasonAccountInactive)
+	}
+	if !from.HasFunds(t.Amount) {
+		if err := t.transition(StatusInsufficientFunds, ActorSettlement, string(ReasonInsufficientFunds)); err != nil {
+			return nil, err
+		}
+		t.FailureReason = ReasonInsufficientFunds
+		t.settled()
+		return nil, nil
+	}
+
+	if t.Mode == ModeAuthorize {
+		if err := t.transition(StatusAuthorized, ActorSettlement, ""); err != nil {
+			return nil, err
+		}
+		from.Hold(t.Amount)
+		return nil, nil
+	}
+
+	if err := t.transition(StatusOK, ActorSettlement, ""); err != nil {
+		return nil, err
+	}
+	t.settled()
+	return ledger.Transfer(t.ID, from.ID, to.ID, t.Amount), nil
+}
+
+// Capture releases the hold and returns ledger entry moving the captured amount, the rest is not held anymore
+func (t *Transaction) Capture(amount money.Money, from *account.Account, to *account.Account) (*ledger.Entry, error) {
+	if t.Status != StatusAuthorized {
+		return nil, problem.New(problem.Conflict, "%s transaction is %s, only authorized can be captured", t.ID, t.Status)
+	}
+	if amount.Currency != t.Amount.Currency {
+		return nil, problem.New(problem.Invalid, "capture currency %s does not match %s", amount.Currency, t.Amount.Currency)
+	}
+	if !amount.IsPositive() {
+		return nil, problem.New(problem.Invalid, "invalid amount")
+	}
+	if amount.Units > t.Amount.Units {
+		return nil, problem.New(problem.Invalid, "capture %s exceeds authorized %s", amount, t.Amount)
+	}
+
+	for _, acc := range []*account.Account{from, to} {
+		if err := acc.CheckActive(); err != nil {
+			return nil, err
+		}
+	}
+
+	from.Release(t.Amount)
+	// balance can be lowered by an adjustment while the amount is held
+	if !from.HasFunds(amount) {
+		return nil, problem.New(problem.InsufficientFunds, "%s account has insufficient funds to capture %s", from.ID, amount)
+	}
+	reason := "captured"
+	if amount.Units < t.Amount.Units {
+		reason = "partially captured"
+	}
+	if err := t.transition(StatusOK, ActorAPI, reason); err != nil {
+		return nil, err
+	}
+	t.Captured = &amount
+	t.settled()
+	return ledger.Transfer(t.ID, from.ID, to.ID, amount), nil
+}
+
+// Void releases the hold of authorized transaction without moving money
+func (t *Transaction) Void(from *account.Account) error {
+	return t.release(StatusVoided, ActorAPI, from)
+}
+
+// ExpireHold releases the hold of authorized transaction which was not captured in time
+func (t *Transaction) ExpireHold(from *account.Account) error {
+	return t.release(StatusExpired, ActorSweeper, from)
+}
+
+func (t *Transaction) release(status TransactionStatus, actor string, from *account.Account) error {
+	if t.Status != StatusAuthorized {
+		return problem.New(problem.Conflict, "%s transaction is %s, only authorized can be released", t.ID, t.Status)
+	}
+	if err := t.transition(status, actor, ""); err != nil {
+		return err
+	}
+	from.Release(t.Amount)
+	t.settled()
 	return nil
 }
 
-//CalculateHash hashes the values of a transaction ID
+// CalculateHash hashes the values of a transaction ID and its details.
+// Details are tagged and added only when set, so transactions without them keep their hash.
 func (t Transaction) CalculateHash() ([]byte, error) {
 	h := sha256.New()
 	if _, err := h.Write([]byte(t.ID)); err != nil {
 		return nil, err
 	}
 
+	fields := [][]byte{}
+	if t.Description != "" {
+		fields = append(fields, encodeField('d', t.Description))
+	}
+	if t.Reference != "" {
+		fields = append(fields, encodeField('r', t.Reference))
+	}
+	keys := make([]string, 0, len(t.Metadata))
+	for key := range t.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, encodeField('m', key, t.Metadata[key]))
+	}
+	for _, leg := range t.Sources {
+		fields = append(fields, encodeField('s', leg.Account, leg.Amount.String()))
+	}
+	for _, leg := range t.Destinations {
+		fields = append(fields, encodeField('t', leg.Account, leg.Amount.String()))
+	}
+	for _, field := range fields {
+		if _, err := h.Write(field); err != nil {
+			return nil, err
+		}
+	}
+
 	return h.Sum(nil), nil
 }
 
+// encodeField separates the field from the ID and prefixes each value with its length,
+// so values containing separators or tags can not be mistaken for other fields
+func encodeField(tag byte, values ...string) []byte {
+	buf := []byte{0, tag}
+	for _, value := range values {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(value)))
+		buf = append(buf, size[:]...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
 // Hash is string representation of calculated hash
 func (t *Transaction) Hash() (string, error) {
 	calculated, err := t.CalculateHash()
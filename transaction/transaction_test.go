@@ -1,14 +1,27 @@
 package transaction
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/MarinX/kit-payment/account"
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/idempotency"
+	"github.com/MarinX/kit-payment/ledger"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/go-kit/kit/log"
 )
 
@@ -32,6 +45,24 @@ func (f *FakeRepoAccount) Find(id string) (*account.Account, error) {
 func (f *FakeRepoAccount) FindAll() []*account.Account {
 	return []*account.Account{}
 }
+func (f *FakeRepoAccount) FindPage(page.Request) ([]*account.Account, string, error) {
+	return []*account.Account{}, "", nil
+}
+func (f *FakeRepoAccount) Update(id string, fn func(*account.Account) error) error {
+	if f.makeError {
+		return errors.New("test error")
+	}
+	return fn(&account.Account{ID: id})
+}
+func (f *FakeRepoAccount) Adjust(id string, fn func(*account.Account) (*ledger.Entry, error)) error {
+	return errors.New("test error")
+}
+func (f *FakeRepoAccount) Summary(id string) (*account.Summary, error) {
+	return &account.Summary{}, nil
+}
+func (f *FakeRepoAccount) FindByExternalRef(ref string) (*account.Account, error) {
+	return nil, problem.New(problem.NotFound, "account with external reference %s not found", ref)
+}
 
 type FakeRepoTransaction struct {
 	makeError bool
@@ -52,16 +83,468 @@ func (f *FakeRepoTransaction) Find(id string) (*Transaction, error) {
 func (f *FakeRepoTransaction) FindAll() []*Transaction {
 	return []*Transaction{}
 }
+func (f *FakeRepoTransaction) FindPage(Filter, page.Request) ([]*Transaction, string, error) {
+	if f.makeError {
+		return nil, "", errors.New("test error")
+	}
+	return []*Transaction{}, "", nil
+}
+func (f *FakeRepoTransaction) FindExpiring(TransactionStatus, time.Time, page.Request) ([]*Transaction, string, error) {
+	if f.makeError {
+		return nil, "", errors.New("test error")
+	}
+	return []*Transaction{}, "", nil
+}
+func (f *FakeRepoTransaction) FindByAccount(string, Direction, page.Request) ([]*Transaction, string, error) {
+	return []*Transaction{}, "", nil
+}
 func (f *FakeRepoTransaction) Delete(id string) error {
 	if f.makeError {
 		return errors.New("test error")
 	}
 	return nil
 }
+func (f *FakeRepoTransaction) Transfer(id string, fn TransferFunc) error {
+	if f.makeError {
+		return errors.New("test error")
+	}
+	_, err := fn(&Transaction{ID: id, Status: StatusPending}, &account.Account{ID: "123"}, &account.Account{ID: "222"})
+	return err
+}
+func (f *FakeRepoTransaction) TransferLegs(id string, fn LegsFunc) error {
+	return errors.New("test error")
+}
+func (f *FakeRepoTransaction) History(id string) ([]*Change, error) {
+	if f.makeError {
+		return nil, errors.New("test error")
+	}
+	return []*Change{}, nil
+}
+func (f *FakeRepoTransaction) TransferBatch(*Batch, []*Transaction, TransferFunc) error {
+	return errors.New("test error")
+}
+func (f *FakeRepoTransaction) StoreBatch(*Batch, []*Transaction) error {
+	return errors.New("test error")
+}
+func (f *FakeRepoTransaction) StoreRefund(*Transaction, *Transaction) error {
+	if f.makeError {
+		return errors.New("test error")
+	}
+	return nil
+}
+func (f *FakeRepoTransaction) FindBatch(id string) (*Batch, error) {
+	return nil, problem.New(problem.NotFound, "%s batch not found", id)
+}
+
+// memStore keeps accounts and transactions in memory and settles like the bolt repository
+type memStore struct {
+	sync.Mutex
+	accounts     map[string]account.Account
+	transactions map[string]Transaction
+	history      map[string][]*Change
+	batches      map[string]Batch
+
+	// panicOn makes Transfer of the transaction panic
+	panicOn string
+
+	// latency simulates storage work done outside of the store lock
+	latency time.Duration
+	// inFlight tracks accounts being settled to detect parallel settlements of one account
+	inFlight map[string]bool
+	overlap  bool
+	settled  int
+}
+
+type MemRepoAccount struct{ *memStore }
+type MemRepoTransaction struct{ *memStore }
+
+func newMemStore() *memStore {
+	return &memStore{
+		accounts:     make(map[string]account.Account),
+		transactions: make(map[string]Transaction),
+		history:      make(map[string][]*Change),
+		batches:      make(map[string]Batch),
+		inFlight:     make(map[string]bool),
+	}
+}
+
+func (m *memStore) fund(id string, amount money.Money) {
+	m.Lock()
+	defer m.Unlock()
+	acc := account.Account{ID: id}
+	acc.SetBalance(amount)
+	m.accounts[id] = acc
+}
+
+func (m *memStore) balance(id string, currency account.Currency) money.Money {
+	m.Lock()
+	defer m.Unlock()
+	acc := m.accounts[id]
+	return acc.BalanceFor(currency)
+}
+
+func (m *memStore) transaction(id string) Transaction {
+	m.Lock()
+	defer m.Unlock()
+	return m.transactions[id]
+}
+
+// put stores the transaction and moves its changes to history, the lock must be held
+func (m *memStore) put(tx Transaction) {
+	for i := range tx.Changes {
+		m.history[tx.ID] = append(m.history[tx.ID], &tx.Changes[i])
+	}
+	tx.Changes = nil
+	m.transactions[tx.ID] = tx
+}
+
+func (m *memStore) status(id string) TransactionStatus {
+	m.Lock()
+	defer m.Unlock()
+	return m.transactions[id].Status
+}
+
+func (m MemRepoAccount) Store(acc *account.Account) error {
+	m.Lock()
+	defer m.Unlock()
+	m.accounts[acc.ID] = *acc
+	return nil
+}
+func (m MemRepoAccount) Find(id string) (*account.Account, error) {
+	m.Lock()
+	defer m.Unlock()
+	acc, ok := m.accounts[id]
+	if !ok {
+		return nil, problem.New(problem.NotFound, "%s account not found", id)
+	}
+	return &acc, nil
+}
+func (m MemRepoAccount) FindAll() []*account.Account {
+	return nil
+}
+func (m MemRepoAccount) FindPage(page.Request) ([]*account.Account, string, error) {
+	return nil, "", nil
+}
+func (m MemRepoAccount) Adjust(id string, fn func(*account.Account) (*ledger.Entry, error)) error {
+	return errors.New("not supported")
+}
+func (m MemRepoAccount) Summary(id string) (*account.Summary, error) {
+	return nil, errors.New("not supported")
+}
+func (m MemRepoAccount) FindByExternalRef(ref string) (*account.Account, error) {
+	return nil, problem.New(problem.NotFound, "account with external reference %s not found", ref)
+}
+func (m MemRepoAccount) Update(id string, fn func(*account.Account) error) error {
+	m.Lock()
+	defer m.Unlock()
+	acc, ok := m.accounts[id]
+	if !ok {
+		return problem.New(problem.NotFound, "%s account not found", id)
+	}
+	if err := fn(&acc); err != nil {
+		return err
+	}
+	m.accounts[id] = acc
+	return nil
+}
+
+func (m MemRepoTransaction) Store(tx *Transaction) error {
+	m.Lock()
+	defer m.Unlock()
+	m.put(*tx)
+	tx.Changes = nil
+	return nil
+}
+func (m MemRepoTransaction) StoreRefund(original *Transaction, refund *Transaction) error {
+	m.Lock()
+	defer m.Unlock()
+	m.put(*original)
+	m.put(*refund)
+	original.Changes, refund.Changes = nil, nil
+	return nil
+}
+func (m MemRepoTransaction) Find(id string) (*Transaction, error) {
+	m.Lock()
+	defer m.Unlock()
+	tx, ok := m.transactions[id]
+	if !ok {
+		return nil, problem.New(problem.NotFound, "%s transaction not found", id)
+	}
+	return &tx, nil
+}
+func (m MemRepoTransaction) FindAll() []*Transaction {
+	m.Lock()
+	defer m.Unlock()
+	var txs []*Transaction
+	for _, tx := range m.transactions {
+		tmp := tx
+		txs = append(txs, &tmp)
+	}
+	return txs
+}
+func (m MemRepoTransaction) FindPage(filter Filter, p page.Request) ([]*Transaction, string, error) {
+	var txs []*Transaction
+	for _, tx := range m.FindAll() {
+		if filter.Match(tx) {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, "", nil
+}
+func (m MemRepoTransaction) FindExpiring(status TransactionStatus, before time.Time, p page.Request) ([]*Transaction, string, error) {
+	var txs []*Transaction
+	for _, tx := range m.FindAll() {
+		if at, ok := tx.ExpiryTime(); ok && tx.Status == status && at.Before(before) {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, "", nil
+}
+func (m MemRepoTransaction) FindByAccount(id string, direction Direction, p page.Request) ([]*Transaction, string, error) {
+	var txs []*Transaction
+	for _, tx := range m.FindAll() {
+		outgoing := tx.From == id && direction != DirectionIncoming
+		incoming := tx.To == id && direction != DirectionOutgoing
+		if outgoing || incoming {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, "", nil
+}
+func (m MemRepoTransaction) Delete(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.transactions, id)
+	return nil
+}
+func (m MemRepoTransaction) Transfer(id string, fn TransferFunc) error {
+	if m.latency > 0 {
+		tx, _ := m.Find(id)
+		m.Lock()
+		if m.inFlight[tx.From] || m.inFlight[tx.To] {
+			m.overlap = true
+		}
+		m.inFlight[tx.From], m.inFlight[tx.To] = true, true
+		m.Unlock()
+
+		time.Sleep(m.latency)
+
+		m.Lock()
+		delete(m.inFlight, tx.From)
+		delete(m.inFlight, tx.To)
+		m.Unlock()
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.settled++
+	if id == m.panicOn {
+		panic("test panic")
+	}
+	tx, ok := m.transactions[id]
+	if !ok {
+		return errors.New("transaction not found")
+	}
+	return m.transfer(tx, fn)
+}
+
+// transfer settles the transaction with fn and stores the result, the lock must be held
+func (m *memStore) transfer(tx Transaction, fn TransferFunc) error {
+	from, ok := m.accounts[tx.From]
+	if !ok {
+		return errors.New("account not found")
+	}
+	to, ok := m.accounts[tx.To]
+	if !ok {
+		return errors.New("account not found")
+	}
+	toRef := &to
+	if tx.To == tx.From {
+		toRef = &from
+	}
+	entry, err := fn(&tx, &from, toRef)
+	if err != nil {
+		return err
+	}
+	m.accounts[toRef.ID] = *toRef
+	m.accounts[from.ID] = from
+	if entry != nil {
+		if err := entry.Validate(); err != nil {
+			return err
+		}
+		for _, p := range entry.Postings {
+			if p.Account == ledger.SystemAccount {
+				continue
+			}
+			acc := m.accounts[p.Account]
+			acc.AppendBalance(p.Amount)
+			m.accounts[p.Account] = acc
+		}
+	}
+	m.put(tx)
+	return nil
+}
+func (m MemRepoTransaction) History(id string) ([]*Change, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.history[id], nil
+}
+func (m MemRepoTransaction) TransferLegs(id string, fn LegsFunc) error {
+	m.Lock()
+	defer m.Unlock()
+	tx, ok := m.transactions[id]
+	if !ok {
+		return errors.New("transaction not found")
+	}
+	accounts := map[string]*account.Account{}
+	for _, id := range tx.Accounts() {
+		acc, ok := m.accounts[id]
+		if !ok {
+			return errors.New("account not found")
+		}
+		accounts[id] = &acc
+	}
+	entry, err := fn(&tx, accounts)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		if err := entry.Validate(); err != nil {
+			return err
+		}
+		for _, p := range entry.Postings {
+			acc := m.accounts[p.Account]
+			acc.AppendBalance(p.Amount)
+			m.accounts[p.Account] = acc
+		}
+	}
+	m.put(tx)
+	return nil
+}
+func (m MemRepoTransaction) TransferBatch(batch *Batch, txs []*Transaction, fn TransferFunc) error {
+	m.Lock()
+	defer m.Unlock()
+	// restore everything on failure like a rolled back bolt transaction
+	accounts, transactions, history := map[string]account.Account{}, map[string]Transaction{}, map[string][]*Change{}
+	for k, v := range m.accounts {
+		// balances are maps, keep a deep copy
+		var acc account.Account
+		buff, _ := json.Marshal(v)
+		json.Unmarshal(buff, &acc)
+		accounts[k] = acc
+	}
+	for k, v := range m.transactions {
+		transactions[k] = v
+	}
+	for k, v := range m.history {
+		history[k] = v
+	}
+	for _, tx := range txs {
+		copied := *tx
+		copied.Changes = append([]Change(nil), tx.Changes...)
+		if err := m.transfer(copied, fn); err != nil {
+			m.accounts, m.transactions, m.history = accounts, transactions, history
+			return err
+		}
+	}
+	m.batches[batch.ID] = *batch
+	return nil
+}
+func (m MemRepoTransaction) StoreBatch(batch *Batch, txs []*Transaction) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, tx := range txs {
+		m.put(*tx)
+	}
+	m.batches[batch.ID] = *batch
+	return nil
+}
+func (m MemRepoTransaction) FindBatch(id string) (*Batch, error) {
+	m.Lock()
+	defer m.Unlock()
+	batch, ok := m.batches[id]
+	if !ok {
+		return nil, problem.New(problem.NotFound, "%s batch not found", id)
+	}
+	return &batch, nil
+}
+
+// waitStatus polls until the transaction reaches the status
+func waitStatus(t *testing.T, m *memStore, id string, status TransactionStatus) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if m.status(id) == status {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("transaction %v did not reach %v, got %v", id, status, m.status(id))
+	return false
+}
+
+type FakeRepoIdempotency struct {
+	records map[string]*idempotency.Record
+}
+
+func (f *FakeRepoIdempotency) Create(r *idempotency.Record) error {
+	if existing, ok := f.records[r.Key]; ok && !existing.Expired(time.Now()) {
+		return idempotency.ErrExists
+	}
+	tmp := *r
+	f.records[r.Key] = &tmp
+	return nil
+}
+func (f *FakeRepoIdempotency) Store(r *idempotency.Record) error {
+	if existing, ok := f.records[r.Key]; !ok || existing.Token != r.Token {
+		return idempotency.ErrLeaseLost
+	}
+	tmp := *r
+	f.records[r.Key] = &tmp
+	return nil
+}
+func (f *FakeRepoIdempotency) Find(key string) (*idempotency.Record, error) {
+	r, ok := f.records[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return r, nil
+}
+func (f *FakeRepoIdempotency) Delete(r *idempotency.Record) error {
+	if existing, ok := f.records[r.Key]; !ok || existing.Token != r.Token {
+		return idempotency.ErrLeaseLost
+	}
+	delete(f.records, r.Key)
+	return nil
+}
+func (f *FakeRepoIdempotency) DeleteExpired(before time.Time) error {
+	for key, r := range f.records {
+		if r.Expired(before) {
+			delete(f.records, key)
+		}
+	}
+	return nil
+}
+
+type FakeRepoCurrency struct {
+	disabled bool
+}
+
+func (f *FakeRepoCurrency) Store(*currency.Currency) error {
+	return nil
+}
+func (f *FakeRepoCurrency) Find(code money.Currency) (*currency.Currency, error) {
+	info, _ := money.Lookup(code)
+	c := currency.New(info)
+	c.Enabled = !f.disabled
+	return c, nil
+}
+func (f *FakeRepoCurrency) FindAll() []*currency.Currency {
+	return currency.Defaults()
+}
 
 func TestTransactionModel(t *testing.T) {
 
-	tx := New("123", "222", account.Currency("USD"), 10)
+	tx := New("123", "222", money.New(10, "USD"))
 	if tx.ID != "" {
 		t.Error("expectedd ID to be empty on init model")
 		return
@@ -76,6 +559,16 @@ func TestTransactionModel(t *testing.T) {
 		t.Errorf("transaction status is wrong, want %v got %v", StatusCreated, tx.Status)
 		return
 	}
+	if tx.CreatedAt.IsZero() || tx.CommittedAt != nil || tx.SettledAt != nil {
+		t.Errorf("expected only creation time, got %v %v %v", tx.CreatedAt, tx.CommittedAt, tx.SettledAt)
+		return
+	}
+	next := New("123", "222", money.New(10, "USD"))
+	next.Create()
+	if next.ID <= tx.ID {
+		t.Errorf("expected time ordered IDs, got %v after %v", next.ID, tx.ID)
+		return
+	}
 
 	// merkle tree hash
 	h, err := tx.Hash()
@@ -88,135 +581,1535 @@ func TestTransactionModel(t *testing.T) {
 	tx.Commit()
 	if tx.Status != StatusPending {
 		t.Errorf("transaction status is wrong, want %v got %v", StatusPending, tx.Status)
+		return
 	}
-}
-
-func TestTransactionService(t *testing.T) {
-	tfr := &FakeRepoTransaction{}
-	afr := &FakeRepoAccount{}
-	var logger = log.NewLogfmtLogger(os.Stderr)
-	service := NewService(tfr, afr, logger)
-
-	tx, err := service.CreateTransaction("123", "222", account.Currency("USD"), 1)
-	if err != nil {
-		t.Errorf("transaction creation error %v", err)
+	if tx.CommittedAt == nil || tx.CommittedAt.Before(tx.CreatedAt) {
+		t.Errorf("expected commit time after creation, got %v", tx.CommittedAt)
 		return
 	}
-	if tx.ID == "" {
-		t.Errorf("expected ID after transaction creation, got nil")
+	if err := tx.Commit(); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict committing twice, got %v", err)
+		return
+	}
+	if len(tx.Changes) != 2 || tx.Changes[1].From != StatusCreated || tx.Changes[1].To != StatusPending {
+		t.Errorf("expected created and committed changes, got %+v", tx.Changes)
 		return
 	}
 
-	tx, err = service.CommitTransaction(tx.ID)
-	if err != nil {
-		t.Errorf("error commit transaction %v", err)
+	from := &account.Account{ID: "123"}
+	to := &account.Account{ID: "222"}
+	from.SetBalance(money.New(5, "USD"))
+	entry, _ := tx.Settle(from, to)
+	if tx.Status != StatusInsufficientFunds {
+		t.Errorf("transaction status is wrong, want %v got %v", StatusInsufficientFunds, tx.Status)
 		return
 	}
-	if tx.Status != StatusPending {
-		t.Errorf("transaction did not change status, want %v got %v", StatusPending, tx.Status)
+	if entry != nil {
+		t.Error("expected no ledger entry for insufficient funds")
+		return
+	}
+	if tx.SettledAt == nil {
+		t.Error("expected settlement time")
 		return
 	}
 
-	if _, err := service.GetTransaction("123"); err != nil {
-		t.Errorf("error getting transaction %v", err)
+	tx.Status = StatusPending
+	from.SetBalance(money.New(15, "USD"))
+	entry, _ = tx.Settle(from, to)
+	if tx.Status != StatusOK {
+		t.Errorf("transaction status is wrong, want %v got %v", StatusOK, tx.Status)
+		return
+	}
+	if entry == nil || entry.Validate() != nil || entry.Reference != tx.ID {
+		t.Errorf("expected balanced ledger entry for transaction, got %+v", entry)
+		return
+	}
+	if entry.Postings[0].Account != "123" || entry.Postings[0].Amount.Units != -10 {
+		t.Errorf("expected sender to be debited, got %+v", entry.Postings[0])
 		return
 	}
 
-	tfr.makeError = true
+	// settling twice must not move money again
+	if entry, _ = tx.Settle(from, to); entry != nil {
+		t.Error("transaction settled twice")
+	}
+	if err := tx.Fail(ReasonInternal); !problem.Is(err, problem.Conflict) || tx.Status != StatusOK {
+		t.Errorf("expected settled transaction to stay %v, got %v %v", StatusOK, tx.Status, err)
+	}
+}
 
-	if _, err := service.CreateTransaction("123", "222", account.Currency("USD"), 1); err == nil {
-		t.Error("expected error for creation, got nil")
+func TestTransactionRefundModel(t *testing.T) {
+	tx := New("123", "222", money.New(10, "USD"))
+	tx.Create()
+	if _, err := tx.Refund(money.New(1, "USD")); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict refunding created transaction, got %v", err)
 		return
 	}
+	tx.Status = StatusOK
 
-	if _, err := service.CommitTransaction("123"); err == nil {
-		t.Error("expected error for commit, got nil")
+	refund, err := tx.Refund(money.New(4, "USD"))
+	if err != nil {
+		t.Errorf("error refunding transaction %v", err)
 		return
 	}
-
-	if _, err := service.GetTransaction("123"); err == nil {
-		t.Error("expected error for getting transaction, got nil")
+	if refund.From != "222" || refund.To != "123" || refund.RefundOf != tx.ID || refund.Status != StatusCreated {
+		t.Errorf("expected reverse transaction, got %+v", refund)
+		return
+	}
+	if refundable := tx.Refundable(); refundable.Units != 6 {
+		t.Errorf("invalid refundable amount, want %v got %v", 6, refundable.Units)
 		return
 	}
 
-	trxs := service.Transactions()
-	if len(trxs) > 0 {
-		t.Errorf("expected 0 transactions got %v", len(trxs))
+	cases := map[money.Money]problem.Kind{
+		money.New(7, "USD"):  problem.Conflict,
+		money.New(1, "EUR"):  problem.Invalid,
+		money.New(0, "USD"):  problem.Invalid,
+		money.New(-1, "USD"): problem.Invalid,
+	}
+	for amount, kind := range cases {
+		if _, err := tx.Refund(amount); !problem.Is(err, kind) {
+			t.Errorf("refund of %v, expected %v got %v", amount, kind, err)
+		}
+	}
+
+	refund.Status = StatusOK
+	if _, err := refund.Refund(money.New(1, "USD")); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected refund of refund to be invalid, got %v", err)
 	}
 
+	tx.ReleaseRefund(refund.Amount)
+	if _, err := tx.Refund(money.New(10, "USD")); err != nil {
+		t.Errorf("expected released amount to be refundable, got %v", err)
+		return
+	}
+	if _, err := tx.Refund(money.New(1, "USD")); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict refunding fully refunded transaction, got %v", err)
+	}
 }
 
-func TestTransactionREST(t *testing.T) {
-	tfr := &FakeRepoTransaction{}
-	afr := &FakeRepoAccount{}
-	var logger = log.NewLogfmtLogger(os.Stderr)
-	service := NewService(tfr, afr, logger)
-	handler := MakeHandler(service, logger)
+func TestTransactionAuthorizeModel(t *testing.T) {
+	tx := New("123", "222", money.New(6, "USD"))
+	tx.Mode = ModeAuthorize
+	tx.Create()
+	tx.Commit()
 
-	rr := makeRequest(t, "POST", "/transactions", handler)
-	res := transactionsResponse{}
-	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
-		t.Error(err)
+	from := &account.Account{ID: "123"}
+	to := &account.Account{ID: "222"}
+	from.SetBalance(money.New(10, "USD"))
+	entry, err := tx.Settle(from, to)
+	if err != nil || entry != nil || tx.Status != StatusAuthorized {
+		t.Errorf("expected hold without ledger entry, got %v %+v %v", tx.Status, entry, err)
 		return
 	}
-	if res.Error == "" {
-		t.Error("expected error, got nil")
+	if from.HeldFor("USD").Units != 6 || from.HasFunds(money.New(5, "USD")) || tx.SettledAt != nil {
+		t.Errorf("expected held amount, got %v", from.Held)
 		return
 	}
 
-	rr = makeRequest(t, "GET", "/transactions", handler)
-	listRes := listTransactionsResponse{}
-	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
-		t.Error(err)
+	if _, err := tx.Capture(money.New(7, "USD"), from, to); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected capture over authorized amount to be invalid, got %v", err)
 		return
 	}
-
-	rr = makeRequest(t, "GET", "/transactions/123", handler)
-	res = transactionsResponse{}
-	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
-		t.Error(err)
+	entry, err = tx.Capture(money.New(4, "USD"), from, to)
+	if err != nil || entry == nil || entry.Postings[1].Amount.Units != 4 {
+		t.Errorf("expected ledger entry of captured amount, got %+v %v", entry, err)
 		return
 	}
-	if res.Error != "" {
-		t.Errorf("unexpected error for getting transaction %v", res.Error)
+	if tx.Status != StatusOK || len(from.Held) != 0 || tx.Refundable().Units != 4 {
+		t.Errorf("expected released hold and captured amount, got %v %v %v", tx.Status, from.Held, tx.Refundable())
 		return
 	}
+	if err := tx.Void(from); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict voiding captured transaction, got %v", err)
+	}
 
-	rr = makeRequest(t, "PUT", "/transactions/123/commit", handler)
-	res = transactionsResponse{}
-	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+	voided := New("123", "222", money.New(6, "USD"))
+	voided.Mode = ModeAuthorize
+	voided.Create()
+	voided.Commit()
+	voided.Settle(from, to)
+	if err := voided.Void(from); err != nil || voided.Status != StatusVoided || len(from.Held) != 0 {
+		t.Errorf("expected voided transaction without hold, got %v %v %v", voided.Status, from.Held, err)
+	}
+}
+
+func TestTransactionMultiLegModel(t *testing.T) {
+	usd := func(units int64) money.Money {
+		return money.New(units, "USD")
+	}
+	invalid := [][2][]Leg{
+		{nil, {{Account: "222", Amount: usd(10)}}},
+		{{{Account: "123", Amount: usd(10)}}, {{Account: "222", Amount: usd(9)}}},
+		{{{Account: "123", Amount: usd(10)}}, {{Account: "222", Amount: money.New(10, "EUR")}}},
+		{{{Account: "123", Amount: usd(0)}}, {{Account: "222", Amount: usd(0)}}},
+		{{{Account: "", Amount: usd(10)}}, {{Account: "222", Amount: usd(10)}}},
+	}
+	for _, legs := range invalid {
+		if _, err := NewMultiLeg(legs[0], legs[1]); !problem.Is(err, problem.Invalid) {
+			t.Errorf("expected invalid error for %+v, got %v", legs, err)
+		}
+	}
+
+	// one order paid by two cards split to seller, platform fee and tax
+	sources := []Leg{{Account: "123", Amount: usd(60)}, {Account: "123", Amount: usd(40)}}
+	destinations := []Leg{{Account: "seller", Amount: usd(85)}, {Account: "platform", Amount: usd(10)}, {Account: "tax", Amount: usd(5)}}
+	tx, err := NewMultiLeg(sources, destinations)
+	if err != nil {
 		t.Error(err)
 		return
 	}
-	if res.Error != "" {
-		t.Errorf("unexpected error for commiting transaction %v", res.Error)
+	if tx.From != "123" || tx.To != "seller" || tx.Amount != usd(100) || !tx.IsMultiLeg() {
+		t.Errorf("expected first legs and total amount, got %+v", tx)
+		return
+	}
+	if !(Filter{From: "123", To: "tax"}).Match(tx) || (Filter{From: "seller"}).Match(tx) {
+		t.Error("expected filter to match leg accounts")
 		return
 	}
+	tx.Create()
+	tx.Commit()
 
-	rr = makeRequest(t, "GET", "/transactions/123/hash", handler)
-	hashRes := hashTransactionsResponse{}
-	if err := json.NewDecoder(rr.Body).Decode(&hashRes); err != nil {
-		t.Error(err)
+	accounts := map[string]*account.Account{}
+	for _, id := range tx.Accounts() {
+		accounts[id] = &account.Account{ID: id}
+	}
+	accounts["123"].SetBalance(usd(99))
+	if entry, err := tx.SettleLegs(accounts); entry != nil || err != nil || tx.Status != StatusInsufficientFunds {
+		t.Errorf("expected insufficient funds for all legs of one source, got %v %v %v", entry, err, tx.Status)
 		return
 	}
-	if res.Error != "" {
-		t.Errorf("unexpected error for getting hash transaction %v", res.Error)
+
+	tx, _ = NewMultiLeg(sources, destinations)
+	tx.Create()
+	tx.Commit()
+	accounts["123"].SetBalance(usd(100))
+	entry, err := tx.SettleLegs(accounts)
+	if err != nil || tx.Status != StatusOK || tx.SettledAt == nil {
+		t.Errorf("expected settled transaction, got %v %v", err, tx.Status)
 		return
 	}
-	t.Log(hashRes.Hash)
+	if len(entry.Postings) != 5 || entry.Reference != tx.ID || entry.Validate() != nil {
+		t.Errorf("expected balanced posting per leg, got %+v", entry)
+		return
+	}
+	if _, err := tx.Refund(usd(10)); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected invalid error refunding multi-leg transaction, got %v", err)
+	}
+}
 
+func TestTransactionTransitions(t *testing.T) {
+	allowed := [][2]TransactionStatus{
+		{"", StatusCreated},
+		{StatusCreated, StatusPending},
+		{StatusPending, StatusOK},
+		{StatusPending, StatusInsufficientFunds},
+		{StatusPending, StatusFailed},
+		{StatusPending, StatusCreated},
+	}
+	for _, c := range allowed {
+		if !CanTransition(c[0], c[1]) {
+			t.Errorf("expected %q -> %q to be allowed", c[0], c[1])
+		}
+	}
+
+	denied := [][2]TransactionStatus{
+		{StatusCreated, StatusOK},
+		{StatusCreated, StatusFailed},
+		{StatusOK, StatusPending},
+		{StatusFailed, StatusOK},
+		{StatusInsufficientFunds, StatusCreated},
+		{"", StatusPending},
+	}
+	for _, c := range denied {
+		if CanTransition(c[0], c[1]) {
+			t.Errorf("expected %q -> %q to be denied", c[0], c[1])
+		}
+	}
+
+	tx := New("123", "222", money.New(10, "USD"))
+	tx.Create()
+	tx.Commit()
+	if err := tx.Rollback("queue full"); err != nil || tx.Status != StatusCreated || tx.CommittedAt != nil {
+		t.Errorf("expected rollback to created, got %v %v %v", tx.Status, tx.CommittedAt, err)
+		return
+	}
+	last := tx.Changes[len(tx.Changes)-1]
+	if last.From != StatusPending || last.Actor != ActorAPI || last.Reason != "queue full" {
+		t.Errorf("unexpected rollback change %+v", last)
+	}
 }
 
-func makeRequest(t *testing.T, method string, path string, handler http.Handler) *httptest.ResponseRecorder {
-	req, err := http.NewRequest(method, path, nil)
+func TestTransactionService(t *testing.T) {
+	tfr := &FakeRepoTransaction{}
+	afr := &FakeRepoAccount{}
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(tfr, afr, logger, Config{})
+
+	tx, err := service.CreateTransaction(context.Background(), "123", "222", money.New(1, "USD"), Details{})
+	if err != nil {
+		t.Errorf("transaction creation error %v", err)
+		return
+	}
+	if tx.ID == "" {
+		t.Errorf("expected ID after transaction creation, got nil")
+		return
+	}
+
+	tx, err = service.CommitTransaction(context.Background(), tx.ID)
+	if err != nil {
+		t.Errorf("error commit transaction %v", err)
+		return
+	}
+	if tx.Status != StatusPending {
+		t.Errorf("transaction did not change status, want %v got %v", StatusPending, tx.Status)
+		return
+	}
+
+	if _, err := service.GetTransaction("123"); err != nil {
+		t.Errorf("error getting transaction %v", err)
+		return
+	}
+
+	tfr.makeError = true
+
+	if _, err := service.CreateTransaction(context.Background(), "123", "222", money.New(1, "USD"), Details{}); err == nil {
+		t.Error("expected error for creation, got nil")
+		return
+	}
+
+	if _, err := service.CommitTransaction(context.Background(), "123"); err == nil {
+		t.Error("expected error for commit, got nil")
+		return
+	}
+
+	if _, err := service.GetTransaction("123"); err == nil {
+		t.Error("expected error for getting transaction, got nil")
+		return
+	}
+
+	if _, _, err := service.Transactions(Filter{}, page.New("", 0)); err == nil {
+		t.Error("expected error for listing transactions, got nil")
+	}
+
+}
+
+func TestTransactionFilter(t *testing.T) {
+	created := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tx := &Transaction{From: "123", To: "222", Status: StatusOK, Amount: money.New(1050, "USD"), CreatedAt: created}
+	usd := func(units int64) *money.Money {
+		m := money.New(units, "USD")
+		return &m
+	}
+	eur := money.New(1, "EUR")
+
+	cases := []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{}, true},
+		{Filter{Status: StatusOK, Currency: "USD", From: "123", To: "222"}, true},
+		{Filter{Status: StatusPending}, false},
+		{Filter{Currency: "EUR"}, false},
+		{Filter{From: "222"}, false},
+		{Filter{To: "123"}, false},
+		{Filter{MinAmount: usd(1050), MaxAmount: usd(1050)}, true},
+		{Filter{MinAmount: usd(1051)}, false},
+		{Filter{MaxAmount: usd(1049)}, false},
+		{Filter{MinAmount: &eur}, false},
+		{Filter{CreatedFrom: created, CreatedTo: created.Add(time.Second)}, true},
+		{Filter{CreatedFrom: created.Add(time.Second)}, false},
+		{Filter{CreatedTo: created}, false},
+		{Filter{Reference: "order-1"}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Match(tx); got != c.match {
+			t.Errorf("filter %+v, want %v got %v", c.filter, c.match, got)
+		}
+	}
+
+	// transactions stored before timestamps are outside of any creation range
+	legacy := *tx
+	legacy.CreatedAt = time.Time{}
+	if (Filter{CreatedTo: created.Add(time.Second)}).Match(&legacy) {
+		t.Error("expected transaction without creation time not to match")
+	}
+
+	// multi-leg transaction matches totals of every currency, not only the first one
+	multi, err := NewMultiLeg(
+		[]Leg{{Account: "123", Amount: money.New(100, "USD")}, {Account: "124", Amount: money.New(300, "EUR")}, {Account: "125", Amount: money.New(200, "EUR")}},
+		[]Leg{{Account: "222", Amount: money.New(100, "USD")}, {Account: "223", Amount: money.New(500, "EUR")}},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	eurs := func(units int64) *money.Money {
+		m := money.New(units, "EUR")
+		return &m
+	}
+	multiCases := []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{Currency: "EUR"}, true},
+		{Filter{Currency: "USD"}, true},
+		{Filter{Currency: "GBP"}, false},
+		{Filter{Currency: "EUR", MinAmount: eurs(500), MaxAmount: eurs(500)}, true},
+		{Filter{MinAmount: eurs(501)}, false},
+		{Filter{MaxAmount: eurs(499)}, false},
+		{Filter{MinAmount: usd(100), MaxAmount: usd(100)}, true},
+	}
+	for _, c := range multiCases {
+		if got := c.filter.Match(multi); got != c.match {
+			t.Errorf("multi-leg filter %+v, want %v got %v", c.filter, c.match, got)
+		}
+	}
+}
+
+func TestTransactionDetails(t *testing.T) {
+	tx := New("123", "222", money.New(1, "USD"))
+	tx.Create()
+	plain, _ := tx.CalculateHash()
+
+	details := Details{Description: "dinner", Reference: "order-1", Metadata: map[string]string{"table": "4", "guests": "2"}}
+	described := *tx
+	described.Describe(details)
+	hash, _ := described.CalculateHash()
+	if bytes.Equal(plain, hash) {
+		t.Error("expected details to change the hash")
+		return
+	}
+	// metadata order does not change the hash
+	again, _ := described.CalculateHash()
+	if !bytes.Equal(hash, again) {
+		t.Error("expected stable hash")
+		return
+	}
+	described.Metadata = map[string]string{"table": "5", "guests": "2"}
+	if changed, _ := described.CalculateHash(); bytes.Equal(hash, changed) {
+		t.Error("expected metadata to change the hash")
+		return
+	}
+	if sum := sha256.Sum256([]byte(tx.ID)); !bytes.Equal(plain, sum[:]) {
+		t.Error("expected hash of transaction without details to stay hash of its ID")
+		return
+	}
+
+	// values can not run into the next field
+	collisions := [][2]Details{
+		{{Description: "a\x00rX"}, {Description: "a", Reference: "X"}},
+		{{Metadata: map[string]string{"a=b": "c"}}, {Metadata: map[string]string{"a": "b=c"}}},
+	}
+	for _, c := range collisions {
+		first, second := *tx, *tx
+		first.Describe(c[0])
+		second.Describe(c[1])
+		h1, _ := first.CalculateHash()
+		h2, _ := second.CalculateHash()
+		if bytes.Equal(h1, h2) {
+			t.Errorf("expected different hashes for %+v and %+v", c[0], c[1])
+			return
+		}
+	}
+	usd := money.New(1, "USD")
+	split, joined := *tx, *tx
+	split.Sources = []Leg{{Account: "a", Amount: usd}, {Account: "b", Amount: usd}}
+	joined.Sources = []Leg{{Account: "a=" + usd.String() + "\x00sb", Amount: usd}}
+	h1, _ := split.CalculateHash()
+	h2, _ := joined.CalculateHash()
+	if bytes.Equal(h1, h2) {
+		t.Error("expected different hashes for different legs")
+		return
+	}
+
+	store := newMemStore()
+	store.fund("123", money.New(10, "USD"))
+	store.fund("222", money.New(0, "USD"))
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, log.NewNopLogger(), Config{})
+
+	if _, err := service.CreateTransaction(context.Background(), "123", "222", money.New(1, "USD"), Details{Metadata: map[string]string{"": "x"}}); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected invalid error for empty metadata key, got %v", err)
+		return
+	}
+	created, err := service.CreateTransaction(context.Background(), "123", "222", money.New(1, "USD"), details)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	txs, _, err := service.Transactions(Filter{Reference: "order-1"}, page.New("", 0))
+	if err != nil || len(txs) != 1 || txs[0].ID != created.ID || txs[0].Description != "dinner" || txs[0].Metadata["table"] != "4" {
+		t.Errorf("expected transaction found by reference, got %+v %v", txs, err)
+	}
+}
+
+func TestTransactionRecover(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	// left pending by a crash before settlement
+	tx := New("123", "222", money.New(30, "USD"))
+	tx.Create()
+	tx.Commit()
+	MemRepoTransaction{store}.Store(tx)
+
+	settled := New("123", "222", money.New(50, "USD"))
+	settled.Create()
+	settled.Status = StatusOK
+	MemRepoTransaction{store}.Store(settled)
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{})
+	go service.Watch()
+
+	// recovering twice must settle only once
+	if n := service.Recover(); n != 1 {
+		t.Errorf("expected 1 pending transaction, got %v", n)
+		return
+	}
+	service.Recover()
+
+	if !waitStatus(t, store, tx.ID, StatusOK) {
+		return
+	}
+	// wait for the second enqueue to be processed
+	next := New("123", "222", money.New(0, "USD"))
+	next.Create()
+	next.Commit()
+	MemRepoTransaction{store}.Store(next)
+	service.Recover()
+	waitStatus(t, store, next.ID, StatusOK)
+
+	if b := store.balance("123", "USD"); b.Units != 70 {
+		t.Errorf("invalid sender balance, want %v got %v", 70, b.Units)
+	}
+	if b := store.balance("222", "USD"); b.Units != 30 {
+		t.Errorf("invalid receiver balance, want %v got %v", 30, b.Units)
+	}
+}
+
+func TestTransactionWatchFailures(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(10, "USD"))
+	store.fund("222", money.New(0, "USD"))
+	store.panicOn = "boom"
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{})
+	go service.Watch()
+
+	commit := func(from string, to string, units int64) *Transaction {
+		tx, err := service.CreateTransaction(context.Background(), from, to, money.New(units, "USD"), Details{})
+		if err != nil {
+			t.Errorf("transaction creation error %v", err)
+			return nil
+		}
+		if _, err := service.CommitTransaction(context.Background(), tx.ID); err != nil {
+			t.Errorf("error commit transaction %v", err)
+			return nil
+		}
+		return tx
+	}
+
+	poor := commit("123", "222", 50)
+	if poor == nil || !waitStatus(t, store, poor.ID, StatusInsufficientFunds) {
+		return
+	}
+	if reason := store.transaction(poor.ID).FailureReason; reason != ReasonInsufficientFunds {
+		t.Errorf("failure reason is wrong, want %v got %v", ReasonInsufficientFunds, reason)
+	}
+
+	// receiver removed after the transaction was committed
+	orphan := &Transaction{ID: "orphan", From: "123", To: "missing", Status: StatusPending, Amount: money.New(1, "USD")}
+	MemRepoTransaction{store}.Store(orphan)
+	service.Recover()
+	if !waitStatus(t, store, orphan.ID, StatusFailed) {
+		return
+	}
+	if reason := store.transaction(orphan.ID).FailureReason; reason != ReasonAccountNotFound {
+		t.Errorf("failure reason is wrong, want %v got %v", ReasonAccountNotFound, reason)
+	}
+
+	// crash while settling single transaction
+	boom := &Transaction{ID: "boom", From: "123", To: "222", Status: StatusPending, Amount: money.New(1, "USD")}
+	MemRepoTransaction{store}.Store(boom)
+	service.Recover()
+	if !waitStatus(t, store, boom.ID, StatusFailed) {
+		return
+	}
+	if reason := store.transaction(boom.ID).FailureReason; reason != ReasonInternal {
+		t.Errorf("failure reason is wrong, want %v got %v", ReasonInternal, reason)
+	}
+
+	// the worker is still alive and settles the next transaction
+	ok := commit("123", "222", 10)
+	if ok == nil || !waitStatus(t, store, ok.ID, StatusOK) {
+		return
+	}
+	if b := store.balance("222", "USD"); b.Units != 10 {
+		t.Errorf("invalid receiver balance, want %v got %v", 10, b.Units)
+	}
+}
+
+func TestTransactionWorkerPool(t *testing.T) {
+	store := newMemStore()
+	store.latency = time.Millisecond
+	accounts := []string{"a", "b", "c", "d", "e", "f"}
+	for _, id := range accounts {
+		store.fund(id, money.New(10, "USD"))
+	}
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{Workers: 4})
+	go service.Watch()
+
+	// every account sends and receives, 20 times more than it has
+	var txs []*Transaction
+	for i := 0; i < 120; i++ {
+		from := accounts[i%len(accounts)]
+		to := accounts[(i+1+i/len(accounts))%len(accounts)]
+		if from == to {
+			continue
+		}
+		tx, err := service.CreateTransaction(context.Background(), from, to, money.New(1, "USD"), Details{})
+		if err != nil {
+			t.Errorf("transaction creation error %v", err)
+			return
+		}
+		if _, err := service.CommitTransaction(context.Background(), tx.ID); err != nil {
+			t.Errorf("error commit transaction %v", err)
+			return
+		}
+		txs = append(txs, tx)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, tx := range txs {
+		for store.status(tx.ID) == StatusPending && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if store.status(tx.ID) == StatusPending {
+			t.Errorf("transaction %v was not settled", tx.ID)
+			return
+		}
+	}
+
+	store.Lock()
+	overlap := store.overlap
+	store.Unlock()
+	if overlap {
+		t.Error("transactions of the same account were settled in parallel")
+	}
+
+	var total int64
+	for _, id := range accounts {
+		b := store.balance(id, "USD")
+		if b.Units < 0 {
+			t.Errorf("account %v overdrawn %v", id, b)
+		}
+		total += b.Units
+	}
+	if total != 60 {
+		t.Errorf("money created or destroyed, total %v", total)
+	}
+}
+
+func TestTransactionBackpressure(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	// settlement is not running, so the queue never drains
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{
+		QueueSize:      1,
+		EnqueueTimeout: time.Millisecond,
+	})
+	ctx := context.Background()
+
+	first, _ := service.CreateTransaction(ctx, "123", "222", money.New(1, "USD"), Details{})
+	second, _ := service.CreateTransaction(ctx, "123", "222", money.New(1, "USD"), Details{})
+	if _, err := service.CreateTransaction(ctx, "123", "222", money.New(1, "USD"), Details{}); err != nil {
+		t.Errorf("creation must not block on full event queue, got %v", err)
+		return
+	}
+
+	if _, err := service.CommitTransaction(ctx, first.ID); err != nil {
+		t.Errorf("error commit transaction %v", err)
+		return
+	}
+	if depth := service.QueueDepth(); depth != 1 {
+		t.Errorf("invalid queue depth, want %v got %v", 1, depth)
+		return
+	}
+
+	if _, err := service.CommitTransaction(ctx, second.ID); err != ErrQueueFull {
+		t.Errorf("expected queue full error, got %v", err)
+		return
+	}
+	if status := store.status(second.ID); status != StatusCreated {
+		t.Errorf("rejected commit must be retryable, want %v got %v", StatusCreated, status)
+		return
+	}
+	if committed := store.transaction(second.ID).CommittedAt; committed != nil {
+		t.Errorf("rejected commit must not keep commit time, got %v", committed)
+		return
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := service.CommitTransaction(cancelled, second.ID); err != context.Canceled {
+		t.Errorf("expected cancelled context error, got %v", err)
+		return
+	}
+
+	ir := &FakeRepoIdempotency{records: make(map[string]*idempotency.Record)}
+	handler := MakeHandler(service, currency.NewService(&FakeRepoCurrency{}), ir, logger)
+	req, _ := http.NewRequest("PUT", "/transactions/"+second.ID+"/commit", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for full queue, got %v", rr.Code)
+		return
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+}
+
+func TestTransactionStop(t *testing.T) {
+	store := newMemStore()
+	store.latency = 50 * time.Millisecond
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{})
+	go service.Watch()
+
+	var txs []*Transaction
+	for i := 0; i < 3; i++ {
+		tx, _ := service.CreateTransaction(context.Background(), "123", "222", money.New(10, "USD"), Details{})
+		if _, err := service.CommitTransaction(context.Background(), tx.ID); err != nil {
+			t.Errorf("error commit transaction %v", err)
+			return
+		}
+		txs = append(txs, tx)
+	}
+
+	// stop while the first transfer is in progress
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.Lock()
+		busy := len(store.inFlight) > 0
+		store.Unlock()
+		if busy || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := service.Stop(ctx); err != nil {
+		t.Errorf("error stopping service %v", err)
+		return
+	}
+	if status := store.status(txs[0].ID); status != StatusOK {
+		t.Errorf("in-flight transfer must finish, want %v got %v", StatusOK, status)
+		return
+	}
+	for _, tx := range txs[1:] {
+		if status := store.status(tx.ID); status != StatusPending {
+			t.Errorf("queued transaction must stay pending, want %v got %v", StatusPending, status)
+			return
+		}
+	}
+	if b := store.balance("123", "USD"); b.Units != 90 {
+		t.Errorf("invalid sender balance, want %v got %v", 90, b.Units)
+	}
+
+	// stopping twice is safe and nothing is left to settle
+	if err := service.Stop(ctx); err != nil {
+		t.Errorf("error stopping service twice %v", err)
+	}
+	if depth := service.QueueDepth(); depth != 0 {
+		t.Errorf("expected drained queue, got %v", depth)
+		return
+	}
+
+	// Stop right after Watch is started waits for everything Watch started, run with -race
+	for i := 0; i < 1000; i++ {
+		racing := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, log.NewNopLogger(), Config{
+			TTL: time.Hour,
+		})
+		watching := make(chan struct{})
+		go func() {
+			close(watching)
+			racing.Watch()
+		}()
+		<-watching
+		if err := racing.Stop(ctx); err != nil {
+			t.Errorf("error stopping service %v", err)
+			return
+		}
+	}
+}
+
+func TestTransactionExpire(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	svc := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{}).(*service)
+
+	stale, _ := svc.CreateTransaction(context.Background(), "123", "222", money.New(10, "USD"), Details{})
+	committed, _ := svc.CreateTransaction(context.Background(), "123", "222", money.New(10, "USD"), Details{})
+	svc.CommitTransaction(context.Background(), committed.ID)
+	before := now()
+	fresh, _ := svc.CreateTransaction(context.Background(), "123", "222", money.New(10, "USD"), Details{})
+	store.Lock()
+	tx := store.transactions[fresh.ID]
+	tx.CreatedAt = before.Add(time.Second)
+	store.transactions[fresh.ID] = tx
+	store.Unlock()
+
+	if expired := svc.expire(before); expired != 1 {
+		t.Errorf("expected one expired transaction, got %v", expired)
+		return
+	}
+	for id, want := range map[string]TransactionStatus{stale.ID: StatusExpired, committed.ID: StatusPending, fresh.ID: StatusCreated} {
+		if status := store.status(id); status != want {
+			t.Errorf("transaction %v status is wrong, want %v got %v", id, want, status)
+		}
+	}
+	if _, err := svc.CommitTransaction(context.Background(), stale.ID); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict committing expired transaction, got %v", err)
+	}
+
+	// sweeper expires in the background
+	sweeping := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{
+		TTL:           time.Millisecond,
+		SweepInterval: time.Millisecond,
+	})
+	go sweeping.Watch()
+	waitStatus(t, store, fresh.ID, StatusExpired)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sweeping.Stop(ctx); err != nil {
+		t.Errorf("error stopping service %v", err)
+	}
+}
+
+func TestTransactionCreditLimit(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(10, "USD"))
+	store.fund("222", money.New(0, "USD"))
+	MemRepoAccount{store}.Update("123", func(acc *account.Account) error {
+		acc.SetCreditLimit(money.New(50, "USD"))
+		return nil
+	})
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{})
+	go service.Watch()
+	ctx := context.Background()
+
+	within, _ := service.CreateTransaction(ctx, "123", "222", money.New(60, "USD"), Details{})
+	service.CommitTransaction(ctx, within.ID)
+	if !waitStatus(t, store, within.ID, StatusOK) {
+		return
+	}
+	if b := store.balance("123", "USD"); b.Units != -50 {
+		t.Errorf("invalid sender balance, want %v got %v", -50, b.Units)
+	}
+
+	over, _ := service.CreateTransaction(ctx, "123", "222", money.New(1, "USD"), Details{})
+	service.CommitTransaction(ctx, over.ID)
+	waitStatus(t, store, over.ID, StatusInsufficientFunds)
+
+	stop, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	service.Stop(stop)
+}
+
+func TestTransactionInactiveAccount(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+	freeze := func(id string) {
+		MemRepoAccount{store}.Update(id, (*account.Account).Freeze)
+	}
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{})
+	ctx := context.Background()
+
+	tx, err := service.CreateTransaction(ctx, "123", "222", money.New(10, "USD"), Details{})
+	if err != nil {
+		t.Errorf("transaction creation error %v", err)
+		return
+	}
+	service.CommitTransaction(ctx, tx.ID)
+
+	// receiver frozen after commit, settlement fails without moving money
+	freeze("222")
+	go service.Watch()
+	if !waitStatus(t, store, tx.ID, StatusFailed) {
+		return
+	}
+	if reason := store.transaction(tx.ID).FailureReason; reason != ReasonAccountInactive {
+		t.Errorf("failure reason is wrong, want %v got %v", ReasonAccountInactive, reason)
+	}
+	if b := store.balance("123", "USD"); b.Units != 100 {
+		t.Errorf("invalid sender balance, want %v got %v", 100, b.Units)
+	}
+
+	if _, err := service.CreateTransaction(ctx, "123", "222", money.New(10, "USD"), Details{}); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict creating transaction to frozen account, got %v", err)
+	}
+
+	stop, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	service.Stop(stop)
+}
+
+func TestTransactionRefund(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	svc := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{}).(*service)
+	go svc.Watch()
+	ctx := context.Background()
+
+	tx, _ := svc.CreateTransaction(ctx, "123", "222", money.New(10, "USD"), Details{})
+	svc.CommitTransaction(ctx, tx.ID)
+	if !waitStatus(t, store, tx.ID, StatusOK) {
+		return
+	}
+
+	partial := money.New(4, "USD")
+	refund, err := svc.RefundTransaction(ctx, tx.ID, &partial)
+	if err != nil {
+		t.Errorf("error refunding transaction %v", err)
+		return
+	}
+	if refund.RefundOf != tx.ID || refund.Status != StatusPending {
+		t.Errorf("expected pending refund linked to %v, got %+v", tx.ID, refund)
+		return
+	}
+	if !waitStatus(t, store, refund.ID, StatusOK) {
+		return
+	}
+	if b := store.balance("123", "USD"); b.Units != 94 {
+		t.Errorf("invalid sender balance after refund, want %v got %v", 94, b.Units)
+		return
+	}
+
+	// receiver spent the money, refund fails and the amount is refundable again
+	store.fund("222", money.New(0, "USD"))
+	failed, err := svc.RefundTransaction(ctx, tx.ID, nil)
+	if err != nil {
+		t.Errorf("error refunding transaction %v", err)
+		return
+	}
+	if !waitStatus(t, store, failed.ID, StatusInsufficientFunds) {
+		return
+	}
+
+	stop, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	svc.Stop(stop)
+
+	original := store.transaction(tx.ID)
+	if refunded := original.Refunded; refunded == nil || refunded.Units != 4 {
+		t.Errorf("invalid refunded amount, want %v got %v", 4, refunded)
+	}
+	if _, err := svc.RefundTransaction(ctx, tx.ID, &money.Money{Units: 7, Currency: "USD"}); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict for refund over the original amount, got %v", err)
+		return
+	}
+
+	// refund left created by a crash gives the amount back when it is cancelled or expires
+	ends := map[TransactionStatus]func(id string){
+		StatusCancelled: func(id string) { svc.CancelTransaction(ctx, id) },
+		StatusExpired:   func(id string) { svc.expireOne(id, now().Add(time.Second)) },
+	}
+	for status, end := range ends {
+		original := store.transaction(tx.ID)
+		refund, err := original.Refund(money.New(2, "USD"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := (MemRepoTransaction{store}).StoreRefund(&original, refund); err != nil {
+			t.Error(err)
+			return
+		}
+		end(refund.ID)
+		if got := store.status(refund.ID); got != status {
+			t.Errorf("refund status is wrong, want %v got %v", status, got)
+			return
+		}
+		if refunded := store.transaction(tx.ID).Refunded; refunded == nil || refunded.Units != 4 {
+			t.Errorf("expected refund amount given back after %v, got %v", status, refunded)
+			return
+		}
+	}
+}
+
+func TestTransactionAuthorize(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	svc := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{HoldTTL: time.Hour}).(*service)
+	go svc.Watch()
+	ctx := context.Background()
+
+	authorize := func(amount int64) Transaction {
+		tx, _ := svc.AuthorizeTransaction(ctx, "123", "222", money.New(amount, "USD"), Details{})
+		svc.CommitTransaction(ctx, tx.ID)
+		waitStatus(t, store, tx.ID, StatusAuthorized)
+		return store.transaction(tx.ID)
+	}
+
+	held := authorize(30)
+	if held.ExpiresAt == nil {
+		t.Error("expected hold expiry")
+		return
+	}
+	sender, _ := MemRepoAccount{store}.Find("123")
+	if sender.BalanceFor("USD").Units != 100 || sender.AvailableFor("USD").Units != 70 {
+		t.Errorf("expected held amount to be unavailable, got %v", sender)
+		return
+	}
+
+	// held amount can not be spent
+	tx, _ := svc.CreateTransaction(ctx, "123", "222", money.New(80, "USD"), Details{})
+	svc.CommitTransaction(ctx, tx.ID)
+	if !waitStatus(t, store, tx.ID, StatusInsufficientFunds) {
+		return
+	}
+
+	partial := money.New(20, "USD")
+	captured, err := svc.CaptureTransaction(ctx, held.ID, &partial)
+	if err != nil || captured.Status != StatusOK {
+		t.Errorf("error capturing transaction %v", err)
+		return
+	}
+	if b := store.balance("123", "USD"); b.Units != 80 {
+		t.Errorf("invalid sender balance after capture, want %v got %v", 80, b.Units)
+	}
+	if b := store.balance("222", "USD"); b.Units != 20 {
+		t.Errorf("invalid receiver balance after capture, want %v got %v", 20, b.Units)
+	}
+	if _, err := svc.CaptureTransaction(ctx, held.ID, nil); !problem.Is(err, problem.Conflict) {
+		t.Errorf("expected conflict capturing twice, got %v", err)
+	}
+
+	voided, err := svc.VoidTransaction(ctx, authorize(10).ID)
+	if err != nil || voided.Status != StatusVoided {
+		t.Errorf("error voiding transaction %v", err)
+		return
+	}
+
+	expiring := authorize(10)
+	if released := svc.expireHolds(now()); released != 0 {
+		t.Errorf("expected no released holds before expiry, got %v", released)
+	}
+	if released := svc.expireHolds(now().Add(2 * time.Hour)); released != 1 {
+		t.Errorf("expected one released hold, got %v", released)
+	}
+	if status := store.status(expiring.ID); status != StatusExpired {
+		t.Errorf("transaction status is wrong, want %v got %v", StatusExpired, status)
+	}
+	sender, _ = MemRepoAccount{store}.Find("123")
+	if len(sender.Held) != 0 || sender.AvailableFor("USD").Units != 80 {
+		t.Errorf("expected all holds released, got %v", sender)
+	}
+
+	stop, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	svc.Stop(stop)
+}
+
+func TestTransactionBatch(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+	store.fund("333", money.New(0, "USD"))
+
+	svc := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, log.NewNopLogger(), Config{})
+	ctx := context.Background()
+	item := func(to string, units int64) BatchItem {
+		return BatchItem{From: "123", To: to, Amount: money.New(units, "USD")}
+	}
+
+	if _, _, err := svc.CreateBatch(ctx, nil); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected invalid error for empty batch, got %v", err)
+		return
+	}
+	if _, _, err := svc.CreateBatch(ctx, []BatchItem{item("222", 1), item("missing", 1)}); !problem.Is(err, problem.NotFound) || !strings.HasPrefix(err.Error(), "transfer 1:") {
+		t.Errorf("expected not found error of the second transfer, got %v", err)
+		return
+	}
+	if len(store.transactions) != 0 {
+		t.Errorf("expected nothing stored for invalid batch, got %v transactions", len(store.transactions))
+		return
+	}
+
+	// every transfer sees balance left by the previous ones
+	batch, txs, err := svc.CreateBatch(ctx, []BatchItem{item("222", 40), item("333", 40), item("222", 30)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if batch.Status != BatchFailed || batch.Failed == nil || *batch.Failed != 2 || batch.FailureReason != ReasonInsufficientFunds {
+		t.Errorf("expected batch failed by the third transfer, got %+v", batch)
+		return
+	}
+	want := []TransactionStatus{StatusFailed, StatusFailed, StatusInsufficientFunds}
+	for i, tx := range txs {
+		stored := store.transaction(tx.ID)
+		if stored.Status != want[i] || stored.Batch != batch.ID {
+			t.Errorf("transfer %v, want %v in batch got %+v", i, want[i], stored)
+		}
+	}
+	if txs[0].FailureReason != ReasonBatchFailed {
+		t.Errorf("expected batch failure reason, got %v", txs[0].FailureReason)
+	}
+	if b := store.balance("123", "USD"); b.Units != 100 {
+		t.Errorf("expected no money moved by failed batch, got %v", b.Units)
+		return
+	}
+
+	batch, txs, err = svc.CreateBatch(ctx, []BatchItem{item("222", 40), item("333", 60)})
+	if err != nil || batch.Status != BatchOK || len(txs) != 2 {
+		t.Errorf("expected settled batch, got %+v %v", batch, err)
+		return
+	}
+	for _, tx := range txs {
+		if tx.Status != StatusOK || store.status(tx.ID) != StatusOK {
+			t.Errorf("expected settled transaction, got %+v", tx)
+		}
+	}
+	if store.balance("123", "USD").Units != 0 || store.balance("222", "USD").Units != 40 || store.balance("333", "USD").Units != 60 {
+		t.Error("invalid balances after batch")
+		return
+	}
+	if history, _ := svc.History(txs[0].ID); len(history) != 3 {
+		t.Errorf("expected created, pending and ok in history, got %v", len(history))
+	}
+
+	found, foundTxs, err := svc.GetBatch(batch.ID)
+	if err != nil || found.Status != BatchOK || len(foundTxs) != 2 || foundTxs[1].ID != txs[1].ID {
+		t.Errorf("expected batch with its transactions, got %+v %v", found, err)
+	}
+	if _, _, err := svc.GetBatch("missing"); !problem.Is(err, problem.NotFound) {
+		t.Errorf("expected not found error for missing batch, got %v", err)
+	}
+}
+
+func TestTransactionMultiLeg(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(50, "USD"))
+	for _, id := range []string{"seller", "platform", "tax"} {
+		store.fund(id, money.New(0, "USD"))
+	}
+
+	svc := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, log.NewNopLogger(), Config{})
+	go svc.Watch()
+	defer svc.Stop(context.Background())
+	ctx := context.Background()
+
+	sources := []Leg{{Account: "123", Amount: money.New(100, "USD")}, {Account: "222", Amount: money.New(20, "USD")}}
+	destinations := []Leg{{Account: "seller", Amount: money.New(100, "USD")}, {Account: "platform", Amount: money.New(15, "USD")}, {Account: "tax", Amount: money.New(5, "USD")}}
+	if _, err := svc.CreateMultiLegTransaction(ctx, sources, append(destinations, Leg{Account: "missing", Amount: money.New(1, "USD")}), Details{}); !problem.Is(err, problem.Invalid) {
+		t.Errorf("expected invalid error for unbalanced legs, got %v", err)
+		return
+	}
+	tx, err := svc.CreateMultiLegTransaction(ctx, sources, destinations, Details{Reference: "order-9"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := svc.CommitTransaction(ctx, tx.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if !waitStatus(t, store, tx.ID, StatusOK) {
+		return
+	}
+	want := map[string]int64{"123": 0, "222": 30, "seller": 100, "platform": 15, "tax": 5}
+	for id, units := range want {
+		if b := store.balance(id, "USD"); b.Units != units {
+			t.Errorf("invalid balance of %v, want %v got %v", id, units, b.Units)
+		}
+	}
+
+	// any source without funds fails the whole transaction
+	tx, _ = svc.CreateMultiLegTransaction(ctx, sources, destinations, Details{})
+	svc.CommitTransaction(ctx, tx.ID)
+	if !waitStatus(t, store, tx.ID, StatusInsufficientFunds) {
+		return
+	}
+	if b := store.balance("222", "USD"); b.Units != 30 {
+		t.Errorf("expected no money moved, got %v", b.Units)
+	}
+}
+
+func TestAccountLocks(t *testing.T) {
+	locks := newAccountLocks()
+	unlock := locks.lock("b", "a", "a")
+
+	acquired := make(chan struct{})
+	released := make(chan struct{})
+	go func() {
+		release := locks.lock("a", "c")
+		close(acquired)
+		release()
+		close(released)
+	}()
+
+	select {
+	case <-acquired:
+		t.Error("lock of shared account acquired while held")
+		return
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// unrelated accounts are not blocked
+	locks.lock("c")()
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Error("lock was not released")
+		return
+	}
+	<-released
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("expected released locks to be removed, got %v", len(locks.locks))
+	}
+}
+
+func benchmarkSettlement(b *testing.B, workers int) {
+	store := newMemStore()
+	store.latency = 50 * time.Microsecond
+	accounts := make([]string, 64)
+	for i := range accounts {
+		accounts[i] = string(rune('A' + i))
+		store.fund(accounts[i], money.New(int64(b.N), "USD"))
+	}
+
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, log.NewNopLogger(), Config{
+		Workers:        workers,
+		EnqueueTimeout: time.Minute,
+	})
+	go service.Watch()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := accounts[i%len(accounts)]
+		to := accounts[(i+1)%len(accounts)]
+		tx, err := service.CreateTransaction(context.Background(), from, to, money.New(1, "USD"), Details{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := service.CommitTransaction(context.Background(), tx.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for {
+		store.Lock()
+		settled := store.settled
+		store.Unlock()
+		if settled == b.N {
+			break
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+func BenchmarkSettlementSingleWorker(b *testing.B) {
+	benchmarkSettlement(b, 1)
+}
+
+func BenchmarkSettlementWorkerPool(b *testing.B) {
+	benchmarkSettlement(b, 8)
+}
+
+func TestTransactionREST(t *testing.T) {
+	tfr := &FakeRepoTransaction{}
+	afr := &FakeRepoAccount{}
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(tfr, afr, logger, Config{})
+	ir := &FakeRepoIdempotency{records: make(map[string]*idempotency.Record)}
+	handler := MakeHandler(service, currency.NewService(&FakeRepoCurrency{}), ir, logger)
+
+	makeStatusRequest(t, "POST", "/transactions", nil, http.StatusBadRequest, handler)
+
+	rr := makeRequest(t, "GET", "/transactions", handler)
+	listRes := listTransactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+		t.Error(err)
+		return
+	}
+
+	rr = makeRequest(t, "GET", "/transactions/123", handler)
+	res := transactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Transaction == nil || res.Transaction.ID != "123" {
+		t.Errorf("expected transaction 123, got %+v", res.Transaction)
+		return
+	}
+
+	rr = makeRequest(t, "PUT", "/transactions/123/commit", handler)
+	res = transactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Transaction == nil || res.Transaction.Status != StatusPending {
+		t.Errorf("expected committed transaction, got %+v", res.Transaction)
+		return
+	}
+
+	rr = makeRequest(t, "GET", "/transactions/123/hash", handler)
+	hashRes := hashTransactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&hashRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if hashRes.Hash == "" {
+		t.Error("expected transaction hash, got empty")
+		return
+	}
+	t.Log(hashRes.Hash)
+
+	// retried commit with idempotency key returns the first response
+	req, _ := http.NewRequest("PUT", "/transactions/123/commit", nil)
+	req.Header.Set(idempotency.HeaderKey, "commit-123")
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, req)
+	retry := httptest.NewRecorder()
+	handler.ServeHTTP(retry, req)
+	if retry.Header().Get(idempotency.HeaderReplayed) != "true" || retry.Body.String() != first.Body.String() {
+		t.Errorf("expected replayed commit response, got %v", retry.Body.String())
+	}
+	if len(ir.records) != 1 {
+		t.Errorf("expected 1 idempotency record, got %v", len(ir.records))
+	}
+}
+
+func TestTransactionRESTErrors(t *testing.T) {
+	store := newMemStore()
+	store.fund("123", money.New(100, "USD"))
+	store.fund("222", money.New(0, "USD"))
+
+	var logger = log.NewLogfmtLogger(os.Stderr)
+	service := NewService(MemRepoTransaction{store}, MemRepoAccount{store}, logger, Config{QueueSize: 1})
+	ir := &FakeRepoIdempotency{records: make(map[string]*idempotency.Record)}
+	handler := MakeHandler(service, currency.NewService(&FakeRepoCurrency{}), ir, logger)
+
+	cases := map[string]int{
+		`{"from":"123","to":"222","amount":"1","currency":"USD"}`:     http.StatusOK,
+		`{"from":"123","to":"missing","amount":"1","currency":"USD"}`: http.StatusNotFound,
+		`{"from":"123","to":"222","amount":"0","currency":"USD"}`:     http.StatusBadRequest,
+		`{"from":"123","to":"222","amount":"1.001","currency":"USD"}`: http.StatusBadRequest,
+		`{"from":"123","to":"222","amount":"1","currency":"FOO"}`:     http.StatusBadRequest,
+		`{"from":"123","to":"222"`:                                    http.StatusBadRequest,
+	}
+	var created transactionsResponse
+	for body, status := range cases {
+		rr := makeStatusRequest(t, "POST", "/transactions", strings.NewReader(body), status, handler)
+		if rr == nil {
+			continue
+		}
+		if status == http.StatusOK {
+			json.NewDecoder(rr.Body).Decode(&created)
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != problem.ContentType {
+			t.Errorf("expected problem content type for %v, got %v", body, ct)
+		}
+		details := problem.Details{}
+		if err := json.NewDecoder(rr.Body).Decode(&details); err != nil {
+			t.Error(err)
+			continue
+		}
+		if details.Status != status || details.Detail == "" {
+			t.Errorf("unexpected problem for %v: %+v", body, details)
+		}
+	}
+	if created.Transaction == nil {
+		t.Error("expected created transaction")
+		return
+	}
+
+	makeStatusRequest(t, "GET", "/transactions/missing", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "GET", "/transactions?amount_min=1", nil, http.StatusBadRequest, handler)
+	makeStatusRequest(t, "GET", "/transactions?currency=USD&amount_max=abc", nil, http.StatusBadRequest, handler)
+	makeStatusRequest(t, "GET", "/transactions?limit=0", nil, http.StatusBadRequest, handler)
+	makeStatusRequest(t, "GET", "/transactions?created_from=yesterday", nil, http.StatusBadRequest, handler)
+
+	rr := makeRequest(t, "GET", "/transactions?created_to=2000-01-01T00:00:00Z", handler)
+	listRes := listTransactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(listRes.Transactions) != 0 {
+		t.Errorf("expected no transactions created before 2000, got %v", len(listRes.Transactions))
+		return
+	}
+
+	rr = makeRequest(t, "GET", "/transactions?currency=usd&amount_min=1&amount_max=1.00&from=123&status=created&created_from=2000-01-01T00:00:00Z", handler)
+	listRes = listTransactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(listRes.Transactions) != 1 || listRes.Transactions[0].ID != created.Transaction.ID {
+		t.Errorf("expected created transaction, got %+v", listRes.Transactions)
+		return
+	}
+
+	makeStatusRequest(t, "GET", "/accounts/missing/transactions", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "GET", "/accounts/123/transactions?direction=sideways", nil, http.StatusBadRequest, handler)
+	for direction, want := range map[string]int{"": 1, "outgoing": 1, "incoming": 0} {
+		rr = makeRequest(t, "GET", "/accounts/123/transactions?direction="+direction, handler)
+		listRes = listTransactionsResponse{}
+		if err := json.NewDecoder(rr.Body).Decode(&listRes); err != nil {
+			t.Error(err)
+			return
+		}
+		if len(listRes.Transactions) != want {
+			t.Errorf("direction %q, want %v got %v", direction, want, len(listRes.Transactions))
+		}
+	}
+
+	makeStatusRequest(t, "PUT", "/transactions/missing/commit", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "PUT", "/transactions/"+created.Transaction.ID+"/commit", nil, http.StatusOK, handler)
+	makeStatusRequest(t, "PUT", "/transactions/"+created.Transaction.ID+"/commit", nil, http.StatusConflict, handler)
+
+	makeStatusRequest(t, "DELETE", "/transactions/missing", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "PUT", "/transactions/missing/cancel", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "DELETE", "/transactions/"+created.Transaction.ID, nil, http.StatusConflict, handler)
+
+	cancelled := transactionsResponse{}
+	rr = makeStatusRequest(t, "POST", "/transactions", strings.NewReader(`{"from":"123","to":"222","amount":"1","currency":"USD","description":"lunch","reference":" order-7 ","metadata":{"table":"4"}}`), http.StatusOK, handler)
+	if err := json.NewDecoder(rr.Body).Decode(&cancelled); err != nil {
+		t.Error(err)
+		return
+	}
+	rr = makeStatusRequest(t, "PUT", "/transactions/"+cancelled.Transaction.ID+"/cancel", nil, http.StatusOK, handler)
+	if err := json.NewDecoder(rr.Body).Decode(&cancelled); err != nil {
+		t.Error(err)
+		return
+	}
+	if cancelled.Transaction.Status != StatusCancelled {
+		t.Errorf("transaction status is wrong, want %v got %v", StatusCancelled, cancelled.Transaction.Status)
+		return
+	}
+	if cancelled.Transaction.Reference != "order-7" || cancelled.Transaction.Description != "lunch" || cancelled.Transaction.Metadata["table"] != "4" {
+		t.Errorf("expected transaction details, got %+v", cancelled.Transaction)
+		return
+	}
+	makeRequest(t, "GET", "/transactions?reference=order-7", handler)
+	makeStatusRequest(t, "POST", "/transactions", strings.NewReader(`{"from":"123","to":"222","amount":"1","currency":"USD","metadata":{"":"x"}}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "DELETE", "/transactions/"+cancelled.Transaction.ID, nil, http.StatusConflict, handler)
+	makeStatusRequest(t, "PUT", "/transactions/"+cancelled.Transaction.ID+"/commit", nil, http.StatusConflict, handler)
+
+	makeStatusRequest(t, "POST", "/transactions", strings.NewReader(`{"from":"123","to":"222","amount":"1","currency":"USD","mode":"later"}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "PUT", "/transactions/missing/void", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "PUT", "/transactions/"+created.Transaction.ID+"/void", nil, http.StatusConflict, handler)
+	makeStatusRequest(t, "PUT", "/transactions/"+created.Transaction.ID+"/capture", nil, http.StatusConflict, handler)
+	makeStatusRequest(t, "PUT", "/transactions/"+created.Transaction.ID+"/capture", strings.NewReader(`{"amount":"abc"}`), http.StatusBadRequest, handler)
+
+	makeStatusRequest(t, "POST", "/transactions/missing/refund", nil, http.StatusNotFound, handler)
+	makeStatusRequest(t, "POST", "/transactions/"+created.Transaction.ID+"/refund", nil, http.StatusConflict, handler)
+	makeStatusRequest(t, "POST", "/transactions/"+created.Transaction.ID+"/refund", strings.NewReader(`{"amount":"0.001"}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "POST", "/transactions/"+created.Transaction.ID+"/refund", strings.NewReader(`{"amount":`), http.StatusBadRequest, handler)
+
+	makeStatusRequest(t, "GET", "/transactions/missing/history", nil, http.StatusNotFound, handler)
+	rr = makeRequest(t, "GET", "/transactions/"+created.Transaction.ID+"/history", handler)
+	historyRes := historyTransactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&historyRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(historyRes.History) != 2 || historyRes.History[0].To != StatusCreated || historyRes.History[1].To != StatusPending {
+		t.Errorf("expected created and pending history, got %+v", historyRes.History)
+		return
+	}
+
+	legs := `"sources":[{"account":"123","amount":"0.30","currency":"USD"}],"destinations":[{"account":"222","amount":"0.25","currency":"USD"},{"account":"222","amount":"0.05","currency":"usd"}]`
+	makeStatusRequest(t, "POST", "/transactions", strings.NewReader(`{"from":"123",`+legs+`}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "POST", "/transactions", strings.NewReader(`{"sources":[{"account":"123","amount":"1","currency":"USD"}],"destinations":[{"account":"222","amount":"2","currency":"USD"}]}`), http.StatusBadRequest, handler)
+	rr = makeStatusRequest(t, "POST", "/transactions", strings.NewReader(`{`+legs+`}`), http.StatusOK, handler)
+	multiLeg := transactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&multiLeg); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(multiLeg.Transaction.Sources) != 1 || len(multiLeg.Transaction.Destinations) != 2 || multiLeg.Transaction.Amount.Units != 30 {
+		t.Errorf("expected transaction with legs, got %+v", multiLeg.Transaction)
+		return
+	}
+
+	makeStatusRequest(t, "POST", "/transactions/batch", strings.NewReader(`{"transfers":[]}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "POST", "/transactions/batch", strings.NewReader(`{"transfers":[{"from":"123","to":"222","amount":"1","currency":"USD","mode":"authorize"}]}`), http.StatusBadRequest, handler)
+	makeStatusRequest(t, "POST", "/transactions/batch", strings.NewReader(`{"transfers":[{"from":"123","to":"222","amount":"1","currency":"USD"},{"from":"123","to":"missing","amount":"1","currency":"USD"}]}`), http.StatusNotFound, handler)
+	rr = makeStatusRequest(t, "POST", "/transactions/batch", strings.NewReader(`{"transfers":[{"from":"123","to":"222","amount":"0.10","currency":"USD"},{"from":"123","to":"222","amount":"0.25","currency":"usd","reference":"payroll"}]}`), http.StatusOK, handler)
+	batchRes := batchTransactionsResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&batchRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if batchRes.Batch.Status != BatchOK || len(batchRes.Transactions) != 2 || batchRes.Transactions[1].Amount.Units != 25 {
+		t.Errorf("expected settled batch, got %+v", batchRes.Batch)
+		return
+	}
+	makeStatusRequest(t, "GET", "/transactions/batch/missing", nil, http.StatusNotFound, handler)
+	rr = makeRequest(t, "GET", "/transactions/batch/"+batchRes.Batch.ID, handler)
+	if err := json.NewDecoder(rr.Body).Decode(&batchRes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(batchRes.Transactions) != 2 || batchRes.Transactions[0].Batch != batchRes.Batch.ID {
+		t.Errorf("expected batch transactions, got %+v", batchRes.Transactions)
+	}
+}
+
+func makeRequest(t *testing.T, method string, path string, handler http.Handler) *httptest.ResponseRecorder {
+	return makeStatusRequest(t, method, path, nil, http.StatusOK, handler)
+}
+
+func makeStatusRequest(t *testing.T, method string, path string, body io.Reader, status int, handler http.Handler) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, body)
 	if err != nil {
 		t.Error(err)
 		return nil
 	}
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("error from http, expected 200 got %v", rr.Code)
+	if rr.Code != status {
+		t.Errorf("error from http %v %v, expected %v got %v", method, path, status, rr.Code)
 		return nil
 	}
 	return rr
@@ -3,9 +3,15 @@ package transaction
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"io"
 	"net/http"
+	"strconv"
 
+	"github.com/MarinX/kit-payment/currency"
+	"github.com/MarinX/kit-payment/idempotency"
+	"github.com/MarinX/kit-payment/money"
+	"github.com/MarinX/kit-payment/page"
+	"github.com/MarinX/kit-payment/problem"
 	"github.com/gorilla/mux"
 
 	kitlog "github.com/go-kit/kit/log"
@@ -13,15 +19,17 @@ import (
 )
 
 // MakeHandler returns a handler for the transaction service.
-func MakeHandler(ts Service, logger kitlog.Logger) http.Handler {
+// Requests changing transactions honor the Idempotency-Key header.
+func MakeHandler(ts Service, cs currency.Service, records idempotency.Repository, logger kitlog.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeError),
 	}
 
 	transactionsHandler := kithttp.NewServer(
-		makeTransactionsEndpoint(ts),
+		makeTransactionsEndpoint(ts, cs),
 		decodeTransactionsRequest,
 		encodeResponse,
 		opts...,
@@ -34,6 +42,13 @@ func MakeHandler(ts Service, logger kitlog.Logger) http.Handler {
 		opts...,
 	)
 
+	accountTransactionsHandler := kithttp.NewServer(
+		makeAccountTransactionsEndpoint(ts),
+		decodeAccountTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
 	transactionsGetHandler := kithttp.NewServer(
 		makeGetTransactionsEndpoint(ts),
 		decodeGetTransactionsRequest,
@@ -48,6 +63,34 @@ func MakeHandler(ts Service, logger kitlog.Logger) http.Handler {
 		opts...,
 	)
 
+	transactionsRefundHandler := kithttp.NewServer(
+		makeRefundTransactionsEndpoint(ts, cs),
+		decodeRefundTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	transactionsCaptureHandler := kithttp.NewServer(
+		makeCaptureTransactionsEndpoint(ts, cs),
+		decodeCaptureTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	transactionsVoidHandler := kithttp.NewServer(
+		makeVoidTransactionsEndpoint(ts),
+		decodeVoidTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	transactionsCancelHandler := kithttp.NewServer(
+		makeCancelTransactionsEndpoint(ts),
+		decodeCancelTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
 	transactionsHashHandler := kithttp.NewServer(
 		makeHashTransactionsEndpoint(ts),
 		decodeHashTransactionsRequest,
@@ -55,11 +98,42 @@ func MakeHandler(ts Service, logger kitlog.Logger) http.Handler {
 		opts...,
 	)
 
-	r.Handle("/transactions", transactionsHandler).Methods("POST")
+	transactionsHistoryHandler := kithttp.NewServer(
+		makeHistoryTransactionsEndpoint(ts),
+		decodeHistoryTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	transactionsBatchHandler := kithttp.NewServer(
+		makeBatchTransactionsEndpoint(ts, cs),
+		decodeBatchTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	transactionsBatchGetHandler := kithttp.NewServer(
+		makeGetBatchTransactionsEndpoint(ts),
+		decodeGetBatchTransactionsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	r.Handle("/transactions", idempotency.Middleware(records, logger, transactionsHandler)).Methods("POST")
 	r.Handle("/transactions", transactionsListHandler).Methods("GET")
+	// batch routes go before transaction routes, so batch IDs are not taken for transaction actions
+	r.Handle("/transactions/batch", idempotency.Middleware(records, logger, transactionsBatchHandler)).Methods("POST")
+	r.Handle("/transactions/batch/{id}", transactionsBatchGetHandler).Methods("GET")
 	r.Handle("/transactions/{id}", transactionsGetHandler).Methods("GET")
-	r.Handle("/transactions/{id}/commit", transactionsCommitHandler).Methods("PUT")
+	r.Handle("/transactions/{id}", idempotency.Middleware(records, logger, transactionsCancelHandler)).Methods("DELETE")
+	r.Handle("/transactions/{id}/commit", idempotency.Middleware(records, logger, transactionsCommitHandler)).Methods("PUT")
+	r.Handle("/transactions/{id}/capture", idempotency.Middleware(records, logger, transactionsCaptureHandler)).Methods("PUT")
+	r.Handle("/transactions/{id}/void", idempotency.Middleware(records, logger, transactionsVoidHandler)).Methods("PUT")
+	r.Handle("/transactions/{id}/refund", idempotency.Middleware(records, logger, transactionsRefundHandler)).Methods("POST")
+	r.Handle("/transactions/{id}/cancel", idempotency.Middleware(records, logger, transactionsCancelHandler)).Methods("PUT")
 	r.Handle("/transactions/{id}/hash", transactionsHashHandler).Methods("GET")
+	r.Handle("/transactions/{id}/history", transactionsHistoryHandler).Methods("GET")
+	r.Handle("/accounts/{id}/transactions", accountTransactionsHandler).Methods("GET")
 
 	return r
 }
@@ -68,17 +142,35 @@ func decodeTransactionsRequest(_ context.Context, r *http.Request) (interface{},
 	var body transactionsRequest
 	if r.Body != nil {
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			return nil, err
+			return nil, problem.Wrap(problem.Invalid, err)
 		}
 	}
 	return body, nil
 }
 
+func decodeAccountTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	q := r.URL.Query()
+	p, err := page.FromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return accountTransactionsRequest{
+		AccountID: id,
+		Direction: Direction(q.Get("direction")),
+		Page:      p,
+	}, nil
+}
+
 func decodeGetTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
-		return nil, errors.New("bad request")
+		return nil, problem.New(problem.Invalid, "bad request")
 	}
 	return getTransactionsRequest{
 		ID: id,
@@ -86,32 +178,143 @@ func decodeGetTransactionsRequest(_ context.Context, r *http.Request) (interface
 }
 
 func decodeListTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return listTransactionsRequest{}, nil
+	q := r.URL.Query()
+	p, err := page.FromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return listTransactionsRequest{
+		Status:      TransactionStatus(q.Get("status")),
+		Currency:    money.Currency(q.Get("currency")),
+		From:        q.Get("from"),
+		To:          q.Get("to"),
+		MinAmount:   q.Get("amount_min"),
+		MaxAmount:   q.Get("amount_max"),
+		CreatedFrom: q.Get("created_from"),
+		CreatedTo:   q.Get("created_to"),
+		Reference:   q.Get("reference"),
+		Page:        p,
+	}, nil
 }
 
 func decodeCommitTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
-		return nil, errors.New("bad request")
+		return nil, problem.New(problem.Invalid, "bad request")
 	}
 	return commitTransactionsRequest{
 		ID: id,
 	}, nil
 }
 
+// decodeRefundTransactionsRequest accepts empty body for full refund
+func decodeRefundTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	req := refundTransactionsRequest{}
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			return nil, problem.Wrap(problem.Invalid, err)
+		}
+	}
+	req.ID = id
+	return req, nil
+}
+
+// decodeCaptureTransactionsRequest accepts empty body for full capture
+func decodeCaptureTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	req := captureTransactionsRequest{}
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			return nil, problem.Wrap(problem.Invalid, err)
+		}
+	}
+	req.ID = id
+	return req, nil
+}
+
+func decodeVoidTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return voidTransactionsRequest{
+		ID: id,
+	}, nil
+}
+
+func decodeCancelTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return cancelTransactionsRequest{
+		ID: id,
+	}, nil
+}
+
 func decodeHashTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
-		return nil, errors.New("bad request")
+		return nil, problem.New(problem.Invalid, "bad request")
 	}
 	return hashTransactionsRequest{
 		ID: id,
 	}, nil
 }
 
+func decodeHistoryTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return historyTransactionsRequest{
+		ID: id,
+	}, nil
+}
+
+func decodeBatchTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var body batchTransactionsRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, problem.Wrap(problem.Invalid, err)
+		}
+	}
+	return body, nil
+}
+
+func decodeGetBatchTransactionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, problem.New(problem.Invalid, "bad request")
+	}
+	return getBatchTransactionsRequest{
+		ID: id,
+	}, nil
+}
+
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	return json.NewEncoder(w).Encode(response)
 }
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if err == ErrQueueFull {
+		w.Header().Set("Retry-After", strconv.Itoa(int(RetryAfter.Seconds())))
+	}
+	problem.EncodeError(ctx, err, w)
+}
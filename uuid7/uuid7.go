@@ -0,0 +1,106 @@
+// Package uuid7 generates time-ordered UUIDs (version 7), so sorting IDs sorts by creation time.
+package uuid7
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+var generator = struct {
+	sync.Mutex
+	last int64
+	seq  uint16
+}{}
+
+// New returns UUIDv7 string. IDs generated by one process are strictly increasing,
+// within the same millisecond the 12 bit counter follows the timestamp.
+func New() string {
+	return At(time.Now())
+}
+
+// At returns UUIDv7 string for the given creation time, ordered with the IDs from New
+func At(t time.Time) string {
+	return format(next(t))
+}
+
+// Min returns the lowest ID created at t, IDs created at t or later sort after it
+func Min(t time.Time) string {
+	var u [16]byte
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+	stamp(&u, ms, 0)
+	return format(u)
+}
+
+// Time returns creation time encoded in the ID with millisecond precision
+func Time(id string) (time.Time, bool) {
+	if len(id) != 36 || id[14] != '7' {
+		return time.Time{}, false
+	}
+	b, err := hex.DecodeString(id[0:8] + id[9:13])
+	if err != nil {
+		return time.Time{}, false
+	}
+	ms := int64(b[0])<<40 | int64(b[1])<<32 | int64(b[2])<<24 | int64(b[3])<<16 | int64(b[4])<<8 | int64(b[5])
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC(), true
+}
+
+func next(now time.Time) [16]byte {
+	generator.Lock()
+	ms := now.UnixNano() / int64(time.Millisecond)
+	if ms <= generator.last {
+		// clock did not move or went back, keep order with the counter
+		ms = generator.last
+		generator.seq++
+		if generator.seq > 0xfff {
+			ms++
+			generator.seq = 0
+		}
+	} else {
+		generator.seq = 0
+	}
+	generator.last = ms
+	seq := generator.seq
+	generator.Unlock()
+	return encode(ms, seq)
+}
+
+func encode(ms int64, seq uint16) [16]byte {
+	var u [16]byte
+	if _, err := rand.Read(u[8:]); err != nil {
+		panic(err)
+	}
+	stamp(&u, ms, seq)
+	return u
+}
+
+// stamp writes timestamp, version, counter and variant bits around the random part
+func stamp(u *[16]byte, ms int64, seq uint16) {
+	u[0] = byte(ms >> 40)
+	u[1] = byte(ms >> 32)
+	u[2] = byte(ms >> 24)
+	u[3] = byte(ms >> 16)
+	u[4] = byte(ms >> 8)
+	u[5] = byte(ms)
+	binary.BigEndian.PutUint16(u[6:8], 0x7000|seq)
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+}
+
+func format(u [16]byte) string {
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf)
+}
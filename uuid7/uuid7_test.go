@@ -0,0 +1,60 @@
+package uuid7
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestNew(t *testing.T) {
+	prev := ""
+	for i := 0; i < 10000; i++ {
+		id := New()
+		if id <= prev {
+			t.Errorf("ids are not increasing, %v after %v", id, prev)
+			return
+		}
+		prev = id
+	}
+
+	parsed, err := uuid.FromString(prev)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if parsed.Version() != 7 || parsed.Variant() != uuid.VariantRFC4122 {
+		t.Errorf("unexpected version %v or variant %v", parsed.Version(), parsed.Variant())
+	}
+}
+
+func TestTime(t *testing.T) {
+	now := time.Date(2019, 3, 1, 12, 30, 0, int(250*time.Millisecond), time.UTC)
+	id := format(encode(now.UnixNano()/int64(time.Millisecond), 0))
+	got, ok := Time(id)
+	if !ok || !got.Equal(now) {
+		t.Errorf("want %v got %v", now, got)
+	}
+
+	if _, ok := Time("fecf39a1-c4f2-4706-8eca-bc71f310eeb6"); ok {
+		t.Error("expected random uuid to have no time")
+	}
+}
+
+func TestMin(t *testing.T) {
+	at := time.Date(2019, 3, 1, 12, 30, 0, int(250*time.Millisecond), time.UTC)
+	min := Min(at)
+	if got, ok := Time(min); !ok || !got.Equal(at) {
+		t.Errorf("want %v got %v", at, got)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		if id := At(at.Add(time.Duration(i) * time.Microsecond * 10)); id < min {
+			t.Errorf("id %v sorts before %v", id, min)
+			return
+		}
+	}
+	if id := format(encode(at.UnixNano()/int64(time.Millisecond)-1, 0xfff)); id >= min {
+		t.Errorf("id %v created earlier sorts after %v", id, min)
+	}
+}